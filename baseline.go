@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"log"
+)
+
+// snapshotBaseline records the rules in effect for a container's cgroup before the daemon first writes
+// to it, so revoking what the daemon added later restores the access the container had before.
+func snapshotBaseline(target deviceTarget) {
+	if !preserveBaseline || tracker.hasBaseline(target.id, target.cgroupPath) {
+		return
+	}
+
+	rules, err := target.api.ListDeviceRules(target.cgroupPath)
+
+	if err != nil {
+		log.Printf("unable to record the pre-existing rules of %s: %v\n", target.id, err)
+		return
+	}
+
+	tracker.setBaseline(target.id, target.cgroupPath, rules)
+}
+
+// revokeRules removes rules the daemon added to a container's cgroup. Removing them denies their
+// devices outright, so with DVD_PRESERVE_BASELINE the pre-existing allows of those devices are then
+// written anew, in reverse as a later rule overrides an earlier one.
+func revokeRules(api cgroup.Interface, id string, cgroupPath string, rules []cgroup.DeviceRule) error {
+	if err := api.RemoveDeviceRules(cgroupPath, rules); err != nil {
+		return err
+	}
+
+	if !preserveBaseline {
+		return nil
+	}
+
+	baseline := tracker.baseline(id, cgroupPath)
+
+	var restore []cgroup.DeviceRule
+
+	for i := len(baseline) - 1; i >= 0; i-- {
+		if !baseline[i].Allow {
+			continue
+		}
+
+		for _, rule := range rules {
+			if cgroup.Overlaps(baseline[i], rule) {
+				restore = append(restore, baseline[i])
+				break
+			}
+		}
+	}
+
+	if len(restore) == 0 {
+		return nil
+	}
+
+	log.Printf("Restoring %d pre-existing rules of %s\n", len(restore), id)
+	return api.AddDeviceRules(cgroupPath, restore)
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// shutdownCtx is done once the daemon is asked to stop, ending the processing pass in progress at
+// its next batch.
+var shutdownCtx = context.Background()
+
+// handleShutdown sets up shutdownCtx and, on SIGTERM or SIGINT, waits for a pass in progress to stop,
+// saves the state and exits. It must run before anything is processed.
+func handleShutdown() {
+	var stop context.CancelFunc
+
+	shutdownCtx, stop = signal.NotifyContext(context.Background(), unix.SIGTERM, unix.SIGINT)
+
+	go func() {
+		<-shutdownCtx.Done()
+		stop()
+
+		processMu.Lock()
+		saveState()
+		shutdownTracing()
+
+		log.Printf("Shutting down\n")
+		os.Exit(0)
+	}()
+}
+
+// applyInBatches applies requests applyBatch at a time. Between batches processMu is released for a
+// moment, so a container with a huge number of devices, e.g. a bind mount of all of /dev, doesn't
+// hold up other containers, the control socket or shutdown.
+func applyInBatches(target deviceTarget, requests []deviceRequest) error {
+	for i, request := range requests {
+		if applyBatch > 0 && i > 0 && i%applyBatch == 0 {
+			processMu.Unlock()
+
+			// Sleeping rather than just unlocking lets a waiting goroutine take the lock.
+			time.Sleep(time.Millisecond)
+
+			processMu.Lock()
+
+			if grantsPaused.Load() || tracker.quarantineOf(target.id) != nil {
+				return fmt.Errorf("stopped processing %s after %d of %d devices: grants were paused or it was quarantined", target.id, i, len(requests))
+			}
+
+			// The container may have died or restarted into another cgroup meanwhile, where the
+			// remaining requests no longer apply.
+			if !tracker.isTracked(target.id, target.cgroupPath) {
+				return fmt.Errorf("stopped processing %s after %d of %d devices: it is no longer running in %s", target.id, i, len(requests), target.cgroupPath)
+			}
+		}
+
+		if err := target.ctx.Err(); err != nil {
+			return fmt.Errorf("stopped processing %s after %d of %d devices: %v", target.id, i, len(requests), err)
+		}
+
+		applied := target.summary.applied
+		err := applyDeviceRules(target, request)
+		target.summary.record(request, target.summary.applied > applied, err)
+	}
+
+	return nil
+}
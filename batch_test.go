@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"testing"
+)
+
+// charRequests returns allows of minors 0 to n-1 of a character major.
+func charRequests(major int64, n int) []deviceRequest {
+	requests := make([]deviceRequest, n)
+
+	for i := range requests {
+		requests[i] = deviceRequest{
+			path: "/dev/test",
+			rule: cgroup.DeviceRule{Type: "c", Major: Ptr(major), Minor: Ptr(int64(i)), Access: "rwm", Allow: true},
+		}
+	}
+
+	return requests
+}
+
+func TestApplyInBatchesStopsWhenTheContainerIsGone(t *testing.T) {
+	previousBatch := applyBatch
+	applyBatch = 2
+	t.Cleanup(func() { applyBatch = previousBatch })
+
+	for name, gone := range map[string]func(id string){
+		"died":      func(id string) { tracker.untrack(id) },
+		"restarted": func(id string) { tracker.track(id, 2, 2, "/sys/fs/cgroup/restarted") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			id := containerID(178)
+			resetTracking(t, id)
+
+			api := newTestCGroup()
+			target := testTarget(id, api, "/sys/fs/cgroup/original")
+
+			writes := 0
+			api.written = func(cgroupPath string, rules []cgroup.DeviceRule) {
+				// The container goes away once the first batch is written, while processMu is released.
+				if writes++; writes == 2 {
+					gone(id)
+				}
+			}
+
+			processMu.Lock()
+			err := applyInBatches(target, charRequests(188, 6))
+			processMu.Unlock()
+
+			if err == nil {
+				t.Error("processing went on after the container was gone")
+			}
+
+			if writes != 2 {
+				t.Errorf("%d rules were written, want only the first batch of 2", writes)
+			}
+		})
+	}
+}
+
+func TestApplyInBatches(t *testing.T) {
+	previousBatch := applyBatch
+	applyBatch = 2
+	t.Cleanup(func() { applyBatch = previousBatch })
+
+	id := containerID(179)
+	resetTracking(t, id)
+
+	api := newTestCGroup()
+	target := testTarget(id, api, "/sys/fs/cgroup/batched")
+
+	processMu.Lock()
+	err := applyInBatches(target, charRequests(188, 5))
+	processMu.Unlock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range charRequests(188, 5) {
+		if !api.allows(target.cgroupPath, request.rule) {
+			t.Errorf("%s was not granted", ruleKey(request.rule))
+		}
+	}
+}
+
+// BenchmarkApplyInBatches measures what the daemon adds to the cgroup writes of applying requests,
+// with the writes kept in memory.
+func BenchmarkApplyInBatches(b *testing.B) {
+	discardLogs(b)
+
+	id := containerID(130)
+	resetTracking(b, id)
+
+	requests := charRequests(188, 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tracker.untrack(id)
+		target := testTarget(id, newTestCGroup(), "/sys/fs/cgroup/benchmark")
+		b.StartTimer()
+
+		processMu.Lock()
+		err := applyInBatches(target, requests)
+		processMu.Unlock()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
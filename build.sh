@@ -1,4 +1,7 @@
 #!/bin/sh
 
-docker build . -t ndouba/device-mapping-manager
+docker build . -t ndouba/device-mapping-manager \
+  --build-arg VERSION="$(git describe --tags --always --dirty)" \
+  --build-arg COMMIT="$(git rev-parse HEAD)" \
+  --build-arg BUILD_DATE="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 docker push ndouba/device-mapping-manager
\ No newline at end of file
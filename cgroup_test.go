@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"device-volume-driver/internal/cgroup"
+	"sync"
+)
+
+// testCGroup is a cgroup.Interface keeping the rules written to each cgroup in memory, evaluated as
+// cgroup v2 does: a later rule overrides an earlier one.
+type testCGroup struct {
+	sync.Mutex
+	rules map[string][]cgroup.DeviceRule
+
+	// entry is the cgroup of every process, as its /proc/<pid>/cgroup lists it.
+	entry string
+
+	// written is called after every write, with the rules written.
+	written func(cgroupPath string, rules []cgroup.DeviceRule)
+}
+
+func newTestCGroup() *testCGroup {
+	return &testCGroup{rules: make(map[string][]cgroup.DeviceRule)}
+}
+
+func (c *testCGroup) GetDeviceCGroupMountPath(procRootPath string, pid int) (string, string, error) {
+	return "", "", nil
+}
+
+func (c *testCGroup) GetDeviceCGroupRootPath(procRootPath string, prefix string, pid int) (string, error) {
+	return c.entry, nil
+}
+
+func (c *testCGroup) DeviceControllerAvailable() (bool, error) {
+	return true, nil
+}
+
+func (c *testCGroup) AddDeviceRules(cgroupPath string, rules []cgroup.DeviceRule) error {
+	c.Lock()
+
+	// Rules in effect are listed in evaluation order, the first match winning.
+	for _, rule := range rules {
+		c.rules[cgroupPath] = append([]cgroup.DeviceRule{rule}, c.rules[cgroupPath]...)
+	}
+
+	written := c.written
+	c.Unlock()
+
+	if written != nil {
+		written(cgroupPath, rules)
+	}
+
+	return nil
+}
+
+func (c *testCGroup) RemoveDeviceRules(cgroupPath string, rules []cgroup.DeviceRule) error {
+	denies := make([]cgroup.DeviceRule, len(rules))
+
+	for i, rule := range rules {
+		rule.Allow = false
+		denies[i] = rule
+	}
+
+	return c.AddDeviceRules(cgroupPath, denies)
+}
+
+func (c *testCGroup) ListDeviceRules(cgroupPath string) ([]cgroup.DeviceRule, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]cgroup.DeviceRule(nil), c.rules[cgroupPath]...), nil
+}
+
+func (c *testCGroup) Reconcile(cgroupPath string, desired []cgroup.DeviceRule) (int, int, error) {
+	actual, _ := c.ListDeviceRules(cgroupPath)
+
+	var changes []cgroup.DeviceRule
+	added, removed := 0, 0
+
+	for _, rule := range desired {
+		if rule.Allow && !cgroup.Allows(actual, rule) {
+			changes, added = append(changes, rule), added+1
+		} else if !rule.Allow && !cgroup.Denies(actual, rule) {
+			changes, removed = append(changes, rule), removed+1
+		}
+	}
+
+	if len(changes) == 0 {
+		return 0, 0, nil
+	}
+
+	return added, removed, c.AddDeviceRules(cgroupPath, changes)
+}
+
+func (c *testCGroup) SetIOLimit(cgroupPath string, major int64, minor int64, limits map[string]uint64) error {
+	return nil
+}
+
+// allows reports whether the rules written to cgroupPath allow every access of rule.
+func (c *testCGroup) allows(cgroupPath string, rule cgroup.DeviceRule) bool {
+	actual, _ := c.ListDeviceRules(cgroupPath)
+	return cgroup.Allows(actual, rule)
+}
+
+// testTarget returns a target for a container tracked as running in cgroupPath of api.
+func testTarget(id string, api cgroup.Interface, cgroupPath string) deviceTarget {
+	tracker.track(id, 1, 2, cgroupPath)
+	return deviceTarget{ctx: context.Background(), id: id, pid: 1, api: api, cgroupPath: cgroupPath, summary: &processSummary{id: id}}
+}
@@ -0,0 +1,299 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// pluginId namespaces every label the daemon reads, so instances with different policies can coexist.
+var pluginId = getEnv("DVD_PLUGIN_ID", "dvd")
+
+// logFormat selects between human readable (text) and structured (json) log output.
+var logFormat = getEnv("DVD_LOG_FORMAT", "text")
+
+// logDest selects where log output goes: stderr or the systemd journal (journald).
+var logDest = getEnv("DVD_LOG_DEST", "stderr")
+
+// deviceEnvKey names the container environment variable that lists the devices an image needs; an
+// empty value, the default, disables it, as whoever builds an image could otherwise grant it devices.
+var deviceEnvKey = getEnv("DVD_DEVICES_ENV", "")
+
+// devicesFile is a file inside container images that lists the devices they need; an empty value
+// disables reading it.
+var devicesFile = getEnv("DVD_DEVICES_FILE", "")
+
+// configFile is a JSON file with device policies for compose projects and services; an empty value
+// disables it.
+var configFile = getEnv("DVD_CONFIG_FILE", "")
+
+// auditLogPath is a file every grant, denial and revocation is appended to as JSON; an empty value
+// disables it.
+var auditLogPath = getEnv("DVD_AUDIT_LOG", "")
+
+// stateFile persists what the daemon applied across restarts; an empty value disables it.
+var stateFile = getEnv("DVD_STATE_FILE", "")
+
+// controlSocketPath is where the control socket listens; an empty value disables it.
+var controlSocketPath = getEnv("DVD_CONTROL_SOCKET", "/run/dvd.sock")
+
+// httpAddr is the address the status endpoints are served on; an empty value disables them.
+var httpAddr = getEnv("DVD_HTTP_ADDR", "")
+
+// manualGrantEnabled allows the control socket to apply rules that bypass all policy checks.
+var manualGrantEnabled = getEnvBool("DVD_ENABLE_MANUAL_GRANT", false)
+
+// dbusDisabled skips the systemd reload listener entirely.
+var dbusDisabled = getEnvBool("DVD_DISABLE_DBUS", false)
+
+// dbusConnectTimeout bounds how long startup waits for the system bus.
+var dbusConnectTimeout = getEnvDuration("DVD_DBUS_TIMEOUT", 5*time.Second)
+
+// applyOnCreate also processes containers on their create event, ahead of start, wherever the runtime
+// has already set up the container's cgroup by then.
+var applyOnCreate = getEnvBool("DVD_APPLY_ON_CREATE", false)
+
+// propagateNetns grants the devices of a container to every container sharing its network namespace.
+var propagateNetns = getEnvBool("DVD_PROPAGATE_NETNS", false)
+
+// ruleOrder sequences allow and deny rules before they are applied: deny-last, deny-first or input.
+var ruleOrder = getEnv("DVD_RULE_ORDER", "deny-last")
+
+// runMode is daemon, cleanup to have the running daemon revoke its rules and exit, or oci-hook to
+// apply the rules of the container whose OCI state is read from stdin and exit.
+var runMode = getEnv("DVD_MODE", "daemon")
+
+// targetContainer makes the daemon process a single container, by ID or name, and exit.
+var targetContainer = getEnv("DVD_TARGET_CONTAINER", "")
+
+// optIn only processes the containers opting in with the enable label, e.g. dvd.enable=true, leaving
+// every other container alone.
+var optIn = getEnvBool("DVD_OPT_IN", false)
+
+// retryLateDevices keeps retrying requested devices that don't exist yet on every reconcile pass,
+// for as long as their container runs.
+var retryLateDevices = getEnvBool("DVD_RETRY_LATE_DEVICES", false)
+
+// watchDevices watches the device directories mounted into running containers with inotify, granting
+// the nodes created in them right away, e.g. as a USB device is plugged in.
+var watchDevices = getEnvBool("DVD_WATCH_DEVICES", false)
+
+// followSymlinks descends into the symlinks to directories found while walking a mounted device
+// directory, as long as they stay within deviceRoots.
+var followSymlinks = getEnvBool("DVD_FOLLOW_SYMLINKS", false)
+
+// verifyInContainer reads the rules back from inside each container's cgroup namespace after applying them.
+var verifyInContainer = getEnvBool("DVD_VERIFY_IN_CONTAINER", false)
+
+// detectRootless resolves the cgroups of rootless containers below the user's slice they run in.
+var detectRootless = getEnvBool("DVD_DETECT_ROOTLESS", true)
+
+// ociFallback also reads the device mounts of containers from their runtime's state files below ociStateDir.
+var ociFallback = getEnvBool("DVD_OCI_FALLBACK", false)
+
+// rootPath is where the host's root filesystem is mounted, / when the daemon runs on the host itself.
+var rootPath = getEnv("DVD_ROOT_PATH", "/host")
+
+// ociStateDir is the host directory holding the runtimes' state, read through rootPath.
+var ociStateDir = getEnv("DVD_OCI_STATE_DIR", "/run")
+
+// postApplyHook is a command run with the container ID as last argument after rules were applied to it.
+var postApplyHook = getEnv("DVD_POST_APPLY_HOOK", "")
+
+// hookTimeout bounds how long the post-apply hook may run before it is killed.
+var hookTimeout = getEnvDuration("DVD_HOOK_TIMEOUT", 10*time.Second)
+
+// otlpEndpoint is the OTLP/HTTP collector processing spans are exported to, tracing is off when empty.
+var otlpEndpoint = getEnv("DVD_OTLP_ENDPOINT", "")
+
+// reconcileInterval is how often tracked containers are checked for devices that were not granted.
+var reconcileInterval = getEnvDuration("DVD_RECONCILE_INTERVAL", time.Minute)
+
+// baselineDevices lists devices granted to every container, so basic nodes such as /dev/null survive a
+// reload that wiped the runtime's own rules.
+var baselineDevices = getEnv("DVD_BASELINE_DEVICES", "")
+
+// cgroupWait bounds how long a container's cgroup may take to appear after its start event.
+var cgroupWait = getEnvDuration("DVD_CGROUP_WAIT", 3*time.Second)
+
+// startupDelay postpones the initial scan, so a daemon started during boot doesn't race dockerd
+// still bringing up its containers.
+var startupDelay = getEnvDuration("DVD_STARTUP_DELAY", 0)
+
+// strictMode stops the daemon at startup when the cgroup version, driver or hierarchy can't be
+// determined unambiguously, instead of carrying on best effort.
+var strictMode = getEnvBool("DVD_STRICT", false)
+
+// maxRevocationTimers caps the pending TTL revocations across all containers; 0 removes the cap.
+var maxRevocationTimers = getEnvInt("DVD_MAX_TIMERS", 4096)
+
+// maxWatchers caps the inotify watches on device directories across all containers; 0 removes the cap.
+var maxWatchers = getEnvInt("DVD_MAX_WATCHERS", 8192)
+
+// repairMode is how rules found altered from outside are repaired: incremental or rebuild.
+var repairMode = getEnv("DVD_REPAIR", "incremental")
+
+// nonDeviceMode is how requested paths that are not devices are handled: skip, warn or error. When
+// unset, walked directories skip them and explicitly requested paths warn.
+var nonDeviceMode = getEnv("DVD_NONDEVICE", "")
+
+// podAnnotation is the pod annotation Kubernetes pods run through cri-dockerd request devices with,
+// unset to ignore pod annotations.
+var podAnnotation = getEnv("DVD_POD_ANNOTATION", "")
+
+// requiredFailure is what happens to a container missing a device its require label marks as
+// required: log or stop-container.
+var requiredFailure = getEnv("DVD_REQUIRED_FAILURE", "log")
+
+// probeWrites has the daemon check at startup that a security module doesn't block its cgroup writes.
+var probeWrites = getEnvBool("DVD_PROBE_WRITES", true)
+
+// applyBatch is how many devices of a container are applied before other processing gets a turn, 0
+// to apply them all at once.
+var applyBatch = getEnvInt("DVD_APPLY_BATCH", 256)
+
+// preserveBaseline has revoking rules restore the access a container had before the daemon first
+// wrote to its cgroup.
+var preserveBaseline = getEnvBool("DVD_PRESERVE_BASELINE", false)
+
+// leaderLockPath is a file instances sharing a host lock, so only the one holding the lock applies
+// rules; unset to always apply them.
+var leaderLockPath = getEnv("DVD_LEADER_LOCK", "")
+
+// deviceRootList lists the directories, e.g. "/dev,/run/devices", whose mounts are treated as devices
+// and below which device paths from labels and the environment must be.
+var deviceRootList = getEnv("DVD_DEVICE_ROOTS", "/dev")
+
+// wildcardMinorMajors lists majors, with their type, e.g. "c:243,c:511", whose devices are granted with
+// any minor, for classes where the minor of a node says nothing about the device it will be.
+var wildcardMinorMajors = getEnv("DVD_WILDCARD_MINOR_MAJORS", "")
+
+// wildcardMinors holds the parsed wildcardMinorMajors, keyed by type and major, e.g. "c:243".
+var wildcardMinors map[string]bool
+
+// allowHostCGroup lets the daemon apply rules to a container whose cgroup it shares with the host.
+var allowHostCGroup = getEnvBool("DVD_ALLOW_HOST_CGROUP", false)
+
+// validateConfig reports settings that only accept a fixed set of values and falls back to their defaults.
+func validateConfig() {
+	switch ruleOrder {
+	case "deny-last", "deny-first", "input":
+	default:
+		log.Printf("ignoring unknown DVD_RULE_ORDER %q, expected deny-last, deny-first or input\n", ruleOrder)
+		ruleOrder = "deny-last"
+	}
+
+	switch requiredFailure {
+	case "log", "stop-container":
+	default:
+		log.Printf("ignoring unknown DVD_REQUIRED_FAILURE %q, expected log or stop-container\n", requiredFailure)
+		requiredFailure = "log"
+	}
+
+	switch nonDeviceMode {
+	case "", "skip", "warn", "error":
+	default:
+		log.Printf("ignoring unknown DVD_NONDEVICE %q, expected skip, warn or error\n", nonDeviceMode)
+		nonDeviceMode = ""
+	}
+
+	switch repairMode {
+	case "incremental", "rebuild":
+	default:
+		log.Printf("ignoring unknown DVD_REPAIR %q, expected incremental or rebuild\n", repairMode)
+		repairMode = "incremental"
+	}
+
+	// The watches count against a kernel limit shared with every other process of the user, so
+	// half of it is left to them.
+	if limit, err := readSysctlInt("/proc/sys/fs/inotify/max_user_watches"); watchDevices && err == nil && maxWatchers > limit/2 {
+		log.Printf("limiting DVD_MAX_WATCHERS to %d, half of fs.inotify.max_user_watches\n", limit/2)
+		maxWatchers = limit / 2
+	}
+
+	wildcardMinors = parseWildcardMinorMajors(wildcardMinorMajors)
+	deviceRoots = parseDeviceRoots(deviceRootList)
+
+	switch runMode {
+	case "daemon", "cleanup", "oci-hook":
+	default:
+		log.Printf("ignoring unknown DVD_MODE %q, expected daemon, cleanup or oci-hook\n", runMode)
+		runMode = "daemon"
+	}
+
+	if !path.IsAbs(rootPath) {
+		log.Printf("ignoring DVD_ROOT_PATH %q, expected an absolute path\n", rootPath)
+		rootPath = "/host"
+	}
+
+	rootPath = path.Clean(rootPath)
+
+	if _, err := os.Stat(rootPath); err != nil {
+		log.Printf("WARNING: the host's root filesystem is not mounted at %s: %v\n", rootPath, err)
+	} else {
+		log.Printf("Reading the host's filesystems through %s\n", rootPath)
+	}
+}
+
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+
+	if !ok || value == "" {
+		return fallback
+	}
+
+	enabled, err := strconv.ParseBool(value)
+
+	if err != nil {
+		log.Printf("ignoring invalid %s value %q: %v\n", key, value, err)
+		return fallback
+	}
+
+	return enabled
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+
+	if !ok || value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil {
+		log.Printf("ignoring invalid %s value %q: %v\n", key, value, err)
+		return fallback
+	}
+
+	return number
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+
+	if !ok || value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		log.Printf("ignoring invalid %s value %q: %v\n", key, value, err)
+		return fallback
+	}
+
+	return duration
+}
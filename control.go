@@ -0,0 +1,287 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/client"
+)
+
+// processMu serializes cgroup updates made by event processing and the control socket.
+var processMu sync.Mutex
+
+type controlCommand func(args []string) (any, error)
+
+type controlReply struct {
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var controlCommands = map[string]controlCommand{
+	"grant":        grantCommand,
+	"grant-pid":    grantPidCommand,
+	"drift":        driftCommand,
+	"tracked":      trackedCommand,
+	"revoke-all":   revokeAllCommand,
+	"resume":       resumeCommand,
+	"reprocess":    reprocessCommand,
+	"quarantine":   quarantineCommand,
+	"unquarantine": unquarantineCommand,
+	"version":      versionCommand,
+}
+
+// controlClient is the Docker client commands that inspect containers use.
+var controlClient *client.Client
+
+func listenForControl(cli *client.Client) {
+	if controlSocketPath == "" {
+		return
+	}
+
+	controlClient = cli
+
+	if err := os.Remove(controlSocketPath); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+		return
+	}
+
+	listener, err := net.Listen("unix", controlSocketPath)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := os.Chmod(controlSocketPath, 0600); err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("Listening for control commands on %s\n", controlSocketPath)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		go handleControlConnection(conn)
+	}
+}
+
+func handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+
+	if err != nil && line == "" {
+		return
+	}
+
+	var reply controlReply
+
+	if fields := strings.Fields(line); len(fields) == 0 {
+		reply.Error = "empty command"
+	} else if command, ok := controlCommands[fields[0]]; !ok {
+		reply.Error = fmt.Sprintf("unknown command %q", fields[0])
+	} else if result, err := command(fields[1:]); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Result = result
+	}
+
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		log.Println(err)
+	}
+}
+
+// grantCommand applies a raw device rule to an arbitrary cgroup: grant <cgroup-path> <type>:<major>:<minor>:<access>
+func grantCommand(args []string) (any, error) {
+	if !manualGrantEnabled {
+		return nil, fmt.Errorf("manual grants are disabled (set DVD_ENABLE_MANUAL_GRANT=1)")
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: grant <cgroup-path> <type>:<major>:<minor>:<access>")
+	}
+
+	rule, err := parseDeviceSpec(args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The path is the cgroup as the host sees it, which is found below rootPath.
+	hostPath := path.Clean("/" + args[0])
+
+	if !isPathWithin(hostPath, "/sys/fs/cgroup") {
+		return nil, fmt.Errorf("%s is not a cgroup below /sys/fs/cgroup", args[0])
+	}
+
+	cgroupPath := path.Join(rootPath, hostPath)
+
+	version, err := getCGroupPathVersion(cgroupPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	api, err := cgroup.New(version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("MANUAL GRANT: applying %s to %s, bypassing all policy checks\n", args[1], cgroupPath)
+
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	if err := api.AddDeviceRules(cgroupPath, []cgroup.DeviceRule{rule}); err != nil {
+		return nil, err
+	}
+
+	return "ok", nil
+}
+
+// grantPidCommand applies raw device rules to the cgroup of an arbitrary process, which need not belong
+// to a container: grant-pid <pid> <type>:<major>:<minor>:<access>...
+func grantPidCommand(args []string) (any, error) {
+	if !manualGrantEnabled {
+		return nil, fmt.Errorf("manual grants are disabled (set DVD_ENABLE_MANUAL_GRANT=1)")
+	}
+
+	if len(args) < 2 {
+		return nil, fmt.Errorf("usage: grant-pid <pid> <type>:<major>:<minor>:<access>...")
+	}
+
+	pid, err := strconv.Atoi(args[0])
+
+	if err != nil || pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %q", args[0])
+	}
+
+	var rules []cgroup.DeviceRule
+
+	for _, spec := range args[1:] {
+		rule, err := parseDeviceSpec(spec)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if !isPidVisible(pid) {
+		return nil, fmt.Errorf("process %d does not exist or is not in the daemon's PID namespace", pid)
+	}
+
+	version, err := cgroup.GetDeviceCGroupVersion("/", pid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	api, err := cgroup.New(version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cgroupPath := getHostCGroupPath(api, version, pid)
+
+	if cgroupPath == "" {
+		return nil, fmt.Errorf("the cgroup of process %d is not found below %s", pid, path.Join(rootPath, "sys/fs/cgroup"))
+	}
+
+	if err := checkDevicesCGroup(cgroupPath, version); err != nil {
+		return nil, err
+	}
+
+	if err := checkCGroupWritable(cgroupPath); err != nil {
+		return nil, err
+	}
+
+	log.Printf("MANUAL GRANT: applying %s to process %d at %s, bypassing all policy checks\n", strings.Join(args[1:], " "), pid, cgroupPath)
+
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	if err := api.AddDeviceRules(cgroupPath, rules); err != nil {
+		return nil, err
+	}
+
+	return "ok", nil
+}
+
+// getCGroupPathVersion infers the cgroup version managing the cgroup directory at cgroupPath.
+func getCGroupPathVersion(cgroupPath string) (int, error) {
+	if _, err := os.Stat(path.Join(cgroupPath, "cgroup.controllers")); err == nil {
+		return 2, nil
+	}
+
+	if _, err := os.Stat(path.Join(cgroupPath, "devices.allow")); err == nil {
+		return 1, nil
+	}
+
+	return -1, fmt.Errorf("%s is not a device cgroup", cgroupPath)
+}
+
+// driftCommand lists devices that reconciliation found present but not granted.
+func driftCommand(args []string) (any, error) {
+	return tracker.drift(), nil
+}
+
+// trackedCommand lists every tracked container with its grants, denials and pending revocations.
+func trackedCommand(args []string) (any, error) {
+	return trackedContainers(), nil
+}
+
+// reprocessCommand processes the given containers again, or every tracked one, and reports the outcome
+// for each device: reprocess [<container>...]
+func reprocessCommand(args []string) (any, error) {
+	if grantsPaused.Load() {
+		return nil, fmt.Errorf("grants are paused by revoke-all, run resume first")
+	}
+
+	ids := args
+
+	if len(ids) == 0 {
+		ids = reconciledContainers()
+	}
+
+	reports := make([]processReport, 0, len(ids))
+
+	for _, id := range ids {
+		summary := &processSummary{}
+
+		err := processContainerInto(controlClient, id, summary)
+
+		// Errors before processing started, e.g. a container without a process or one removed since it
+		// was tracked, are not in the summary. They are reported for that container alone.
+		if summary.id == "" {
+			summary.id = id
+
+			if err != nil {
+				summary.failures = append(summary.failures, err.Error())
+			}
+		}
+
+		reports = append(reports, summary.report())
+	}
+
+	return reports, nil
+}
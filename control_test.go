@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReprocessReportsEveryContainer(t *testing.T) {
+	task := newTestTask(t)
+	info := runningContainer(containerID(170), task, nil, deviceMount("/dev/null"))
+	resetTracking(t, info.ID)
+	_, cli := newTestDocker(t, info)
+
+	previous := controlClient
+	controlClient = cli
+	t.Cleanup(func() { controlClient = previous })
+
+	// A container removed since it was tracked comes first, and must not hide the report of the other.
+	removed := containerID(171)
+	result, err := reprocessCommand([]string{removed, info.ID})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := result.([]processReport)
+
+	if len(reports) != 2 {
+		t.Fatalf("reported %d containers, want 2: %+v", len(reports), reports)
+	}
+
+	if reports[0].ID != removed || len(reports[0].Errors) != 1 || !strings.Contains(reports[0].Errors[0], "No such container") {
+		t.Errorf("the removed container is reported as %+v, want its inspect error", reports[0])
+	}
+
+	if reports[1].ID != info.ID || len(reports[1].Errors) != 0 || len(reports[1].Devices) != 1 || reports[1].Devices[0].Path != "/dev/null" {
+		t.Errorf("the running container is reported as %+v, want /dev/null", reports[1])
+	}
+}
+
+func TestGrantRejectsPathsOutsideTheHierarchy(t *testing.T) {
+	previousEnabled, previousRoot := manualGrantEnabled, rootPath
+	manualGrantEnabled, rootPath = true, t.TempDir()
+	t.Cleanup(func() { manualGrantEnabled, rootPath = previousEnabled, previousRoot })
+
+	// A cgroup v1 devices cgroup below rootPath, and a lookalike next to the hierarchy.
+	for _, directory := range []string{"sys/fs/cgroup/devices/app", "sys/fs/cgroupfoo/devices/app"} {
+		if err := os.MkdirAll(filepath.Join(rootPath, directory), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"devices.allow", "devices.deny", "devices.list"} {
+			if err := os.WriteFile(filepath.Join(rootPath, directory, name), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, cgroupPath := range []string{"/sys/fs/cgroupfoo/devices/app", "sys/fs/cgroupfoo/devices/app", "/devices/app", "/sys/fs/cgroup/../cgroupfoo/devices/app", "/sys/fs"} {
+		if _, err := grantCommand([]string{cgroupPath, "c:1:3:rw"}); err == nil || !strings.Contains(err.Error(), "not a cgroup below /sys/fs/cgroup") {
+			t.Errorf("%s: granted or failed otherwise (%v), want it rejected", cgroupPath, err)
+		}
+	}
+
+	if _, err := grantCommand([]string{"/sys/fs/cgroup/devices/app", "c:1:3:rw"}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(rootPath, "sys/fs/cgroup/devices/app/devices.allow"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "c 1:3 rw" {
+		t.Errorf("devices.allow holds %q, want the granted rule", content)
+	}
+}
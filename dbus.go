@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/godbus/dbus/v5"
+)
+
+const systemdManagerInterface = "org.freedesktop.systemd1.Manager"
+
+// listenForReloads reprocesses every container once systemd finishes reloading,
+// since a daemon-reload can reset the device rules of the units it manages.
+func listenForReloads(cli *client.Client) {
+	if dbusDisabled {
+		log.Printf("DBus listener disabled, systemd reloads will not be reprocessed\n")
+		return
+	}
+
+	conn, err := connectSystemBus(dbusConnectTimeout)
+
+	if err != nil {
+		log.Printf("Unable to connect to the system bus, systemd reloads will not be reprocessed: %v\n", err)
+		return
+	}
+
+	defer conn.Close()
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface(systemdManagerInterface),
+		dbus.WithMatchMember("Reloading"),
+	)
+
+	if err != nil {
+		log.Printf("Unable to subscribe to systemd reloads: %v\n", err)
+		return
+	}
+
+	// systemd only emits some of its signals to clients that asked for them.
+	manager := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+
+	if call := manager.Call(systemdManagerInterface+".Subscribe", 0); call.Err != nil {
+		log.Printf("Unable to subscribe to systemd signals: %v\n", call.Err)
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	log.Printf("Listening for systemd reloads\n")
+
+	for signal := range signals {
+		if signal.Name != systemdManagerInterface+".Reloading" || len(signal.Body) != 1 {
+			continue
+		}
+
+		// The signal carries true when the reload starts and false once it has finished.
+		if reloading, ok := signal.Body[0].(bool); ok && !reloading {
+			log.Printf("systemd finished reloading, reprocessing containers\n")
+			tracker.forgetGrants()
+			withScanCache(func() { checkExistingContainers(cli, true) })
+		}
+	}
+}
+
+// connectSystemBus connects to the system bus, giving up after timeout so a missing or
+// unresponsive bus cannot hang startup.
+func connectSystemBus(timeout time.Duration) (*dbus.Conn, error) {
+	type result struct {
+		conn *dbus.Conn
+		err  error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		conn, err := dbus.ConnectSystemBus()
+		results <- result{conn, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-results; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	}
+}
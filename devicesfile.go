@@ -0,0 +1,93 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxDevicesFileSize bounds how much of a container's devices file is read.
+const maxDevicesFileSize = 64 * 1024
+
+// getFileDevicePaths returns the devices listed in devicesFile inside the filesystem of the container
+// whose process is pid, one or more comma separated paths per line with '#' starting a comment.
+func getFileDevicePaths(id string, pid int) []string {
+	content, err := readContainerFile(pid, devicesFile)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		log.Printf("unable to read %s of %s: %v\n", devicesFile, id, err)
+		return nil
+	}
+
+	var devicePaths []string
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		devicePaths = append(devicePaths, getDevicePathList(id, "file "+devicesFile, line)...)
+	}
+
+	return devicePaths
+}
+
+// readContainerFile reads a file of a container's filesystem through the root of its process. The
+// path is resolved as if that root was "/", so neither ".." nor absolute symlinks can escape it.
+func readContainerFile(pid int, name string) (string, error) {
+	procRoot := fmt.Sprintf("/proc/%d/root", pid)
+
+	rootFd, err := unix.Open(procRoot, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: procRoot, Err: err}
+	}
+
+	defer unix.Close(rootFd)
+
+	// Without openat2 the lookup can't be confined to the root, so the file is not read at all.
+	fd, err := unix.Openat2(rootFd, strings.TrimPrefix(name, "/"), &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC | unix.O_NOCTTY | unix.O_NONBLOCK,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	file := os.NewFile(uintptr(fd), name)
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return "", err
+	}
+
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", name)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(file, maxDevicesFileSize+1))
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(content) > maxDevicesFileSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", name, maxDevicesFileSize)
+	}
+
+	return string(content), nil
+}
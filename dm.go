@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// blockDevice is a block device found in sysfs rather than through a node in /dev.
+type blockDevice struct {
+	name  string
+	major int64
+	minor int64
+}
+
+// getUnderlyingDevices returns the block devices that the block device major:minor is stacked on,
+// e.g. the partition below a dm-crypt mapping and the disks below an LVM volume on top of it.
+func getUnderlyingDevices(major int64, minor int64) []blockDevice {
+	key := fmt.Sprintf("%d:%d", major, minor)
+
+	if devices, ok := scanCache.underlyingDevices(key); ok {
+		return devices
+	}
+
+	devices := readUnderlyingDevices(major, minor)
+	scanCache.storeUnderlying(key, devices)
+
+	return devices
+}
+
+// readUnderlyingDevices walks the slaves of the block device major:minor in sysfs.
+func readUnderlyingDevices(major int64, minor int64) []blockDevice {
+	var devices []blockDevice
+
+	seen := make(map[string]bool)
+	queue := []string{fmt.Sprintf("%d:%d", major, minor)}
+
+	for len(queue) > 0 {
+		slavesPath := path.Join(rootPath, "sys/dev/block", queue[0], "slaves")
+		queue = queue[1:]
+
+		entries, err := os.ReadDir(slavesPath)
+
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			numbers := readSysfsValue(path.Join(slavesPath, entry.Name(), "dev"))
+
+			if numbers == "" || seen[numbers] {
+				continue
+			}
+
+			seen[numbers] = true
+
+			rawMajor, rawMinor, _ := strings.Cut(numbers, ":")
+			slaveMajor, err := strconv.ParseInt(rawMajor, 10, 64)
+
+			if err != nil {
+				continue
+			}
+
+			slaveMinor, err := strconv.ParseInt(rawMinor, 10, 64)
+
+			if err != nil {
+				continue
+			}
+
+			devices = append(devices, blockDevice{name: entry.Name(), major: slaveMajor, minor: slaveMinor})
+			queue = append(queue, numbers)
+		}
+	}
+
+	return devices
+}
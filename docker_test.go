@@ -0,0 +1,283 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+)
+
+// testDocker serves the parts of the Docker API the daemon uses for a set of containers and the
+// events emitted for them.
+type testDocker struct {
+	sync.Mutex
+	containers map[string]types.ContainerJSON
+	events     []events.Message
+	emitted    chan struct{}
+	dropped    chan struct{}
+	inspected  map[string]int
+}
+
+// newTestDocker starts a Docker API server knowing the given containers and returns a client of it.
+func newTestDocker(t testing.TB, containers ...types.ContainerJSON) (*testDocker, *client.Client) {
+	t.Helper()
+
+	docker := &testDocker{containers: make(map[string]types.ContainerJSON), emitted: make(chan struct{}), dropped: make(chan struct{}), inspected: make(map[string]int)}
+
+	for _, info := range containers {
+		docker.set(info)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(docker.serve))
+	// Event streams only end as the server drops their connections.
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(server.URL, "http://")), client.WithVersion("1.41"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { cli.Close() })
+	return docker, cli
+}
+
+// set adds or replaces a container.
+func (d *testDocker) set(info types.ContainerJSON) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.containers[info.ID] = info
+}
+
+// emit adds an event, which is streamed to the subscriptions it falls within.
+func (d *testDocker) emit(msg events.Message) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.events = append(d.events, msg)
+	close(d.emitted)
+	d.emitted = make(chan struct{})
+}
+
+// dropEvents ends the event streams, as a restart of dockerd does.
+func (d *testDocker) dropEvents() {
+	d.Lock()
+	defer d.Unlock()
+
+	close(d.dropped)
+	d.dropped = make(chan struct{})
+}
+
+// inspections returns how often a container was inspected.
+func (d *testDocker) inspections(id string) int {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.inspected[id]
+}
+
+// serveEvents streams the events since the time of the request, given as <seconds>[.<nanoseconds>],
+// replaying those emitted before it as dockerd does, until the client goes away or the streams are
+// dropped.
+func (d *testDocker) serveEvents(w http.ResponseWriter, r *http.Request) {
+	seconds, nanoseconds, _ := strings.Cut(r.URL.Query().Get("since"), ".")
+	sinceSeconds, _ := strconv.ParseInt(seconds, 10, 64)
+	sinceNanoseconds, _ := strconv.ParseInt(nanoseconds, 10, 64)
+	since := time.Unix(sinceSeconds, sinceNanoseconds)
+
+	encoder := json.NewEncoder(w)
+	sent := 0
+
+	w.WriteHeader(http.StatusOK)
+
+	d.Lock()
+	dropped := d.dropped
+	d.Unlock()
+
+	for {
+		d.Lock()
+		pending, emitted := d.events[sent:], d.emitted
+		sent = len(d.events)
+		d.Unlock()
+
+		for _, msg := range pending {
+			at := time.Unix(msg.Time, 0)
+
+			if msg.TimeNano != 0 {
+				at = time.Unix(0, msg.TimeNano)
+			}
+
+			if !at.Before(since) {
+				encoder.Encode(msg)
+			}
+		}
+
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-emitted:
+		case <-dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (d *testDocker) serve(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/events") {
+		d.serveEvents(w, r)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v1.") {
+		parts = parts[1:]
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "_ping":
+		w.Header().Set("API-Version", "1.41")
+		fmt.Fprint(w, "OK")
+	case len(parts) == 2 && parts[0] == "containers" && parts[1] == "json":
+		var list []types.Container
+
+		for _, info := range d.containers {
+			if info.State != nil && info.State.Running {
+				list = append(list, types.Container{ID: info.ID, Labels: info.Config.Labels})
+			}
+		}
+
+		json.NewEncoder(w).Encode(list)
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "json":
+		d.inspected[parts[1]]++
+		info, ok := d.containers[parts[1]]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + parts[1]})
+			return
+		}
+
+		json.NewEncoder(w).Encode(info)
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "stop" && r.Method == http.MethodPost:
+		info, ok := d.containers[parts[1]]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + parts[1]})
+			return
+		}
+
+		state := *info.State
+		state.Running, state.Pid = false, 0
+		info.State = &state
+		d.containers[info.ID] = info
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"message": "not implemented by the test server: " + r.URL.Path})
+	}
+}
+
+// testTask is a process standing in for a container's task, running in a cgroup v1 devices cgroup of
+// its own.
+type testTask struct {
+	pid        int
+	cgroupPath string
+}
+
+// newTestTask starts a process in a devices cgroup of its own, skipping the test when the cgroup v1
+// devices hierarchy isn't mounted writable. Rules are read through rootPath "/".
+func newTestTask(t testing.TB) testTask {
+	t.Helper()
+
+	cgroupPath, err := os.MkdirTemp("/sys/fs/cgroup/devices", fmt.Sprintf("dvd-test-%d-", os.Getpid()))
+
+	if err != nil {
+		t.Skipf("unable to create a cgroup v1 devices cgroup: %v", err)
+	}
+
+	command := exec.Command("sleep", "60")
+
+	if err := command.Start(); err != nil {
+		os.Remove(cgroupPath)
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		command.Process.Kill()
+		command.Wait()
+		os.Remove(cgroupPath)
+	})
+
+	if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(command.Process.Pid)), 0600); err != nil {
+		t.Skipf("unable to move a process into a cgroup v1 devices cgroup: %v", err)
+	}
+
+	previousRoot := rootPath
+	rootPath = "/"
+	t.Cleanup(func() { rootPath = previousRoot })
+
+	return testTask{pid: command.Process.Pid, cgroupPath: cgroupPath}
+}
+
+// devicesList returns the entries of the task's devices.list.
+func (task testTask) devicesList(t *testing.T) []string {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(task.cgroupPath, "devices.list"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(content)) == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+// containerID returns a container ID of the length Docker gives them.
+func containerID(n int) string {
+	return fmt.Sprintf("%064x", n)
+}
+
+// runningContainer returns the inspected state of a container running as task.
+func runningContainer(id string, task testTask, labels map[string]string, mounts ...types.MountPoint) types.ContainerJSON {
+	info := testContainer(nil, labels, mounts...)
+	info.ID = id
+	info.State.Pid = task.pid
+	return info
+}
+
+// resetTracking forgets everything tracked about a container once the test is done.
+func resetTracking(t testing.TB, id string) {
+	t.Cleanup(func() {
+		tracker.untrack(id)
+		tracker.unquarantine(id)
+	})
+}
@@ -0,0 +1,92 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of lifecycle events published on the event bus.
+const (
+	eventApplied       = "applied"
+	eventDenied        = "denied"
+	eventRevoked       = "revoked"
+	eventContainerGone = "container-gone"
+)
+
+// lifecycleEvent describes a change the daemon made to a container's device access.
+type lifecycleEvent struct {
+	Kind        string             `json:"kind"`
+	ContainerID string             `json:"containerId"`
+	Path        string             `json:"path,omitempty"`
+	Rule        *cgroup.DeviceRule `json:"rule,omitempty"`
+	Time        time.Time          `json:"time"`
+}
+
+// eventBufferSize is how many events a subscriber may fall behind before further events are dropped for it.
+const eventBufferSize = 256
+
+// eventBus fans lifecycle events out to its subscribers, each of which consumes them on its own
+// goroutine so a slow consumer never holds up processing.
+var eventBus = struct {
+	sync.Mutex
+	subscribers []chan lifecycleEvent
+}{}
+
+// subscribe registers handler to be called, in order, with every event published from now on.
+func subscribe(handler func(lifecycleEvent)) {
+	events := make(chan lifecycleEvent, eventBufferSize)
+
+	eventBus.Lock()
+	eventBus.subscribers = append(eventBus.subscribers, events)
+	eventBus.Unlock()
+
+	go func() {
+		for event := range events {
+			handler(event)
+		}
+	}()
+}
+
+// publish hands an event to every subscriber without waiting for any of them.
+func publish(kind string, id string, devicePath string, rule *cgroup.DeviceRule) {
+	event := lifecycleEvent{Kind: kind, ContainerID: id, Path: devicePath, Rule: rule, Time: time.Now()}
+
+	eventBus.Lock()
+	defer eventBus.Unlock()
+
+	for _, events := range eventBus.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("event subscriber is falling behind, dropping %s event for %s\n", kind, id)
+		}
+	}
+}
+
+// subscribeAuditLog appends every lifecycle event as a JSON line to auditLogPath, if one is set.
+func subscribeAuditLog() {
+	if auditLogPath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		log.Printf("Unable to open the audit log, events will not be audited: %v\n", err)
+		return
+	}
+
+	encoder := json.NewEncoder(file)
+
+	subscribe(func(event lifecycleEvent) {
+		if err := encoder.Encode(event); err != nil {
+			log.Println(err)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// subscribeContainer subscribes to the events of a single container, delivered on the returned channel.
+func subscribeContainer(id string) <-chan lifecycleEvent {
+	received := make(chan lifecycleEvent, eventBufferSize)
+
+	subscribe(func(event lifecycleEvent) {
+		if event.ContainerID != id {
+			return
+		}
+
+		// Subscribers can't be removed, so one outliving its test must not block.
+		select {
+		case received <- event:
+		default:
+		}
+	})
+
+	return received
+}
+
+// nextEvent returns the next event of a subscription, failing the test if none arrives.
+func nextEvent(t *testing.T, received <-chan lifecycleEvent) lifecycleEvent {
+	t.Helper()
+
+	select {
+	case event := <-received:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was delivered")
+		return lifecycleEvent{}
+	}
+}
+
+func TestAppliedEventReachesEverySubscriber(t *testing.T) {
+	id := containerID(145)
+	resetTracking(t, id)
+
+	subscriptions := []<-chan lifecycleEvent{subscribeContainer(id), subscribeContainer(id), subscribeContainer(id)}
+
+	target := testTarget(id, newTestCGroup(), "/sys/fs/cgroup/published")
+	rule := cgroup.DeviceRule{Type: "c", Major: Ptr[int64](1), Minor: Ptr[int64](3), Access: "rwm", Allow: true}
+
+	processMu.Lock()
+	err := applyInBatches(target, []deviceRequest{{path: "/dev/null", rule: rule}})
+	processMu.Unlock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgetContainer(id)
+
+	for i, received := range subscriptions {
+		for _, kind := range []string{eventApplied, eventContainerGone} {
+			event := nextEvent(t, received)
+
+			if event.Kind != kind {
+				t.Errorf("subscriber %d received a %s event, want %s", i, event.Kind, kind)
+			}
+
+			if kind == eventApplied && (event.Path != "/dev/null" || event.Rule == nil || ruleKey(*event.Rule) != ruleKey(rule)) {
+				t.Errorf("subscriber %d received %+v, want the grant of /dev/null", i, event)
+			}
+		}
+	}
+}
+
+func TestAuditLogSubscriber(t *testing.T) {
+	previous := auditLogPath
+	auditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	t.Cleanup(func() { auditLogPath = previous })
+
+	id := containerID(146)
+	subscribeAuditLog()
+	publish(eventRevoked, id, "/dev/ttyUSB0", nil)
+
+	// The audit log is written on its own goroutine, which may not have caught up yet.
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		file, err := os.Open(auditLogPath)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		found := false
+
+		for scanner.Scan() {
+			var event lifecycleEvent
+
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Fatalf("malformed audit log line %q: %v", scanner.Text(), err)
+			}
+
+			found = found || (event.ContainerID == id && event.Kind == eventRevoked && event.Path == "/dev/ttyUSB0")
+		}
+
+		file.Close()
+
+		if found {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the revoked event was not written to the audit log")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
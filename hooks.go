@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// hookQueueSize bounds how many post-apply hook runs can wait behind a slow one.
+const hookQueueSize = 64
+
+// hookInput is what the post-apply hook receives as JSON on stdin.
+type hookInput struct {
+	ContainerID string     `json:"containerId"`
+	Pid         int        `json:"pid"`
+	CgroupPath  string     `json:"cgroupPath"`
+	Rules       []hookRule `json:"rules"`
+}
+
+type hookRule struct {
+	Path string            `json:"path"`
+	Rule cgroup.DeviceRule `json:"rule"`
+}
+
+var hookQueue chan hookInput
+
+// startPostApplyHook starts the single worker running postApplyHook, so a hung hook delays other
+// hook runs but never the processing of containers.
+func startPostApplyHook() {
+	if strings.TrimSpace(postApplyHook) == "" {
+		return
+	}
+
+	hookQueue = make(chan hookInput, hookQueueSize)
+
+	go func() {
+		for input := range hookQueue {
+			runPostApplyHook(input)
+		}
+	}()
+}
+
+// queuePostApplyHook hands the rules of a container that were just applied to the hook worker.
+func queuePostApplyHook(target deviceTarget, requests []deviceRequest) {
+	if hookQueue == nil {
+		return
+	}
+
+	input := hookInput{ContainerID: target.id, Pid: target.pid, CgroupPath: target.cgroupPath, Rules: []hookRule{}}
+
+	for _, request := range requests {
+		if !tracker.isExpired(target.id, request.path) {
+			input.Rules = append(input.Rules, hookRule{Path: request.path, Rule: request.rule})
+		}
+	}
+
+	select {
+	case hookQueue <- input:
+	default:
+		log.Printf("post-apply hook is falling behind, not running it for %s\n", target.id)
+	}
+}
+
+func runPostApplyHook(input hookInput) {
+	payload, err := json.Marshal(input)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	args := strings.Fields(postApplyHook)
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], input.ContainerID)...)
+	cmd.Stdin = bytes.NewReader(payload)
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("post-apply hook for %s timed out after %v\n", input.ContainerID, hookTimeout)
+	} else if err != nil {
+		log.Printf("post-apply hook for %s failed: %v: %s\n", input.ContainerID, err, strings.TrimSpace(string(output)))
+	} else {
+		log.Printf("Ran post-apply hook for %s in %v\n", input.ContainerID, time.Since(start))
+	}
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func serveHTTP() {
+	if httpAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/tracked", trackedHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("Serving status on %s\n", httpAddr)
+	log.Println(http.ListenAndServe(httpAddr, mux))
+}
+
+// statusHandler renders the tracked containers as a plaintext table for a quick look with curl.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	containers := tracker.snapshot()
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(table, "CONTAINER\tPID\tCGROUP\tPATH\tDEVICES\tLAST APPLIED")
+
+	for _, container := range containers {
+		var devices []string
+
+		for _, grant := range container.Grants {
+			devices = append(devices, grant.Path)
+		}
+
+		sort.Strings(devices)
+
+		lastApplied := "-"
+
+		if last := container.lastApplied(); !last.IsZero() {
+			lastApplied = last.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(table, "%.12s\t%d\tv%d\t%s\t%s\t%s\n",
+			container.ID, container.Pid, container.Version, container.CgroupPath,
+			strings.Join(devices, ","), lastApplied)
+	}
+
+	table.Flush()
+
+	for _, container := range containers {
+		if len(container.Errors) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\nRecent errors for %.12s:\n", container.ID)
+
+		for _, trackedError := range container.Errors {
+			fmt.Fprintf(w, "  %s  %s\n", trackedError.Time.Format(time.RFC3339), trackedError.Message)
+		}
+	}
+}
+
+// trackedHandler serves the full tracking state of every container as JSON.
+func trackedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(trackedContainers()); err != nil {
+		log.Println(err)
+	}
+}
+
+// versionHandler serves the build info as JSON.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(getBuildInfo()); err != nil {
+		log.Println(err)
+	}
+}
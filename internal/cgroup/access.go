@@ -0,0 +1,100 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cgroup
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeviceAccess is the structured form of the access string of a DeviceRule, as used by tools that
+// express device access as read/write/mknod flags rather than as "rwm"
+type DeviceAccess struct {
+	Read  bool `json:"read"`
+	Write bool `json:"write"`
+	Mknod bool `json:"mknod"`
+}
+
+// ParseDeviceAccess parses an access string such as "rw" into its structured form
+func ParseDeviceAccess(access string) (DeviceAccess, error) {
+	var a DeviceAccess
+	for _, r := range access {
+		switch r {
+		case 'r':
+			a.Read = true
+		case 'w':
+			a.Write = true
+		case 'm':
+			a.Mknod = true
+		default:
+			return DeviceAccess{}, fmt.Errorf("unknown device access %q", r)
+		}
+	}
+	return a, nil
+}
+
+// DeviceAccessFromBits converts a bitmask of BPF_DEVCG_ACC_* flags into its structured form
+func DeviceAccessFromBits(bits int64) DeviceAccess {
+	return DeviceAccess{
+		Read:  bits&unix.BPF_DEVCG_ACC_READ != 0,
+		Write: bits&unix.BPF_DEVCG_ACC_WRITE != 0,
+		Mknod: bits&unix.BPF_DEVCG_ACC_MKNOD != 0,
+	}
+}
+
+// Bits returns the access as a bitmask of BPF_DEVCG_ACC_* flags
+func (a DeviceAccess) Bits() int64 {
+	var bits int64
+	if a.Read {
+		bits |= unix.BPF_DEVCG_ACC_READ
+	}
+	if a.Write {
+		bits |= unix.BPF_DEVCG_ACC_WRITE
+	}
+	if a.Mknod {
+		bits |= unix.BPF_DEVCG_ACC_MKNOD
+	}
+	return bits
+}
+
+// String returns the access string of a DeviceRule, always in "rwm" order
+func (a DeviceAccess) String() string {
+	access := ""
+	if a.Read {
+		access += "r"
+	}
+	if a.Write {
+		access += "w"
+	}
+	if a.Mknod {
+		access += "m"
+	}
+	return access
+}
+
+// NormalizeDeviceRule returns rule with its access string validated and rewritten in "rwm" order
+func NormalizeDeviceRule(rule DeviceRule) (DeviceRule, error) {
+	access, err := ParseDeviceAccess(rule.Access)
+	if err != nil {
+		return DeviceRule{}, err
+	}
+	rule.Access = access.String()
+	return rule, nil
+}
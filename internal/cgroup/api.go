@@ -23,17 +23,36 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 type DeviceRule = specs.LinuxDeviceCgroup
 
+// WriteObserver, if set, is called with the duration of every AddDeviceRules call, including
+// those made by RemoveDeviceRules and Reconcile, and the cgroup version it was made for
+var WriteObserver func(version int, duration time.Duration)
+
+// observeWrite reports the time since start to WriteObserver
+func observeWrite(version int, start time.Time) {
+	if WriteObserver != nil {
+		WriteObserver(version, time.Since(start))
+	}
+}
+
 type Interface interface {
 	GetDeviceCGroupMountPath(procRootPath string, pid int) (string, string, error)
 	GetDeviceCGroupRootPath(procRootPath string, prefix string, pid int) (string, error)
 	AddDeviceRules(cgroupPath string, devices []DeviceRule) error
+	RemoveDeviceRules(cgroupPath string, devices []DeviceRule) error
+	ListDeviceRules(cgroupPath string) ([]DeviceRule, error)
+	Reconcile(cgroupPath string, desired []DeviceRule) (added int, removed int, err error)
+	SetIOLimit(cgroupPath string, major int64, minor int64, limits map[string]uint64) error
+	DeviceControllerAvailable() (bool, error)
 }
 
 func New(version int) (Interface, error) {
@@ -89,3 +108,89 @@ func GetDeviceCGroupVersion(rootPath string, pid int) (int, error) {
 
 	return -1, fmt.Errorf("no devices or unified cgroup entries found")
 }
+
+// mountInfo is a single entry of a /proc/<pid>/mountinfo file
+type mountInfo struct {
+	Root         string
+	MountPoint   string
+	FSType       string
+	SuperOptions []string
+}
+
+// parseMountInfo parses a line of a mountinfo file as documented in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// The number of optional fields before the '-' separator varies, so the fields
+// following it are located through the separator rather than by position.
+func parseMountInfo(line string) (mountInfo, error) {
+	fields := strings.Split(line, " ")
+
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || len(fields) < separator+4 {
+		return mountInfo{}, fmt.Errorf("malformed mountinfo entry: %v", line)
+	}
+
+	return mountInfo{
+		Root:         unescapeMountInfo(fields[3]),
+		MountPoint:   unescapeMountInfo(fields[4]),
+		FSType:       fields[separator+1],
+		SuperOptions: strings.Split(fields[separator+3], ","),
+	}, nil
+}
+
+// unescapeMountInfo decodes the octal escapes (e.g. '\040' for a space) the kernel uses in mountinfo paths
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// hasOption reports whether option is one of a mount's options
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// denyRules returns a copy of rules that denies the devices instead of allowing them
+func denyRules(rules []DeviceRule) []DeviceRule {
+	denied := make([]DeviceRule, len(rules))
+	for i, rule := range rules {
+		denied[i] = rule
+		denied[i].Allow = false
+	}
+	return denied
+}
+
+// sortedIOLimitKeys returns the keys of an io limit set in a stable order
+func sortedIOLimitKeys(limits map[string]uint64) []string {
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,375 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cgroup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// filterPrologue loads the device context into the registers the blocks of PrependDeviceFilter check.
+var filterPrologue = asm.Instructions{
+	asm.LoadMem(asm.R2, asm.R1, 0, asm.Half),
+	asm.LoadMem(asm.R3, asm.R1, 0, asm.Word),
+	asm.RSh.Imm32(asm.R3, 16),
+	asm.LoadMem(asm.R4, asm.R1, 4, asm.Word),
+	asm.LoadMem(asm.R5, asm.R1, 8, asm.Word),
+}
+
+func jne(reg asm.Register, value int32) asm.Instruction {
+	return asm.JNE.Imm(reg, value, "")
+}
+
+// accessCheck returns the checks of a block that the access is within bits.
+func accessCheck(bits int32) []asm.Instruction {
+	return []asm.Instruction{asm.Mov.Reg32(asm.R6, asm.R3), asm.And.Imm32(asm.R6, bits), asm.JNE.Reg(asm.R6, asm.R3, "")}
+}
+
+// filterBlock returns a block accepting or rejecting an access that passes every check, whose
+// failing checks jump past its end.
+func filterBlock(allow bool, checks ...asm.Instruction) asm.Instructions {
+	var v int32
+	if allow {
+		v = 1
+	}
+	block := append(asm.Instructions{}, checks...)
+	block = append(block, asm.Mov.Imm32(asm.R0, v), asm.Return())
+	for i := range block {
+		if block[i].OpCode.JumpOp() == asm.JNE {
+			block[i].Offset = int16(len(block) - 1 - i)
+		}
+	}
+	return block
+}
+
+func marshalProgram(t *testing.T, insts asm.Instructions) []byte {
+	t.Helper()
+	var program bytes.Buffer
+	if err := insts.Marshal(&program, binary.LittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	return program.Bytes()
+}
+
+// newFakeDevicesCgroup returns a directory with the files of a cgroup v1 devices cgroup in its
+// default allow mode, which keep the entries written to them.
+func newFakeDevicesCgroup(t *testing.T) string {
+	t.Helper()
+	path := t.TempDir()
+	for name, content := range map[string]string{"devices.list": "a *:* rwm\n", "devices.allow": "", "devices.deny": ""} {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+type serializationTest struct {
+	name  string
+	rule  DeviceRule
+	entry string           // written to devices.allow or devices.deny on cgroup v1
+	block asm.Instructions // prepended to the program on cgroup v2
+	rule2 DeviceRule       // parsed back from entry and decoded from the program
+}
+
+func serializationTests() []serializationTest {
+	const c, b = int32(unix.BPF_DEVCG_DEV_CHAR), int32(unix.BPF_DEVCG_DEV_BLOCK)
+	tests := []serializationTest{
+		{
+			name:  "character device",
+			rule:  DeviceRule{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm", Allow: true},
+			entry: "c 1:3 rwm",
+			block: filterBlock(true, jne(asm.R2, c), jne(asm.R4, 1), jne(asm.R5, 3)),
+			rule2: DeviceRule{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm", Allow: true},
+		},
+		{
+			name:  "denied read of a block device",
+			rule:  DeviceRule{Type: "b", Major: int64Ptr(8), Minor: int64Ptr(0), Access: "r"},
+			entry: "b 8:0 r",
+			block: filterBlock(false, append(append([]asm.Instruction{jne(asm.R2, b)}, accessCheck(accRead)...), jne(asm.R4, 8), jne(asm.R5, 0))...),
+			rule2: DeviceRule{Type: "b", Major: int64Ptr(8), Minor: int64Ptr(0), Access: "r"},
+		},
+		{
+			name:  "any major and minor",
+			rule:  DeviceRule{Type: "c", Access: "m", Allow: true},
+			entry: "c *:* m",
+			block: filterBlock(true, append([]asm.Instruction{jne(asm.R2, c)}, accessCheck(accMknod)...)...),
+			rule2: DeviceRule{Type: "c", Access: "m", Allow: true},
+		},
+		{
+			name:  "any minor",
+			rule:  DeviceRule{Type: "c", Major: int64Ptr(188), Access: "rw", Allow: true},
+			entry: "c 188:* rw",
+			block: filterBlock(true, append(append([]asm.Instruction{jne(asm.R2, c)}, accessCheck(accRead|accWrite)...), jne(asm.R4, 188))...),
+			rule2: DeviceRule{Type: "c", Major: int64Ptr(188), Access: "rw", Allow: true},
+		},
+		{
+			name:  "any major",
+			rule:  DeviceRule{Type: "b", Minor: int64Ptr(5), Access: "w"},
+			entry: "b *:5 w",
+			block: filterBlock(false, append(append([]asm.Instruction{jne(asm.R2, b)}, accessCheck(accWrite)...), jne(asm.R5, 5))...),
+			rule2: DeviceRule{Type: "b", Minor: int64Ptr(5), Access: "w"},
+		},
+		{
+			name:  "wildcards of OCI json",
+			rule:  DeviceRule{Type: "c", Major: int64Ptr(-1), Minor: int64Ptr(-1), Access: "rwm", Allow: true},
+			entry: "c *:* rwm",
+			block: filterBlock(true, jne(asm.R2, c)),
+			rule2: DeviceRule{Type: "c", Access: "rwm", Allow: true},
+		},
+		{
+			name:  "all devices",
+			rule:  DeviceRule{Type: "a", Access: "rwm", Allow: true},
+			entry: "a *:* rwm",
+			block: filterBlock(true),
+			rule2: DeviceRule{Type: "a", Access: "rwm", Allow: true},
+		},
+		{
+			name:  "no devices",
+			rule:  DeviceRule{Type: "a", Access: "rwm"},
+			entry: "a *:* rwm",
+			block: filterBlock(false),
+			rule2: DeviceRule{Type: "a", Access: "rwm"},
+		},
+		{
+			name:  "access out of order",
+			rule:  DeviceRule{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "mwr", Allow: true},
+			entry: "c 1:3 rwm",
+			block: filterBlock(true, jne(asm.R2, c), jne(asm.R4, 1), jne(asm.R5, 3)),
+			rule2: DeviceRule{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm", Allow: true},
+		},
+		{
+			name:  "largest numbers",
+			rule:  DeviceRule{Type: "c", Major: int64Ptr(4095), Minor: int64Ptr(1048575), Access: "rwm", Allow: true},
+			entry: "c 4095:1048575 rwm",
+			block: filterBlock(true, jne(asm.R2, c), jne(asm.R4, 4095), jne(asm.R5, 1048575)),
+			rule2: DeviceRule{Type: "c", Major: int64Ptr(4095), Minor: int64Ptr(1048575), Access: "rwm", Allow: true},
+		},
+	}
+
+	// Every access but "rwm" is checked, on the copy of R3 in R6.
+	for access, bits := range map[string]int32{"r": accRead, "w": accWrite, "m": accMknod, "rw": accRead | accWrite, "rm": accRead | accMknod, "wm": accWrite | accMknod} {
+		tests = append(tests, serializationTest{
+			name:  "access " + access,
+			rule:  DeviceRule{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(200), Access: access, Allow: true},
+			entry: "c 10:200 " + access,
+			block: filterBlock(true, append(append([]asm.Instruction{jne(asm.R2, c)}, accessCheck(bits)...), jne(asm.R4, 10), jne(asm.R5, 200))...),
+			rule2: DeviceRule{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(200), Access: access, Allow: true},
+		})
+	}
+	return tests
+}
+
+func TestRuleSerializationV1(t *testing.T) {
+	c := &cgroupv1{}
+	for _, test := range serializationTests() {
+		t.Run(test.name, func(t *testing.T) {
+			path := newFakeDevicesCgroup(t)
+			if err := c.AddDeviceRules(path, []DeviceRule{test.rule}); err != nil {
+				t.Fatal(err)
+			}
+
+			file, other := "devices.allow", "devices.deny"
+			if !test.rule.Allow {
+				file, other = other, file
+			}
+			written, _ := os.ReadFile(filepath.Join(path, file))
+			if string(written) != test.entry {
+				t.Errorf("wrote %q to %s, want %q", written, file, test.entry)
+			}
+			if written, _ := os.ReadFile(filepath.Join(path, other)); len(written) != 0 {
+				t.Errorf("wrote %q to %s", written, other)
+			}
+
+			rule, err := parseDeviceRule(string(written))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule.Allow = test.rule.Allow
+			if !reflect.DeepEqual(rule, test.rule2) {
+				t.Errorf("parsed %+v, want %+v", rule, test.rule2)
+			}
+		})
+	}
+}
+
+func TestRuleSerializationV2(t *testing.T) {
+	for _, test := range serializationTests() {
+		t.Run(test.name, func(t *testing.T) {
+			insts, err := PrependDeviceFilter([]DeviceRule{test.rule}, denyAllProgram)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := append(append(append(asm.Instructions{}, filterPrologue...), test.block...), denyAllProgram...)
+			if !bytes.Equal(marshalProgram(t, insts), marshalProgram(t, want)) {
+				t.Errorf("generated\n%v\nwant\n%v", insts, want)
+			}
+
+			rules, err := DecodeDeviceFilter(insts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 2 || !reflect.DeepEqual(rules[0], test.rule2) {
+				t.Errorf("decoded %+v, want %+v followed by the original deny", rules, test.rule2)
+			}
+		})
+	}
+}
+
+func TestRuleSerializationErrors(t *testing.T) {
+	tooLarge := int64(math.MaxUint32 + 1)
+	for _, test := range []struct {
+		rule DeviceRule
+		v1   string // empty when the kernel rejects the entry rather than the serializer
+		v2   string
+	}{
+		{DeviceRule{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rx", Allow: true}, "unknown device access", "unknown device access"},
+		{DeviceRule{Type: "x", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm", Allow: true}, "", "invalid DeviceType"},
+		{DeviceRule{Type: "c", Major: &tooLarge, Minor: int64Ptr(3), Access: "rwm", Allow: true}, "", "invalid major 4294967296"},
+		{DeviceRule{Type: "c", Major: int64Ptr(1), Minor: &tooLarge, Access: "rwm", Allow: true}, "", "invalid minor 4294967296"},
+	} {
+		if _, err := PrependDeviceFilter([]DeviceRule{test.rule}, denyAllProgram); err == nil || !strings.Contains(err.Error(), test.v2) {
+			t.Errorf("%+v: cgroup v2 err = %v, want %q", test.rule, err, test.v2)
+		}
+		if test.v1 == "" {
+			continue
+		}
+
+		path := newFakeDevicesCgroup(t)
+		if err := (&cgroupv1{}).AddDeviceRules(path, []DeviceRule{test.rule}); err == nil || !strings.Contains(err.Error(), test.v1) {
+			t.Errorf("%+v: cgroup v1 err = %v, want %q", test.rule, err, test.v1)
+		}
+		if written, _ := os.ReadFile(filepath.Join(path, "devices.allow")); len(written) != 0 {
+			t.Errorf("%+v: wrote %q to devices.allow", test.rule, written)
+		}
+	}
+}
+
+// newProcRoot returns a directory holding the given files of /proc/1, for the functions reading /proc
+// below a root path.
+func newProcRoot(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "proc", "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, "proc", "1", name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// The mountinfo of a host running systemd in hybrid mode, as on Ubuntu 20.04, with a combined
+// cpu,devices mount of the kind some distros set up in fstab.
+const hybridMountInfo = `22 27 0:20 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+26 22 0:24 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+27 26 0:25 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw,nsdelegate
+28 26 0:26 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,xattr,name=systemd
+31 26 0:29 / /sys/fs/cgroup/cpuset rw,nosuid,nodev,noexec,relatime shared:14 - cgroup cgroup rw,cpuset
+33 26 0:31 / /sys/fs/cgroup/cpu,devices rw,nosuid,nodev,noexec,relatime shared:16 - cgroup cgroup rw,cpu,devices
+35 26 0:33 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:18 - cgroup cgroup rw,memory
+`
+
+// The mountinfo of a Docker container on a cgroup v1 host, whose controllers are bind mounts of the
+// container's own subtree, without optional fields.
+const containerMountInfo = `1021 1003 0:105 / /sys ro,nosuid,nodev,noexec,relatime - sysfs sysfs ro
+1023 1022 0:26 /docker/8d2f0c3a1b /sys/fs/cgroup/systemd ro,nosuid,nodev,noexec,relatime master:11 - cgroup cgroup rw,xattr,name=systemd
+1027 1022 0:37 /docker/8d2f0c3a1b /sys/fs/cgroup/devices ro,nosuid,nodev,noexec,relatime master:19 - cgroup cgroup rw,devices
+`
+
+// The mountinfo of a host with the unified hierarchy only, as on Fedora.
+const unifiedMountInfo = `22 1 0:21 / /sys rw,nosuid,nodev,noexec,relatime shared:2 - sysfs sysfs rw,seclabel
+26 22 0:23 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,seclabel,nsdelegate,memory_recursiveprot
+`
+
+// The mountinfo of a privileged container that bind mounts the host's unified hierarchy at /host and
+// has a cgroup2 mount of its own subtree, with a second optional field.
+const nestedMountInfo = `644 640 0:23 /../.. /host/sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 master:4 - cgroup2 cgroup2 rw,nsdelegate
+652 640 0:23 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime - cgroup2 cgroup2 rw,nsdelegate
+653 640 0:23 / /mnt/cgroup\040root rw,relatime shared:4 - cgroup2 cgroup2 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	for line, want := range map[string]mountInfo{
+		"33 26 0:31 / /sys/fs/cgroup/cpu,devices rw,relatime shared:16 - cgroup cgroup rw,cpu,devices": {Root: "/", MountPoint: "/sys/fs/cgroup/cpu,devices", FSType: "cgroup", SuperOptions: []string{"rw", "cpu", "devices"}},
+		"1027 1003 0:37 /docker/8d /sys/fs/cgroup/devices ro - cgroup cgroup rw,devices":               {Root: "/docker/8d", MountPoint: "/sys/fs/cgroup/devices", FSType: "cgroup", SuperOptions: []string{"rw", "devices"}},
+		"644 640 0:23 / /host/sys rw shared:4 master:4 propagate_from:2 - cgroup2 cgroup2 rw":          {Root: "/", MountPoint: "/host/sys", FSType: "cgroup2", SuperOptions: []string{"rw"}},
+		"653 640 0:23 /a\\134b /mnt/cgroup\\040root rw - cgroup2 cgroup2 rw":                           {Root: "/a\\b", MountPoint: "/mnt/cgroup root", FSType: "cgroup2", SuperOptions: []string{"rw"}},
+	} {
+		mount, err := parseMountInfo(line)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+		} else if !reflect.DeepEqual(mount, want) {
+			t.Errorf("%q: parsed %+v, want %+v", line, mount, want)
+		}
+	}
+
+	for _, line := range []string{"", "33 26 0:31 / /sys/fs/cgroup rw shared:16 cgroup cgroup rw", "33 26 0:31 / /sys/fs/cgroup rw - cgroup cgroup", "33 26 - cgroup cgroup rw"} {
+		if _, err := parseMountInfo(line); err == nil {
+			t.Errorf("%q: parsed a malformed entry", line)
+		}
+	}
+}
+
+func TestGetDeviceCGroupMountPath(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		c          Interface
+		mountInfo  string
+		prefix     string
+		mountPoint string
+		err        bool
+	}{
+		{name: "v1 combined controller mount", c: &cgroupv1{}, mountInfo: hybridMountInfo, prefix: "/", mountPoint: "/sys/fs/cgroup/cpu,devices"},
+		{name: "v1 bind mounted subtree", c: &cgroupv1{}, mountInfo: containerMountInfo, prefix: "/docker/8d2f0c3a1b", mountPoint: "/sys/fs/cgroup/devices"},
+		{name: "v1 without a devices mount", c: &cgroupv1{}, mountInfo: unifiedMountInfo, err: true},
+		{name: "v2 of a hybrid host", c: &cgroupv2{}, mountInfo: hybridMountInfo, prefix: "/", mountPoint: "/sys/fs/cgroup/unified"},
+		{name: "v2 unified host", c: &cgroupv2{}, mountInfo: unifiedMountInfo, prefix: "/", mountPoint: "/sys/fs/cgroup"},
+		{name: "v2 relative mount prefix", c: &cgroupv2{}, mountInfo: nestedMountInfo, err: true},
+		{name: "v2 several mounts", c: &cgroupv2{}, mountInfo: nestedMountInfo[strings.Index(nestedMountInfo, "\n")+1:], prefix: "/", mountPoint: "/sys/fs/cgroup"},
+		{name: "v2 without a cgroup2 mount", c: &cgroupv2{}, mountInfo: containerMountInfo, err: true},
+		{name: "malformed mountinfo", c: &cgroupv1{}, mountInfo: "33 26 0:31 / /sys/fs/cgroup/devices rw\n", err: true},
+	} {
+		root := newProcRoot(t, map[string]string{"mountinfo": test.mountInfo})
+		prefix, mountPoint, err := test.c.GetDeviceCGroupMountPath(root, 1)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: found %q at %q, want an error", test.name, prefix, mountPoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if prefix != test.prefix || mountPoint != test.mountPoint {
+			t.Errorf("%s: found %q at %q, want %q at %q", test.name, prefix, mountPoint, test.prefix, test.mountPoint)
+		}
+	}
+}
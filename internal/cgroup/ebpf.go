@@ -103,11 +103,19 @@ func (p *program) appendDevice(dev specs.LinuxDeviceCgroup, labelPrefix string)
 		// if not specified in OCI json, typ is set to DeviceTypeAll
 		return fmt.Errorf("invalid DeviceType %q", dev.Type)
 	}
+	// A nil major or minor is a wildcard, like the -1 of OCI json.
+	wildcard := int64(-1)
+	if dev.Major == nil {
+		dev.Major = &wildcard
+	}
+	if dev.Minor == nil {
+		dev.Minor = &wildcard
+	}
 	if *dev.Major > math.MaxUint32 {
 		return fmt.Errorf("invalid major %d", *dev.Major)
 	}
 	if *dev.Minor > math.MaxUint32 {
-		return fmt.Errorf("invalid minor %d", *dev.Major)
+		return fmt.Errorf("invalid minor %d", *dev.Minor)
 	}
 	hasMajor := *dev.Major >= 0 // if not specified in OCI json, major is set to -1
 	hasMinor := *dev.Minor >= 0
@@ -138,10 +146,12 @@ func (p *program) appendDevice(dev specs.LinuxDeviceCgroup, labelPrefix string)
 	}
 	if hasAccess {
 		p.insts = append(p.insts,
-			// if (R3 & bpfAccess == 0 /* use R2 as a temp var */) goto next
-			asm.Mov.Reg32(asm.R2, asm.R3),
-			asm.And.Imm32(asm.R2, bpfAccess),
-			asm.JEq.Imm(asm.R2, 0, nextBlockSym),
+			// if (R3 & bpfAccess != R3 /* use R6 as a temp var */) goto next
+			// R2 still holds the type for the blocks that follow and R1 the context for the
+			// original instructions, so neither may be clobbered, unlike in crun's program.
+			asm.Mov.Reg32(asm.R6, asm.R3),
+			asm.And.Imm32(asm.R6, bpfAccess),
+			asm.JNE.Reg(asm.R6, asm.R3, nextBlockSym),
 		)
 	}
 	if hasMajor {
@@ -262,6 +272,8 @@ func PrependDeviceFilter(devices []specs.LinuxDeviceCgroup, origInsts asm.Instru
 	labelPrefix := uuid.New().String()
 	p := &program{}
 	p.init()
+	// The first matching block decides, so devices are appended last to first: the net effect
+	// is that of applying the slice in order, as cgroup v1 does with its writes.
 	for i := len(devices) - 1; i >= 0; i-- {
 		if err := p.appendDevice(devices[i], labelPrefix); err != nil {
 			return nil, err
@@ -271,6 +283,67 @@ func PrependDeviceFilter(devices []specs.LinuxDeviceCgroup, origInsts asm.Instru
 	return insts, err
 }
 
+// ErrUnknownDeviceFilter is returned for a device filtering ebpf program whose rules cannot be decoded,
+// so the rules in effect are unknown.
+var ErrUnknownDeviceFilter = errors.New("unknown device filter program")
+
+// DecodeDeviceFilter recovers the device rules of a device filtering ebpf program generated by
+// PrependDeviceFilter (or by runc/crun), in the order they are evaluated: the first match wins.
+func DecodeDeviceFilter(insts asm.Instructions) ([]specs.LinuxDeviceCgroup, error) {
+	var rules []specs.LinuxDeviceCgroup
+
+	// block accumulates the conditions of a rule until its accept block is reached. The access
+	// is checked on a copy of R3 in a scratch register: R2 in crun's program, R6 in this one.
+	block := specs.LinuxDeviceCgroup{Type: "a", Access: "rwm"}
+	scratch := asm.R3
+	for i := 0; i < len(insts); i++ {
+		inst := insts[i]
+		switch {
+		case inst.OpCode.Class() == asm.LdXClass:
+			// Loads of the device context, repeated at the head of every merged program.
+		case inst.OpCode.ALUOp() == asm.RSh && inst.Dst == asm.R3:
+		case inst.OpCode.ALUOp() == asm.Mov && inst.OpCode.Source() == asm.RegSource && inst.Src == asm.R3 && inst.Dst != asm.R3:
+			scratch = inst.Dst
+		case inst.OpCode.JumpOp() == asm.JEq && inst.Dst == scratch && inst.Constant == 0:
+		case inst.OpCode.JumpOp() == asm.JNE && inst.OpCode.Source() == asm.RegSource && inst.Dst == scratch && inst.Src == asm.R3:
+		case inst.OpCode.ALUOp() == asm.And && inst.Dst == scratch:
+			block.Access = DeviceAccessFromBits(inst.Constant).String()
+		case inst.OpCode.ALUOp() == asm.And && inst.Dst == asm.R2 && inst.Constant == 0xFFFF:
+			// runc loads the whole access_type word and masks the type out of it.
+		case inst.OpCode.JumpOp() == asm.JNE && inst.Dst == asm.R2:
+			switch inst.Constant {
+			case int64(unix.BPF_DEVCG_DEV_CHAR):
+				block.Type = "c"
+			case int64(unix.BPF_DEVCG_DEV_BLOCK):
+				block.Type = "b"
+			default:
+				return nil, fmt.Errorf("%w: unknown device type %d in instruction %d", ErrUnknownDeviceFilter, inst.Constant, i)
+			}
+		case inst.OpCode.JumpOp() == asm.JNE && inst.Dst == asm.R4:
+			major := inst.Constant
+			block.Major = &major
+		case inst.OpCode.JumpOp() == asm.JNE && inst.Dst == asm.R5:
+			minor := inst.Constant
+			block.Minor = &minor
+		case inst.OpCode.ALUOp() == asm.Mov && inst.OpCode.Source() == asm.ImmSource && inst.Dst == asm.R0:
+			if i+1 >= len(insts) || insts[i+1].OpCode.JumpOp() != asm.Exit {
+				return nil, fmt.Errorf("%w: accept block without exit at instruction %d", ErrUnknownDeviceFilter, i)
+			}
+			block.Allow = inst.Constant == 1
+			rules = append(rules, block)
+			block = specs.LinuxDeviceCgroup{Type: "a", Access: "rwm"}
+			i++
+		case inst.OpCode.JumpOp() == asm.Exit:
+			// A bare exit ends a program that had no default rule of its own.
+			return rules, nil
+		default:
+			return nil, fmt.Errorf("%w: unrecognized instruction %d: %v", ErrUnknownDeviceFilter, i, inst)
+		}
+	}
+
+	return rules, nil
+}
+
 // DetachCgroupDeviceFilter detaches an existing device filter ebpf program from a cgroup.
 func DetachCgroupDeviceFilter(prog *ebpf.Program, dirFd int) error {
 	err := link.RawDetachProgram(link.RawDetachProgramOptions{
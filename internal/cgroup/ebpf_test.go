@@ -0,0 +1,570 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cgroup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// deviceAccess is the context a device filter program is run with: an access of a device.
+type deviceAccess struct {
+	Type   int32 // BPF_DEVCG_DEV_*
+	Access int32 // BPF_DEVCG_ACC_*
+	Major  uint32
+	Minor  uint32
+}
+
+// contextPointer stands for the pointer to the context the kernel passes in R1.
+const contextPointer = 1 << 40
+
+// runDeviceFilter interprets a device filter program the way the kernel runs a BPF_PROG_TYPE_CGROUP_DEVICE
+// program, for the instructions device filters are made of, and reports whether access is allowed. Like
+// the verifier, it fails on loads through anything but the context and on reads of unset registers.
+func runDeviceFilter(t testing.TB, insts asm.Instructions, access deviceAccess) bool {
+	t.Helper()
+
+	symbols, err := insts.SymbolOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context := make([]byte, 12)
+	binary.LittleEndian.PutUint32(context[0:], uint32(access.Access)<<16|uint32(access.Type))
+	binary.LittleEndian.PutUint32(context[4:], access.Major)
+	binary.LittleEndian.PutUint32(context[8:], access.Minor)
+
+	var regs [11]uint64
+	var set [11]bool
+	regs[asm.R1], set[asm.R1] = contextPointer, true
+
+	read := func(pc int, reg asm.Register) uint64 {
+		if !set[reg] {
+			t.Fatalf("instruction %d reads %v before it is set: %v", pc, reg, insts[pc])
+		}
+		return regs[reg]
+	}
+
+	for pc, steps := 0, 0; pc < len(insts); steps++ {
+		if steps > 10000 {
+			t.Fatalf("the program does not terminate")
+		}
+
+		inst := insts[pc]
+		op := inst.OpCode
+		next := pc + 1
+
+		switch {
+		case op.Class() == asm.LdXClass:
+			if read(pc, inst.Src) != contextPointer {
+				t.Fatalf("instruction %d loads through %v, which no longer holds the context: %v", pc, inst.Src, inst)
+			}
+			switch op.Size() {
+			case asm.Word:
+				regs[inst.Dst] = uint64(binary.LittleEndian.Uint32(context[inst.Offset:]))
+			case asm.Half:
+				regs[inst.Dst] = uint64(binary.LittleEndian.Uint16(context[inst.Offset:]))
+			default:
+				t.Fatalf("unsupported load size at instruction %d: %v", pc, inst)
+			}
+			set[inst.Dst] = true
+
+		case op.Class().IsALU():
+			operand := uint64(inst.Constant)
+			if op.Source() == asm.RegSource {
+				operand = read(pc, inst.Src)
+			}
+			var value uint64
+			switch op.ALUOp() {
+			case asm.Mov:
+				value = operand
+			case asm.And:
+				value = read(pc, inst.Dst) & operand
+			case asm.RSh:
+				value = read(pc, inst.Dst) >> operand
+			default:
+				t.Fatalf("unsupported ALU operation at instruction %d: %v", pc, inst)
+			}
+			if op.Class() == asm.ALUClass {
+				value = uint64(uint32(value))
+			}
+			regs[inst.Dst], set[inst.Dst] = value, true
+
+		case op.Class().IsJump():
+			if op.JumpOp() == asm.Exit {
+				return read(pc, asm.R0) == 1
+			}
+			operand := uint64(inst.Constant)
+			if op.Source() == asm.RegSource {
+				operand = read(pc, inst.Src)
+			}
+			var taken bool
+			switch op.JumpOp() {
+			case asm.Ja:
+				taken = true
+			case asm.JEq:
+				taken = read(pc, inst.Dst) == operand
+			case asm.JNE:
+				taken = read(pc, inst.Dst) != operand
+			default:
+				t.Fatalf("unsupported jump at instruction %d: %v", pc, inst)
+			}
+			if taken {
+				if reference := inst.Reference(); reference != "" {
+					target, ok := symbols[reference]
+					if !ok {
+						t.Fatalf("instruction %d jumps to the unknown symbol %s", pc, reference)
+					}
+					next = target
+				} else {
+					next = pc + 1 + int(inst.Offset)
+				}
+			}
+
+		default:
+			t.Fatalf("unsupported instruction %d: %v", pc, inst)
+		}
+
+		pc = next
+	}
+
+	t.Fatalf("the program runs off its end")
+	return false
+}
+
+// denyAllProgram is an original program that denies every access, as a runtime's does for devices it didn't list.
+var denyAllProgram = asm.Instructions{asm.Mov.Imm32(asm.R0, 0), asm.Return()}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func charAccess(major uint32, minor uint32, access int32) deviceAccess {
+	return deviceAccess{Type: unix.BPF_DEVCG_DEV_CHAR, Access: access, Major: major, Minor: minor}
+}
+
+const (
+	accRead  = unix.BPF_DEVCG_ACC_READ
+	accWrite = unix.BPF_DEVCG_ACC_WRITE
+	accMknod = unix.BPF_DEVCG_ACC_MKNOD
+)
+
+func TestPrependDeviceFilterNarrowedAccess(t *testing.T) {
+	// A narrowed access must not keep the blocks after it from matching the type.
+	insts, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(229), Access: "rwm", Allow: true},
+		{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(200), Access: "r", Allow: true},
+	}, denyAllProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		access  deviceAccess
+		allowed bool
+	}{
+		{"write to the rwm device", charAccess(10, 229, accWrite), true},
+		{"read of the rwm device", charAccess(10, 229, accRead), true},
+		{"read of the r device", charAccess(10, 200, accRead), true},
+		{"write to the r device", charAccess(10, 200, accWrite), false},
+		{"read and write of the r device", charAccess(10, 200, accRead|accWrite), false},
+		{"mknod of the r device", charAccess(10, 200, accMknod), false},
+		{"block device with the same numbers", deviceAccess{Type: unix.BPF_DEVCG_DEV_BLOCK, Access: accRead, Major: 10, Minor: 229}, false},
+		{"unlisted device", charAccess(10, 201, accRead), false},
+	} {
+		if allowed := runDeviceFilter(t, insts, test.access); allowed != test.allowed {
+			t.Errorf("%s: allowed = %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPrependDeviceFilterKeepsOriginalProgram(t *testing.T) {
+	// The original program reloads its context from R1, as every program generated by runc does.
+	original := asm.Instructions{
+		asm.LoadMem(asm.R2, asm.R1, 0, asm.Word),
+		asm.And.Imm32(asm.R2, 0xFFFF),
+		asm.LoadMem(asm.R4, asm.R1, 4, asm.Word),
+		asm.JNE.Imm(asm.R2, int32(unix.BPF_DEVCG_DEV_CHAR), "deny"),
+		asm.JNE.Imm(asm.R4, 1, "deny"),
+		asm.Mov.Imm32(asm.R0, 1),
+		asm.Return(),
+		asm.Mov.Imm32(asm.R0, 0).Sym("deny"),
+		asm.Return(),
+	}
+
+	insts, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(200), Access: "r", Allow: true},
+		{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "w", Allow: false},
+	}, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		access  deviceAccess
+		allowed bool
+	}{
+		{"prepended allow", charAccess(10, 200, accRead), true},
+		{"prepended deny", charAccess(1, 3, accWrite), false},
+		{"original allow past the prepended deny", charAccess(1, 3, accRead), true},
+		{"original allow", charAccess(1, 5, accWrite), true},
+		{"original deny", charAccess(5, 0, accRead), false},
+	} {
+		if allowed := runDeviceFilter(t, insts, test.access); allowed != test.allowed {
+			t.Errorf("%s: allowed = %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+
+	// The kernel's verifier has the final word on whether the registers are used correctly.
+	program, err := ebpf.NewProgram(&ebpf.ProgramSpec{Type: ebpf.CGroupDevice, Instructions: insts, License: BpfProgramLicense})
+	if errors.Is(err, ebpf.ErrNotSupported) || errors.Is(err, os.ErrPermission) {
+		t.Skipf("unable to load device filter programs: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("the verifier rejects the program: %v", err)
+	}
+	program.Close()
+}
+
+func TestPrependDeviceFilterOrder(t *testing.T) {
+	// A later rule overrides an earlier one, as writes do on cgroup v1.
+	insts, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(188), Access: "rwm", Allow: true},
+		{Type: "c", Major: int64Ptr(188), Minor: int64Ptr(0), Access: "w", Allow: false},
+		{Type: "c", Major: int64Ptr(188), Minor: int64Ptr(1), Access: "rwm", Allow: false},
+		{Type: "c", Major: int64Ptr(188), Minor: int64Ptr(1), Access: "r", Allow: true},
+	}, denyAllProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		access  deviceAccess
+		allowed bool
+	}{
+		{charAccess(188, 0, accRead), true},
+		{charAccess(188, 0, accWrite), false},
+		{charAccess(188, 1, accRead), true},
+		{charAccess(188, 1, accWrite), false},
+		{charAccess(188, 2, accWrite), true},
+	} {
+		if allowed := runDeviceFilter(t, insts, test.access); allowed != test.allowed {
+			t.Errorf("%+v: allowed = %v, want %v", test.access, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPrependDeviceFilterWildcardMinor(t *testing.T) {
+	// A nil or negative minor matches every minor of the major, a minor only itself.
+	insts, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(226), Access: "rwm", Allow: true},
+		{Type: "c", Major: int64Ptr(189), Minor: int64Ptr(-1), Access: "r", Allow: true},
+		{Type: "c", Major: int64Ptr(240), Minor: int64Ptr(0), Access: "rwm", Allow: true},
+	}, denyAllProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		access  deviceAccess
+		allowed bool
+	}{
+		{charAccess(226, 0, accRead|accWrite), true},
+		{charAccess(226, 128, accMknod), true},
+		{charAccess(189, 5, accRead), true},
+		{charAccess(189, 5, accWrite), false},
+		{charAccess(240, 0, accWrite), true},
+		{charAccess(240, 1, accRead), false},
+		{charAccess(227, 0, accRead), false},
+	} {
+		if allowed := runDeviceFilter(t, insts, test.access); allowed != test.allowed {
+			t.Errorf("%+v: allowed = %v, want %v", test.access, allowed, test.allowed)
+		}
+	}
+}
+
+// runcBlock returns a block of a program generated by runc's devicefilter package, as bpftool dumps it:
+// with jump offsets rather than symbols. A negative major or minor, or an access of "rwm", is not checked.
+func runcBlock(devType int32, access string, major int32, minor int32, allow bool) asm.Instructions {
+	var block asm.Instructions
+	if devType >= 0 {
+		block = append(block, asm.JNE.Imm(asm.R2, devType, ""))
+	}
+	if access != "rwm" {
+		bits, _ := ParseDeviceAccess(access)
+		block = append(block,
+			asm.Mov.Reg32(asm.R1, asm.R3),
+			asm.And.Imm32(asm.R1, int32(bits.Bits())),
+			asm.JNE.Reg(asm.R1, asm.R3, ""),
+		)
+	}
+	if major >= 0 {
+		block = append(block, asm.JNE.Imm(asm.R4, major, ""))
+	}
+	if minor >= 0 {
+		block = append(block, asm.JNE.Imm(asm.R5, minor, ""))
+	}
+	var v int32
+	if allow {
+		v = 1
+	}
+	block = append(block, asm.Mov.Imm32(asm.R0, v), asm.Return())
+
+	// Every check jumps past the end of the block when it fails.
+	for i := range block {
+		if block[i].OpCode.JumpOp() == asm.JNE {
+			block[i].Offset = int16(len(block) - 1 - i)
+		}
+	}
+	return block
+}
+
+// runcProgram returns the program runc generates for the devices Docker allows a container by default,
+// transcribed from the shape of runc's devicefilter generator rather than dumped from a live system:
+// a word load of the type masked with 0xFFFF, the access checked on a copy in R1 compared by register,
+// the rules in reverse and a final default deny.
+func runcProgram() asm.Instructions {
+	const c, b = int32(unix.BPF_DEVCG_DEV_CHAR), int32(unix.BPF_DEVCG_DEV_BLOCK)
+	insts := asm.Instructions{
+		asm.LoadMem(asm.R2, asm.R1, 0, asm.Word),
+		asm.And.Imm32(asm.R2, 0xFFFF),
+		asm.LoadMem(asm.R3, asm.R1, 0, asm.Word),
+		asm.RSh.Imm32(asm.R3, 16),
+		asm.LoadMem(asm.R4, asm.R1, 4, asm.Word),
+		asm.LoadMem(asm.R5, asm.R1, 8, asm.Word),
+	}
+	insts = append(insts, runcBlock(c, "rwm", 10, 200, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 5, 2, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 136, -1, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 5, 1, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 5, 0, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 1, 9, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 1, 8, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 1, 7, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 1, 5, true)...)
+	insts = append(insts, runcBlock(c, "rwm", 1, 3, true)...)
+	insts = append(insts, runcBlock(b, "m", -1, -1, true)...)
+	insts = append(insts, runcBlock(c, "m", -1, -1, true)...)
+	insts = append(insts, asm.Mov.Imm32(asm.R0, 0), asm.Return())
+	return insts
+}
+
+// deviceAccesses returns single accesses of the devices test programs mention and of some they don't.
+func deviceAccesses() []deviceAccess {
+	var accesses []deviceAccess
+	for _, devType := range []int32{unix.BPF_DEVCG_DEV_CHAR, unix.BPF_DEVCG_DEV_BLOCK} {
+		for _, device := range [][2]uint32{{1, 3}, {1, 5}, {1, 8}, {5, 0}, {5, 2}, {7, 0}, {10, 200}, {10, 229}, {136, 0}, {136, 7}, {188, 0}, {188, 1}} {
+			for _, access := range []int32{accRead, accWrite, accMknod} {
+				accesses = append(accesses, deviceAccess{Type: devType, Access: access, Major: device[0], Minor: device[1]})
+			}
+		}
+	}
+	return accesses
+}
+
+// ruleOf returns the rule describing a single access, as the rules in effect are queried.
+func ruleOf(access deviceAccess) DeviceRule {
+	devType := "c"
+	if access.Type == unix.BPF_DEVCG_DEV_BLOCK {
+		devType = "b"
+	}
+	return DeviceRule{Type: devType, Major: int64Ptr(int64(access.Major)), Minor: int64Ptr(int64(access.Minor)), Access: DeviceAccessFromBits(int64(access.Access)).String()}
+}
+
+// checkDecoded checks that decoded rules allow exactly the accesses a program does.
+func checkDecoded(t *testing.T, insts asm.Instructions, rules []DeviceRule) {
+	t.Helper()
+	for _, access := range deviceAccesses() {
+		if allowed, want := Allows(rules, ruleOf(access)), runDeviceFilter(t, insts, access); allowed != want {
+			t.Errorf("%+v: decoded rules allow = %v, program allows = %v", access, allowed, want)
+		}
+	}
+}
+
+func TestDecodeDeviceFilterRunc(t *testing.T) {
+	insts := runcProgram()
+	rules, err := DecodeDeviceFilter(insts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 13 {
+		t.Errorf("decoded %d rules, want 13: %v", len(rules), rules)
+	}
+	checkDecoded(t, insts, rules)
+
+	// A program this daemon prepended rules to keeps runc's after its own.
+	prepended, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(229), Access: "rw", Allow: true},
+		{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(8), Access: "w", Allow: false},
+	}, insts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err = DecodeDeviceFilter(prepended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecoded(t, prepended, rules)
+}
+
+func TestDecodeDeviceFilterPrepended(t *testing.T) {
+	insts, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(188), Access: "rwm", Allow: true},
+		{Type: "c", Major: int64Ptr(188), Minor: int64Ptr(0), Access: "w", Allow: false},
+		{Type: "b", Major: int64Ptr(7), Minor: int64Ptr(0), Access: "r", Allow: true},
+	}, denyAllProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := DecodeDeviceFilter(insts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecoded(t, insts, rules)
+}
+
+func TestDecodeDeviceFilterUnknown(t *testing.T) {
+	for name, insts := range map[string]asm.Instructions{
+		"unknown type":        {asm.JNE.Imm(asm.R2, 3, "next"), asm.Mov.Imm32(asm.R0, 1), asm.Return(), asm.Mov.Imm32(asm.R0, 0).Sym("next"), asm.Return()},
+		"accept without exit": {asm.Mov.Imm32(asm.R0, 1), asm.Mov.Imm32(asm.R0, 0), asm.Return()},
+		"unknown instruction": {asm.JGT.Imm(asm.R4, 200, "next"), asm.Mov.Imm32(asm.R0, 1), asm.Return(), asm.Mov.Imm32(asm.R0, 0).Sym("next"), asm.Return()},
+	} {
+		if _, err := DecodeDeviceFilter(insts); !errors.Is(err, ErrUnknownDeviceFilter) {
+			t.Errorf("%s: err = %v, want ErrUnknownDeviceFilter", name, err)
+		}
+	}
+}
+
+func TestIntersectDeviceRules(t *testing.T) {
+	// Attached programs combine with AND: an access has to pass both.
+	runc := runcProgram()
+	own, err := PrependDeviceFilter([]DeviceRule{
+		{Type: "c", Major: int64Ptr(10), Minor: int64Ptr(229), Access: "rwm", Allow: true},
+		{Type: "a", Access: "m", Allow: false},
+		{Type: "c", Major: int64Ptr(1), Access: "rw", Allow: true},
+		{Type: "c", Major: int64Ptr(1), Minor: int64Ptr(5), Access: "w", Allow: false},
+	}, asm.Instructions{asm.Mov.Imm32(asm.R0, 1), asm.Return()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := DecodeDeviceFilter(runc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DecodeDeviceFilter(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := intersectDeviceRules(a, b)
+	for _, access := range deviceAccesses() {
+		want := runDeviceFilter(t, runc, access) && runDeviceFilter(t, own, access)
+		if allowed := Allows(rules, ruleOf(access)); allowed != want {
+			t.Errorf("%+v: intersected rules allow = %v, programs allow = %v", access, allowed, want)
+		}
+	}
+}
+
+func BenchmarkPrependDeviceFilter(b *testing.B) {
+	rules := make([]DeviceRule, 100)
+	for i := range rules {
+		rules[i] = DeviceRule{Type: "c", Major: int64Ptr(240), Minor: int64Ptr(int64(i)), Access: "rw", Allow: true}
+	}
+	original := runcProgram()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := PrependDeviceFilter(rules, original); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeDeviceFilter(b *testing.B) {
+	rules := make([]DeviceRule, 100)
+	for i := range rules {
+		rules[i] = DeviceRule{Type: "c", Major: int64Ptr(240), Minor: int64Ptr(int64(i)), Access: "rw", Allow: true}
+	}
+	insts, err := PrependDeviceFilter(rules, runcProgram())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeDeviceFilter(insts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzDecodeDeviceFilter(f *testing.F) {
+	var seed bytes.Buffer
+	for _, insts := range []asm.Instructions{runcProgram(), denyAllProgram, {asm.Return()}} {
+		seed.Reset()
+		if err := insts.Marshal(&seed, binary.LittleEndian); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(seed.Bytes())
+	}
+	prepended, err := PrependDeviceFilter([]DeviceRule{{Type: "c", Major: int64Ptr(188), Access: "rw", Allow: true}}, runcProgram())
+	if err != nil {
+		f.Fatal(err)
+	}
+	seed.Reset()
+	if err := prepended.Marshal(&seed, binary.LittleEndian); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed.Bytes())
+
+	f.Fuzz(func(t *testing.T, program []byte) {
+		var insts asm.Instructions
+		if err := insts.Unmarshal(bytes.NewReader(program), binary.LittleEndian); err != nil {
+			return
+		}
+
+		// Whatever the kernel returns for an attached program, it is either decoded or reported as unknown.
+		rules, err := DecodeDeviceFilter(insts)
+		if err != nil && !errors.Is(err, ErrUnknownDeviceFilter) {
+			t.Fatalf("decoding failed with %v, want ErrUnknownDeviceFilter", err)
+		}
+		for _, rule := range rules {
+			if rule.Type != "a" && rule.Type != "b" && rule.Type != "c" {
+				t.Fatalf("decoded the invalid rule %+v", rule)
+			}
+			if _, err := ParseDeviceAccess(rule.Access); err != nil {
+				t.Fatalf("decoded the rule %+v: %v", rule, err)
+			}
+		}
+	})
+}
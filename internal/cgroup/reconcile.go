@@ -0,0 +1,176 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cgroup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reconcile compares the desired rules against the rules in effect for the cgroup at cgroupPath and
+// writes only the allows that are missing and the denies of devices that are still accessible. Rules
+// in effect that are not mentioned in desired are left alone. When the rules in effect cannot be
+// read, every desired rule is written, as adding a rule that is already in effect is harmless.
+func reconcile(c Interface, cgroupPath string, desired []DeviceRule) (int, int, error) {
+	actual, err := c.ListDeviceRules(cgroupPath)
+	if err != nil {
+		actual = nil
+	}
+
+	var changes []DeviceRule
+	added, removed := 0, 0
+	for _, rule := range desired {
+		inEffect := err == nil
+		if rule.Allow {
+			inEffect = inEffect && isAllowed(actual, rule, true)
+		} else {
+			inEffect = inEffect && !isAllowed(actual, rule, false)
+		}
+		if inEffect {
+			continue
+		}
+
+		changes = append(changes, rule)
+		if rule.Allow {
+			added++
+		} else {
+			removed++
+		}
+	}
+
+	if len(changes) == 0 {
+		return 0, 0, nil
+	}
+
+	// The changes keep the order of desired, so a later rule still overrides an earlier one.
+	if err := c.AddDeviceRules(cgroupPath, changes); err != nil {
+		return 0, 0, fmt.Errorf("unable to write %d device rules: %v", len(changes), err)
+	}
+
+	return added, removed, nil
+}
+
+// Allows reports whether rules, evaluated as ListDeviceRules returns them, allow every access of rule
+func Allows(rules []DeviceRule, rule DeviceRule) bool {
+	return isAllowed(rules, rule, true)
+}
+
+// Denies reports whether rules, evaluated as ListDeviceRules returns them, deny every access of rule
+func Denies(rules []DeviceRule, rule DeviceRule) bool {
+	return !isAllowed(rules, rule, false)
+}
+
+// isAllowed evaluates rules in order, the first match winning, for every access of rule. It reports
+// whether all those accesses are allowed, or with all set to false, whether any of them is.
+func isAllowed(rules []DeviceRule, rule DeviceRule, all bool) bool {
+	for _, access := range rule.Access {
+		allowed := false
+		for _, candidate := range rules {
+			if matchesDevice(candidate, rule, access) {
+				allowed = candidate.Allow
+				break
+			}
+		}
+		if allowed != all {
+			return allowed
+		}
+	}
+	return all
+}
+
+// intersectDeviceRules returns rules, evaluated first match wins, allowing exactly the accesses both a
+// and b allow. Each pair of rules yields the rule for the devices and accesses they have in common,
+// ordered by the rule of a and then by that of b, so the first pair matching an access is made of the
+// rules of a and b that decide it.
+func intersectDeviceRules(a []DeviceRule, b []DeviceRule) []DeviceRule {
+	var rules []DeviceRule
+	for _, ruleA := range a {
+		for _, ruleB := range b {
+			rule, ok := intersectDeviceRule(ruleA, ruleB)
+			if ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// intersectDeviceRule returns the rule for the devices and accesses a and b have in common, allowing
+// them only if both do, and whether there are any
+func intersectDeviceRule(a DeviceRule, b DeviceRule) (DeviceRule, bool) {
+	rule := DeviceRule{Type: a.Type, Allow: a.Allow && b.Allow}
+	if rule.Type == "a" {
+		rule.Type = b.Type
+	} else if b.Type != "a" && b.Type != a.Type {
+		return DeviceRule{}, false
+	}
+
+	var ok bool
+	if rule.Major, ok = intersectDeviceNumber(a.Major, b.Major); !ok {
+		return DeviceRule{}, false
+	}
+	if rule.Minor, ok = intersectDeviceNumber(a.Minor, b.Minor); !ok {
+		return DeviceRule{}, false
+	}
+
+	rule.Access = sharedAccess(a.Access, b.Access)
+	return rule, rule.Access != ""
+}
+
+// intersectDeviceNumber returns the major or minor number matched by both a and b, nil for a
+// wildcard, and whether there is one
+func intersectDeviceNumber(a *int64, b *int64) (*int64, bool) {
+	switch {
+	case isWildcard(a) && isWildcard(b):
+		return nil, true
+	case isWildcard(a):
+		return b, true
+	case isWildcard(b) || *a == *b:
+		return a, true
+	}
+	return nil, false
+}
+
+// matchesDevice reports whether candidate applies to the device of rule for the given access
+func matchesDevice(candidate DeviceRule, rule DeviceRule, access rune) bool {
+	if candidate.Type != "a" && candidate.Type != rule.Type {
+		return false
+	}
+	if candidate.Major != nil && (rule.Major == nil || *candidate.Major != *rule.Major) {
+		return false
+	}
+	if candidate.Minor != nil && (rule.Minor == nil || *candidate.Minor != *rule.Minor) {
+		return false
+	}
+	return strings.ContainsRune(candidate.Access, access)
+}
+
+// Overlaps reports whether a and b apply to a common device for a common access
+func Overlaps(a DeviceRule, b DeviceRule) bool {
+	if a.Type != "a" && b.Type != "a" && a.Type != b.Type {
+		return false
+	}
+	if !isWildcard(a.Major) && !isWildcard(b.Major) && *a.Major != *b.Major {
+		return false
+	}
+	if !isWildcard(a.Minor) && !isWildcard(b.Minor) && *a.Minor != *b.Minor {
+		return false
+	}
+	return strings.ContainsAny(a.Access, b.Access)
+}
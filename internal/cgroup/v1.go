@@ -23,7 +23,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // GetDeviceCGroupMountPath returns the mount path (and its prefix) for the device cgroup controller associated with pid
@@ -42,27 +46,27 @@ func (c *cgroupv1) GetDeviceCGroupMountPath(procRootPath string, pid int) (strin
 
 	// Loop through the file looking for a subsystem of 'devices' entry.
 	for scanner.Scan() {
-		// Split each entry by '[space]'
-		parts := strings.Split(scanner.Text(), " ")
-		if len(parts) < 5 {
-			return "", "", fmt.Errorf("malformed mountinfo entry: %v", scanner.Text())
+		mount, err := parseMountInfo(scanner.Text())
+		if err != nil {
+			return "", "", err
 		}
 		// Look for an entry with cgroup as the mount type.
-		if parts[len(parts)-3] != "cgroup" {
+		if mount.FSType != "cgroup" {
 			continue
 		}
-		// Look for an entry with 'devices' as the basename of the mountpath
-		if filepath.Base(parts[4]) != "devices" {
+		// Look for an entry with 'devices' among its controllers. This is found in
+		// the super options rather than the mount point, which may be a combined
+		// (e.g. 'cpu,devices') or a non-standard location.
+		if !hasOption(mount.SuperOptions, "devices") {
 			continue
 		}
 		// Make sure the mount prefix is not a relative path.
-		if strings.HasPrefix(parts[3], "/..") {
-			return "", "", fmt.Errorf("relative path in mount prefix: %v", parts[3])
+		if strings.HasPrefix(mount.Root, "/..") {
+			return "", "", fmt.Errorf("relative path in mount prefix: %v", mount.Root)
 		}
-		// Return the 3rd element as the prefix of the mount point for
-		// the devices cgroup and the 4th element as the mount point of
-		// the devices cgroup itself.
-		return parts[3], parts[4], nil
+		// Return the root as the prefix of the mount point for the devices
+		// cgroup and the mount point of the devices cgroup itself.
+		return mount.Root, mount.MountPoint, nil
 	}
 
 	return "", "", fmt.Errorf("no cgroup filesystem mounted for the devices subsytem in mountinfo file")
@@ -104,10 +108,72 @@ func (c *cgroupv1) GetDeviceCGroupRootPath(procRootPath string, prefix string, p
 	return "", fmt.Errorf("no devices cgroup entries found")
 }
 
+// GetDevicesMountPoint returns where the devices controller is mounted according to a file in the format
+// of /proc/mounts, which need not be /sys/fs/cgroup/devices, e.g. with a combined cpu,devices mount
+func GetDevicesMountPoint(mountsPath string) (string, error) {
+	file, err := os.Open(mountsPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Each line is: <source> <mount point> <fstype> <options> <dump> <pass>
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "cgroup" {
+			continue
+		}
+		if hasOption(strings.Split(fields[3], ","), "devices") {
+			return unescapeMountInfo(fields[1]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no cgroup mount with the devices controller in %v", mountsPath)
+}
+
+// DeviceControllerAvailable reports whether the kernel has the devices controller compiled in and enabled
+func (c *cgroupv1) DeviceControllerAvailable() (bool, error) {
+	// Open the list of controllers known to the kernel.
+	file, err := os.Open("/proc/cgroups")
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Create a scanner to loop through the file's contents.
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	// Loop through the file looking for the 'devices' entry, whose last
+	// field tells whether it was disabled (e.g. by cgroup_disable=devices).
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || fields[0] != "devices" {
+			continue
+		}
+		return fields[3] == "1", nil
+	}
+
+	return false, scanner.Err()
+}
+
 // AddDeviceRules adds a set of device rules for the device cgroup at cgroupPath
 func (c *cgroupv1) AddDeviceRules(cgroupPath string, rules []DeviceRule) error {
-	// Loop through all rules in the set of device rules and add that rule to the device.
+	defer observeWrite(1, time.Now())
+
+	// Loop through all rules in the set of device rules and add that rule to the device,
+	// in order, so a later rule overrides an earlier one as it does on cgroup v2.
 	for _, rule := range rules {
+		if !rule.Allow && rule.Type != "a" {
+			err := c.denyCoveredRules(cgroupPath, rule)
+			if err != nil {
+				return err
+			}
+		}
 		err := c.addDeviceRule(cgroupPath, &rule)
 		if err != nil {
 			return err
@@ -117,14 +183,194 @@ func (c *cgroupv1) AddDeviceRules(cgroupPath string, rules []DeviceRule) error {
 	return nil
 }
 
+// denyCoveredRules makes a deny take the effect it has on cgroup v2 when the cgroup is in its
+// default deny mode. The kernel only removes the allow entry that matches the deny exactly, so
+// entries for devices within a wildcard deny are denied one by one. An allow entry spanning more
+// devices than the deny cannot be narrowed on v1: the accesses it shares with the deny stay allowed,
+// which is logged, while the deny still takes effect for the others. Docker's "c *:* m" and
+// "b *:* m" keep mknod allowed this way, which only matters with CAP_MKNOD so is logged at debug level.
+func (c *cgroupv1) denyCoveredRules(cgroupPath string, rule DeviceRule) error {
+	entries, err := c.ListDeviceRules(cgroupPath)
+	if err != nil {
+		return err
+	}
+	// In its default allow mode the cgroup lists just "a *:* rwm" and denies are stored as is.
+	if len(entries) == 1 && entries[0].Type == "a" {
+		return nil
+	}
+
+	for _, entry := range entries {
+		if !strings.ContainsAny(entry.Access, rule.Access) || sameDevices(entry, rule) {
+			continue
+		}
+		if coversDevices(rule, entry) {
+			covered := entry
+			covered.Access = rule.Access
+			covered.Allow = false
+			err := c.addDeviceRule(cgroupPath, &covered)
+			if err != nil {
+				return err
+			}
+		} else if coversDevices(entry, rule) {
+			broadened := sharedAccess(entry.Access, rule.Access)
+			broader, _ := formatDeviceRule(&entry)
+			denied, _ := formatDeviceRule(&rule)
+			if broadened == "m" {
+				logrus.Debugf("cgroup v1 keeps mknod of %v allowed by the broader allow %v", denied, broader)
+			} else {
+				logrus.Warnf("cgroup v1 cannot deny %v of %v within the broader allow %v", broadened, denied, broader)
+			}
+		}
+	}
+
+	return nil
+}
+
+// broadenedAccess returns the accesses of a deny that allow entries spanning more devices than
+// its own keep allowed, as the kernel cannot remove them on cgroup v1
+func broadenedAccess(entries []DeviceRule, rule DeviceRule) string {
+	broadened := ""
+	for _, entry := range entries {
+		if coversDevices(entry, rule) && !sameDevices(entry, rule) {
+			broadened += sharedAccess(entry.Access, rule.Access)
+		}
+	}
+	return sharedAccess("rwm", broadened)
+}
+
+// sharedAccess returns the accesses in both a and b, in the order of "rwm"
+func sharedAccess(a string, b string) string {
+	shared := ""
+	for _, access := range "rwm" {
+		if strings.ContainsRune(a, access) && strings.ContainsRune(b, access) {
+			shared += string(access)
+		}
+	}
+	return shared
+}
+
+// coversDevices reports whether every device matched by inner is also matched by outer
+func coversDevices(outer DeviceRule, inner DeviceRule) bool {
+	if outer.Type != "a" && outer.Type != inner.Type {
+		return false
+	}
+	if !isWildcard(outer.Major) && (isWildcard(inner.Major) || *outer.Major != *inner.Major) {
+		return false
+	}
+	return isWildcard(outer.Minor) || (!isWildcard(inner.Minor) && *outer.Minor == *inner.Minor)
+}
+
+// isWildcard reports whether a major or minor matches any number, as formatDeviceRule prints it
+func isWildcard(number *int64) bool {
+	return number == nil || *number < 0
+}
+
+// sameDevices reports whether a and b match exactly the same devices
+func sameDevices(a DeviceRule, b DeviceRule) bool {
+	return coversDevices(a, b) && coversDevices(b, a)
+}
+
+// ListDeviceRules returns the device rules in effect for the device cgroup at cgroupPath
+func (c *cgroupv1) ListDeviceRules(cgroupPath string) ([]DeviceRule, error) {
+	// Open the cgroup's list of allowed devices.
+	file, err := os.Open(filepath.Join(cgroupPath, "devices.list"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Create a scanner to loop through the file's contents.
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	// Every entry is an allowed device; '*' stands for any major or minor.
+	var rules []DeviceRule
+	for scanner.Scan() {
+		rule, err := parseDeviceRule(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		rule.Allow = true
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// parseDeviceRule parses an entry of devices.list, the inverse of formatDeviceRule
+func parseDeviceRule(entry string) (DeviceRule, error) {
+	fields := strings.Fields(entry)
+	if len(fields) != 3 {
+		return DeviceRule{}, fmt.Errorf("malformed devices.list entry: %v", entry)
+	}
+
+	numbers := strings.SplitN(fields[1], ":", 2)
+	if len(numbers) != 2 {
+		return DeviceRule{}, fmt.Errorf("malformed devices.list entry: %v", entry)
+	}
+
+	rule := DeviceRule{Type: fields[0], Access: fields[2]}
+	for i, number := range numbers {
+		if number == "*" {
+			continue
+		}
+		value, err := strconv.ParseInt(number, 10, 64)
+		if err != nil || value < 0 {
+			return DeviceRule{}, fmt.Errorf("malformed devices.list entry: %v", entry)
+		}
+		if i == 0 {
+			rule.Major = &value
+		} else {
+			rule.Minor = &value
+		}
+	}
+
+	return rule, nil
+}
+
+// Reconcile writes only those of the desired device rules that are not already in effect for the device cgroup at cgroupPath
+func (c *cgroupv1) Reconcile(cgroupPath string, desired []DeviceRule) (int, int, error) {
+	// The accesses of a deny kept allowed by a broader allow stay allowed however often the deny is
+	// written, so they are left out rather than counted as missing on every pass.
+	entries, err := c.ListDeviceRules(cgroupPath)
+	if err == nil && !(len(entries) == 1 && entries[0].Type == "a") {
+		narrowed := make([]DeviceRule, 0, len(desired))
+		for _, rule := range desired {
+			if !rule.Allow && rule.Type != "a" {
+				broadened := broadenedAccess(entries, rule)
+				rule.Access = strings.Map(func(access rune) rune {
+					if strings.ContainsRune(broadened, access) {
+						return -1
+					}
+					return access
+				}, rule.Access)
+				if rule.Access == "" {
+					continue
+				}
+			}
+			narrowed = append(narrowed, rule)
+		}
+		desired = narrowed
+	}
+
+	return reconcile(c, cgroupPath, desired)
+}
+
+// RemoveDeviceRules revokes a set of device rules from the device cgroup at cgroupPath
+func (c *cgroupv1) RemoveDeviceRules(cgroupPath string, rules []DeviceRule) error {
+	// Writing an entry into devices.deny removes it from the cgroup's allow list.
+	return c.AddDeviceRules(cgroupPath, denyRules(rules))
+}
+
 func (c *cgroupv1) addDeviceRule(cgroupPath string, rule *DeviceRule) error {
-	// Check the major/minor numbers of the device in the device rule.
-	if rule.Major == nil {
-		return fmt.Errorf("no major set in device rule")
+	normalized, err := NormalizeDeviceRule(*rule)
+	if err != nil {
+		return err
 	}
 
-	if rule.Minor == nil {
-		return fmt.Errorf("no minor set in device rule")
+	entry, err := formatDeviceRule(&normalized)
+	if err != nil {
+		return err
 	}
 
 	// Open the appropriate allow/deny file.
@@ -141,10 +387,64 @@ func (c *cgroupv1) addDeviceRule(cgroupPath string, rule *DeviceRule) error {
 	defer file.Close()
 
 	// Write the device rule into the file.
-	_, err = file.WriteString(fmt.Sprintf("%s %d:%d %s", rule.Type, *rule.Major, *rule.Minor, rule.Access))
+	_, err = file.WriteString(entry)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// formatDeviceRule serializes a device rule into the entry format of devices.allow/devices.deny
+func formatDeviceRule(rule *DeviceRule) (string, error) {
+	// A nil (or, as in OCI json, negative) major/minor matches any number.
+	major, minor := "*", "*"
+	if rule.Major != nil && *rule.Major >= 0 {
+		major = strconv.FormatInt(*rule.Major, 10)
+	}
+	if rule.Minor != nil && *rule.Minor >= 0 {
+		minor = strconv.FormatInt(*rule.Minor, 10)
+	}
+
+	return fmt.Sprintf("%s %s:%s %s", rule.Type, major, minor, rule.Access), nil
+}
+
+// blkioThrottleFiles maps io.max style limit keys to the blkio throttle files of cgroup v1
+var blkioThrottleFiles = map[string]string{
+	"rbps":  "blkio.throttle.read_bps_device",
+	"wbps":  "blkio.throttle.write_bps_device",
+	"riops": "blkio.throttle.read_iops_device",
+	"wiops": "blkio.throttle.write_iops_device",
+}
+
+// SetIOLimit throttles the block device major:minor in the blkio cgroup next to the device cgroup at cgroupPath
+func (c *cgroupv1) SetIOLimit(cgroupPath string, major int64, minor int64, limits map[string]uint64) error {
+	// The blkio hierarchy mirrors the devices hierarchy, so swap the controller directory.
+	parts := strings.Split(filepath.Clean(cgroupPath), string(filepath.Separator))
+	found := false
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] == "devices" {
+			parts[i] = "blkio"
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unable to locate the blkio cgroup next to %v", cgroupPath)
+	}
+	blkioPath := strings.Join(parts, string(filepath.Separator))
+
+	// Write each limit into its throttle file.
+	for _, key := range sortedIOLimitKeys(limits) {
+		name, ok := blkioThrottleFiles[key]
+		if !ok {
+			return fmt.Errorf("unknown io limit %v", key)
+		}
+		err := os.WriteFile(filepath.Join(blkioPath, name), []byte(fmt.Sprintf("%d:%d %d", major, minor, limits[key])), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newDevicesCgroup creates a cgroup v1 devices cgroup denying every device, skipping the test
+// when the devices hierarchy isn't mounted writable.
+func newDevicesCgroup(t testing.TB) string {
+	t.Helper()
+
+	path := filepath.Join("/sys/fs/cgroup/devices", fmt.Sprintf("dvd-test-%d", os.Getpid()))
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Skipf("unable to create a cgroup v1 devices cgroup: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(path) })
+
+	if err := os.WriteFile(filepath.Join(path, "devices.deny"), []byte("a"), 0600); err != nil {
+		t.Skipf("unable to write to a cgroup v1 devices cgroup: %v", err)
+	}
+	return path
+}
+
+func parseRules(t *testing.T, entries ...string) []DeviceRule {
+	t.Helper()
+
+	var rules []DeviceRule
+	for _, entry := range entries {
+		allow := !strings.HasPrefix(entry, "!")
+		rule, err := parseDeviceRule(strings.TrimPrefix(entry, "!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rule.Allow = allow
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestV1DenyWithinBroaderAllow(t *testing.T) {
+	path := newDevicesCgroup(t)
+	c := &cgroupv1{}
+
+	// The allows Docker gives a container by default, along with a wildcard of its own.
+	defaults := parseRules(t, "c *:* m", "b *:* m", "c 1:3 rwm", "c 188:* rwm")
+	if err := c.AddDeviceRules(path, defaults); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := parseRules(t, "c 10:200 rwm", "!c 10:200 rwm", "!c 188:0 rwm", "!c 1:3 w")
+	for _, change := range changes {
+		if err := c.AddDeviceRules(path, []DeviceRule{change}); err != nil {
+			t.Fatalf("%+v: %v", change, err)
+		}
+	}
+
+	actual, err := c.ListDeviceRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cgroup v2 applies the same rules to a program denying everything else.
+	program, err := PrependDeviceFilter(append(defaults, changes...), denyAllProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The two differ only in the accesses broader allows keep on cgroup v1.
+	kept := map[string]bool{"c 10:200 m": true, "c 188:0 r": true, "c 188:0 w": true, "c 188:0 m": true}
+	for _, access := range deviceAccesses() {
+		rule := ruleOf(access)
+		entry, _ := formatDeviceRule(&rule)
+		v1, v2 := Allows(actual, rule), runDeviceFilter(t, program, access)
+		if v1 != v2 && !kept[entry] {
+			t.Errorf("%v: allowed on cgroup v1 = %v, on cgroup v2 = %v", entry, v1, v2)
+		} else if kept[entry] && (!v1 || v2) {
+			t.Errorf("%v: allowed on cgroup v1 = %v, on cgroup v2 = %v, want only v1", entry, v1, v2)
+		}
+	}
+
+	// Reconciling doesn't write the denies again for the accesses v1 keeps.
+	added, removed, err := c.Reconcile(path, parseRules(t, "!c 10:200 rwm", "!c 188:0 rwm", "!c 1:3 w"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 || removed != 0 {
+		t.Errorf("reconciling denies in effect wrote %d allows and %d denies", added, removed)
+	}
+}
+
+func TestV1DenyWildcard(t *testing.T) {
+	path := newDevicesCgroup(t)
+	c := &cgroupv1{}
+
+	if err := c.AddDeviceRules(path, parseRules(t, "c 188:0 rwm", "c 188:1 r", "c 189:0 rwm")); err != nil {
+		t.Fatal(err)
+	}
+	// A wildcard deny removes the entries within it, which the kernel alone would leave.
+	if err := c.RemoveDeviceRules(path, parseRules(t, "c 188:* rw")); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := c.ListDeviceRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry, want := range map[string]bool{"c 188:0 r": false, "c 188:0 m": true, "c 188:1 r": false, "c 189:0 rw": true} {
+		rule := parseRules(t, entry)[0]
+		if allowed := Allows(actual, rule); allowed != want {
+			t.Errorf("%v: allowed = %v, want %v (devices.list: %v)", entry, allowed, want, actual)
+		}
+	}
+}
+
+func TestBroadenedAccess(t *testing.T) {
+	entries := parseRules(t, "c *:* m", "b *:* m", "c 188:* rw", "c 188:0 rwm", "b 8:0 r")
+	for rule, want := range map[string]string{
+		"c 188:0 rwm": "rwm",
+		"c 188:* rwm": "m",
+		"c 10:200 rw": "",
+		"b 8:0 rwm":   "m",
+		"b 8:* mw":    "m",
+		"c 1:3 wm":    "m",
+		"a *:* rwm":   "",
+	} {
+		if broadened := broadenedAccess(entries, parseRules(t, "!"+rule)[0]); broadened != want {
+			t.Errorf("%v: broadened = %q, want %q", rule, broadened, want)
+		}
+	}
+}
+
+func BenchmarkV1AddDeviceRules(b *testing.B) {
+	path := newDevicesCgroup(b)
+	c := &cgroupv1{}
+
+	rules := make([]DeviceRule, 100)
+	for i := range rules {
+		rules[i] = DeviceRule{Type: "c", Major: int64Ptr(240), Minor: int64Ptr(int64(i)), Access: "rwm", Allow: true}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := c.AddDeviceRules(path, rules); err != nil {
+			b.Fatal(err)
+		}
+		// Denying the rules one by one lists the cgroup's entries for every one of them.
+		if err := c.RemoveDeviceRules(path, rules); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkV1Reconcile(b *testing.B) {
+	path := newDevicesCgroup(b)
+	c := &cgroupv1{}
+
+	rules := make([]DeviceRule, 100)
+	for i := range rules {
+		rules[i] = DeviceRule{Type: "c", Major: int64Ptr(240), Minor: int64Ptr(int64(i)), Access: "rwm", Allow: true}
+	}
+	if err := c.AddDeviceRules(path, rules); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Every rule is in effect already, as on the reconcile passes that follow a container's start.
+	for i := 0; i < b.N; i++ {
+		if _, _, err := c.Reconcile(path, rules); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzParseDeviceRule(f *testing.F) {
+	for _, seed := range []string{"a *:* rwm", "c 1:3 rwm", "b 8:* r", "c *:5 m", "c 1:3", "c 1-3 rwm", "c -1:3 r", "c 1:3:5 r"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, entry string) {
+		rule, err := parseDeviceRule(entry)
+		if err != nil {
+			return
+		}
+
+		// An entry of devices.list formats to one that parses back to the same rule.
+		formatted, err := formatDeviceRule(&rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reparsed, err := parseDeviceRule(formatted)
+		if err != nil {
+			t.Fatalf("%q parsed to %+v, which formats to %q that doesn't parse: %v", entry, rule, formatted, err)
+		}
+		if !reflect.DeepEqual(reparsed, rule) {
+			t.Fatalf("%q parsed to %+v, which formats to %q parsing back to %+v", entry, rule, formatted, reparsed)
+		}
+	})
+}
+
+func TestGetDevicesMountPoint(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		mounts string
+		want   string
+	}{
+		{
+			name: "systemd hybrid",
+			mounts: `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /sys/fs/cgroup tmpfs ro,nosuid,nodev,noexec,mode=755 0 0
+cgroup2 /sys/fs/cgroup/unified cgroup2 rw,nosuid,nodev,noexec,relatime,nsdelegate 0 0
+cgroup /sys/fs/cgroup/systemd cgroup rw,nosuid,nodev,noexec,relatime,xattr,name=systemd 0 0
+cgroup /sys/fs/cgroup/devices cgroup rw,nosuid,nodev,noexec,relatime,devices 0 0
+`,
+			want: "/sys/fs/cgroup/devices",
+		},
+		{
+			name: "combined controllers",
+			mounts: `cgroup /sys/fs/cgroup/cpu,cpuacct cgroup rw,nosuid,nodev,noexec,relatime,cpu,cpuacct 0 0
+cgroup /sys/fs/cgroup/blkio,devices cgroup rw,nosuid,nodev,noexec,relatime,blkio,devices 0 0
+`,
+			want: "/sys/fs/cgroup/blkio,devices",
+		},
+		{
+			name: "custom fstab location",
+			mounts: `/dev/sda1 / ext4 rw,relatime 0 0
+devices /cgroup/my\040devices cgroup rw,relatime,devices 0 0
+`,
+			want: "/cgroup/my devices",
+		},
+		{
+			name: "controller named in a mount point only",
+			mounts: `cgroup /sys/fs/cgroup/devices cgroup rw,relatime,cpuset 0 0
+tmpfs /devices tmpfs rw,devices 0 0
+cgroup /mnt/dev cgroup rw,relatime,devices 0 0
+`,
+			want: "/mnt/dev",
+		},
+	} {
+		mountsPath := filepath.Join(t.TempDir(), "mounts")
+		if err := os.WriteFile(mountsPath, []byte(test.mounts), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if mountPoint, err := GetDevicesMountPoint(mountsPath); err != nil || mountPoint != test.want {
+			t.Errorf("%s: found %q (%v), want %q", test.name, mountPoint, err, test.want)
+		}
+	}
+
+	mountsPath := filepath.Join(t.TempDir(), "mounts")
+	if err := os.WriteFile(mountsPath, []byte("cgroup2 /sys/fs/cgroup cgroup2 rw,nsdelegate 0 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mountPoint, err := GetDevicesMountPoint(mountsPath); err == nil {
+		t.Errorf("found %q on a host without cgroup v1", mountPoint)
+	}
+}
+
+func TestGetDeviceCGroupRootPathV1(t *testing.T) {
+	root := newProcRoot(t, map[string]string{"cgroup": `12:memory:/docker/abc
+11:cpu,cpuacct:/docker/abc
+7:devices:/docker/abc
+1:name=systemd:/docker/abc
+0::/system.slice/containerd.service
+`})
+	c := &cgroupv1{}
+
+	// The prefix is the root of a bind mounted subtree, which the mount point already stands for.
+	for prefix, want := range map[string]string{"/": "/docker/abc", "/docker": "/abc"} {
+		if cgroupPath, err := c.GetDeviceCGroupRootPath(root, prefix, 1); err != nil || cgroupPath != want {
+			t.Errorf("prefix %q: found %q (%v), want %q", prefix, cgroupPath, err, want)
+		}
+	}
+
+	root = newProcRoot(t, map[string]string{"cgroup": "0::/system.slice/docker-abc.scope\n"})
+	if cgroupPath, err := c.GetDeviceCGroupRootPath(root, "/", 1); err == nil {
+		t.Errorf("found %q without a devices entry", cgroupPath)
+	}
+}
+
+func TestV1RemoveDeviceRules(t *testing.T) {
+	// The denies are written to devices.deny, whatever the Allow of the rules passed.
+	fake := newFakeDevicesCgroup(t)
+	c := &cgroupv1{}
+	if err := c.RemoveDeviceRules(fake, parseRules(t, "c 1:3 w", "!b 8:* rwm")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"devices.allow": "", "devices.deny": "c 1:3 wb 8:* rwm"} {
+		content, err := os.ReadFile(filepath.Join(fake, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("%s holds %q, want %q", name, content, want)
+		}
+	}
+
+	path := newDevicesCgroup(t)
+	if err := c.AddDeviceRules(path, parseRules(t, "c 1:3 rwm", "c 1:5 rwm", "b 8:0 rw")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveDeviceRules(path, parseRules(t, "c 1:3 w", "b 8:* rwm")); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := c.ListDeviceRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := parseRules(t, "c 1:3 rm", "c 1:5 rwm"); !reflect.DeepEqual(actual, want) {
+		t.Errorf("devices.list holds %v, want %v", actual, want)
+	}
+}
+
+func TestV1WildcardMinor(t *testing.T) {
+	rules := []DeviceRule{
+		{Type: "c", Major: int64Ptr(226), Access: "rwm", Allow: true},
+		{Type: "c", Major: int64Ptr(189), Minor: int64Ptr(-1), Access: "r", Allow: true},
+		{Type: "c", Major: int64Ptr(240), Minor: int64Ptr(0), Access: "rwm", Allow: true},
+	}
+	c := &cgroupv1{}
+
+	fake := newFakeDevicesCgroup(t)
+	if err := c.AddDeviceRules(fake, rules); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(fake, "devices.allow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c 226:* rwmc 189:* rc 240:0 rwm"; string(content) != want {
+		t.Errorf("devices.allow holds %q, want %q", content, want)
+	}
+
+	path := newDevicesCgroup(t)
+	if err := c.AddDeviceRules(path, rules); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := c.ListDeviceRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry, want := range map[string]bool{"c 226:0 rwm": true, "c 226:128 rw": true, "c 189:5 r": true, "c 189:5 w": false, "c 240:0 rw": true, "c 240:1 r": false} {
+		if allowed := Allows(actual, parseRules(t, entry)[0]); allowed != want {
+			t.Errorf("%v: allowed = %v, want %v (devices.list: %v)", entry, allowed, want, actual)
+		}
+	}
+}
@@ -20,13 +20,16 @@ package cgroup
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
 	"golang.org/x/sys/unix"
 )
 
@@ -49,27 +52,34 @@ func (c *cgroupv2) GetDeviceCGroupMountPath(procRootPath string, pid int) (strin
 	scanner.Split(bufio.ScanLines)
 
 	// Loop through the file looking for a subsystem of '' (i.e. unified) entry.
+	var found *mountInfo
 	for scanner.Scan() {
-		// Split each entry by '[space]'
-		parts := strings.Split(scanner.Text(), " ")
-		if len(parts) < 5 {
-			return "", "", fmt.Errorf("malformed mountinfo entry: %v", scanner.Text())
+		mount, err := parseMountInfo(scanner.Text())
+		if err != nil {
+			return "", "", err
 		}
 		// Look for an entry with cgroup2 as the mount type.
-		if parts[len(parts)-3] != "cgroup2" {
+		if mount.FSType != "cgroup2" {
 			continue
 		}
 		// Make sure the mount prefix is not a relative path.
-		if strings.HasPrefix(parts[3], "/..") {
-			return "", "", fmt.Errorf("relative path in mount prefix: %v", parts[3])
+		if strings.HasPrefix(mount.Root, "/..") {
+			return "", "", fmt.Errorf("relative path in mount prefix: %v", mount.Root)
+		}
+		// Nested runtimes can leave several cgroup2 mounts behind, in which case
+		// the one at the standard location wins over the first one found.
+		if found == nil || mount.MountPoint == "/sys/fs/cgroup" {
+			found = &mount
 		}
-		// Return the 3rd element as the prefix of the mount point for
-		// the devices cgroup and the 4th element as the mount point of
-		// the devices cgroup itself.
-		return parts[3], parts[4], nil
 	}
 
-	return "", "", fmt.Errorf("no cgroup2 filesystem in mountinfo file")
+	if found == nil {
+		return "", "", fmt.Errorf("no cgroup2 filesystem in mountinfo file")
+	}
+
+	// Return the root as the prefix of the mount point for the devices
+	// cgroup and the mount point of the devices cgroup itself.
+	return found.Root, found.MountPoint, nil
 }
 
 // GetDeviceCGroupRootPath returns the root path for the device cgroup controller associated with pid
@@ -108,8 +118,41 @@ func (c *cgroupv2) GetDeviceCGroupRootPath(procRootPath string, prefix string, p
 	return "", fmt.Errorf("no cgroupv2 entries in file")
 }
 
+// DeviceControllerAvailable reports whether the kernel can load the eBPF programs that control device access
+func (c *cgroupv2) DeviceControllerAvailable() (bool, error) {
+	// Probing loads a program, which is subject to the same limit as AddDeviceRules.
+	memlockLimit := &unix.Rlimit{
+		Cur: unix.RLIM_INFINITY,
+		Max: unix.RLIM_INFINITY,
+	}
+	_ = unix.Setrlimit(unix.RLIMIT_MEMLOCK, memlockLimit)
+
+	err := features.HaveProgramType(ebpf.CGroupDevice)
+	if errors.Is(err, ebpf.ErrNotSupported) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 // AddDeviceRules adds a set of device rules for the device cgroup at cgroupPath
 func (c *cgroupv2) AddDeviceRules(cgroupPath string, rules []DeviceRule) error {
+	defer observeWrite(2, time.Now())
+
+	// Validate the access of every rule before touching any program.
+	normalized := make([]DeviceRule, len(rules))
+	for i, rule := range rules {
+		var err error
+		normalized[i], err = NormalizeDeviceRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	rules = normalized
+
 	// Open the cgroup path.
 	dirFD, err := unix.Open(cgroupPath, unix.O_DIRECTORY|unix.O_RDONLY, 0600)
 	if err != nil {
@@ -184,6 +227,83 @@ func (c *cgroupv2) AddDeviceRules(cgroupPath string, rules []DeviceRule) error {
 	return nil
 }
 
+// ListDeviceRules returns the device rules in effect for the device cgroup at cgroupPath
+func (c *cgroupv2) ListDeviceRules(cgroupPath string) ([]DeviceRule, error) {
+	// Open the cgroup path.
+	dirFD, err := unix.Open(cgroupPath, unix.O_DIRECTORY|unix.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the cgroup path: %v", err)
+	}
+	defer unix.Close(dirFD)
+
+	progs, err := FindAttachedCgroupDeviceFilters(dirFD)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find any existing device filters attached to the cgroup: %v", err)
+	}
+
+	// Without any device filter program, the cgroup has access to every device.
+	if len(progs) == 0 {
+		return []DeviceRule{{Type: "a", Access: "rwm", Allow: true}}, nil
+	}
+
+	// Decode the rules of each program. An access has to pass every program, so the
+	// rules of the programs are intersected.
+	var rules []DeviceRule
+	for i, prog := range progs {
+		defer prog.Close()
+
+		info, err := prog.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get Info() of a device filters program: %v", err)
+		}
+
+		insts, err := info.Instructions()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the instructions of a device filters program: %v", err)
+		}
+
+		decoded, err := DecodeDeviceFilter(insts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode a device filters program: %w", err)
+		}
+
+		if i == 0 {
+			rules = decoded
+		} else {
+			rules = intersectDeviceRules(rules, decoded)
+		}
+	}
+
+	return rules, nil
+}
+
+// Reconcile writes only those of the desired device rules that are not already in effect for the device cgroup at cgroupPath
+func (c *cgroupv2) Reconcile(cgroupPath string, desired []DeviceRule) (int, int, error) {
+	return reconcile(c, cgroupPath, desired)
+}
+
+// RemoveDeviceRules revokes a set of device rules from the device cgroup at cgroupPath
+func (c *cgroupv2) RemoveDeviceRules(cgroupPath string, rules []DeviceRule) error {
+	// Deny blocks are prepended to the attached programs, so they take precedence
+	// over any earlier allow for the same devices.
+	return c.AddDeviceRules(cgroupPath, denyRules(rules))
+}
+
+// SetIOLimit throttles the block device major:minor through the io.max file of the cgroup at cgroupPath
+func (c *cgroupv2) SetIOLimit(cgroupPath string, major int64, minor int64, limits map[string]uint64) error {
+	entry := fmt.Sprintf("%d:%d", major, minor)
+	for _, key := range sortedIOLimitKeys(limits) {
+		entry += fmt.Sprintf(" %s=%d", key, limits[key])
+	}
+
+	err := os.WriteFile(filepath.Join(cgroupPath, "io.max"), []byte(entry), 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write io.max (is the io controller enabled?): %v", err)
+	}
+
+	return nil
+}
+
 func generateNewProgram(rules []DeviceRule, oldInsts asm.Instructions) (*ebpf.Program, error) {
 	// Prepend instructions for the new devices to the original set of instructions.
 	newInsts, err := PrependDeviceFilter(rules, oldInsts)
@@ -0,0 +1,113 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// newV2Cgroup creates a cgroup in a cgroup2 hierarchy mounted for the test, with runcProgram attached
+// as runc does for a container. The test is skipped when the hierarchy can't be mounted or the kernel
+// can't load device filters.
+func newV2Cgroup(t *testing.T) string {
+	t.Helper()
+
+	c := &cgroupv2{}
+	if available, err := c.DeviceControllerAvailable(); !available {
+		t.Skipf("unable to load device filters: %v", err)
+	}
+	root := t.TempDir()
+	if err := unix.Mount("none", root, "cgroup2", 0, ""); err != nil {
+		t.Skipf("unable to mount a cgroup2 hierarchy: %v", err)
+	}
+	t.Cleanup(func() { unix.Unmount(root, unix.MNT_DETACH) })
+
+	path := filepath.Join(root, "dvd-test")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(path) })
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{Type: ebpf.CGroupDevice, Instructions: runcProgram(), License: BpfProgramLicense})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prog.Close()
+	dirFD, err := unix.Open(path, unix.O_DIRECTORY|unix.O_RDONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirFD)
+	if err := AttachCgroupDeviceFilter(prog, dirFD); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestV2RemoveDeviceRules(t *testing.T) {
+	path := newV2Cgroup(t)
+	c := &cgroupv2{}
+
+	if err := c.AddDeviceRules(path, parseRules(t, "b 8:0 rw", "b 8:1 r")); err != nil {
+		t.Fatal(err)
+	}
+	// Allows among the rules are revoked all the same.
+	if err := c.RemoveDeviceRules(path, parseRules(t, "c 1:3 w", "!b 8:* rwm")); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := c.ListDeviceRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry, want := range map[string]bool{
+		"c 1:3 r":  true,
+		"c 1:3 w":  false,
+		"c 1:3 m":  true,
+		"c 1:5 rw": true,
+		"b 8:0 r":  false,
+		"b 8:1 m":  false,
+		"c 1:7 w":  true,
+		"c 4:0 r":  false,
+	} {
+		if allowed := Allows(actual, parseRules(t, entry)[0]); allowed != want {
+			t.Errorf("%v: allowed = %v, want %v (rules: %v)", entry, allowed, want, actual)
+		}
+	}
+
+	// Removing the rules again changes nothing.
+	if err := c.RemoveDeviceRules(path, parseRules(t, "c 1:3 w", "b 8:* rwm")); err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.ListDeviceRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"c 1:3 r", "c 1:3 w", "c 1:5 rw", "b 8:0 r"} {
+		rule := parseRules(t, entry)[0]
+		if Allows(again, rule) != Allows(actual, rule) {
+			t.Errorf("%v: removing the rules again changed whether it is allowed (rules: %v)", entry, again)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// deviceRoots are the directories that device paths supplied through labels or the environment must resolve under,
+// and whose mounts are treated as devices, as set by DVD_DEVICE_ROOTS.
+var deviceRoots = []string{"/dev"}
+
+// parseDeviceRoots parses a comma separated list of absolute directories, ignoring invalid ones and
+// falling back to /dev when none is left.
+func parseDeviceRoots(value string) []string {
+	var roots []string
+
+	for _, root := range strings.Split(value, ",") {
+		root = strings.TrimSpace(root)
+
+		if root == "" {
+			continue
+		}
+
+		if !path.IsAbs(root) || path.Clean(root) == "/" {
+			log.Printf("ignoring invalid DVD_DEVICE_ROOTS entry %q, expected an absolute directory other than /\n", root)
+			continue
+		}
+
+		roots = append(roots, path.Clean(root))
+	}
+
+	if len(roots) == 0 {
+		return []string{"/dev"}
+	}
+
+	return roots
+}
+
+// isDeviceSource reports whether a mount source is within deviceRoots, and so treated as a device.
+func isDeviceSource(source string) bool {
+	if !path.IsAbs(source) {
+		return false
+	}
+
+	for _, root := range deviceRoots {
+		if isPathWithin(path.Clean(source), root) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deviceLabelNames lists the labels that are keyed by a device path, e.g. dvd.ttl./dev/ttyUSB0.
+var deviceLabelNames = []string{"access", "io.max", "ttl"}
+
+// labelKey builds the name of a container label read by the daemon, namespaced under pluginId,
+// e.g. labelKey("io.max", "/dev/sdb") is "dvd.io.max./dev/sdb".
+func labelKey(parts ...string) string {
+	return strings.Join(append([]string{pluginId}, parts...), ".")
+}
+
+// normalizeDevicePath cleans a user supplied device path and makes sure it stays within deviceRoots.
+// origin names where the path came from (e.g. the label) so errors point at the offending input.
+func normalizeDevicePath(origin string, value string) (string, error) {
+	if !path.IsAbs(value) || strings.Contains(value, "\\") {
+		return "", fmt.Errorf("invalid device path %q in %s: not an absolute unix path", value, origin)
+	}
+
+	for _, part := range strings.Split(value, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("invalid device path %q in %s: path traversal is not allowed", value, origin)
+		}
+	}
+
+	cleaned := path.Clean(value)
+
+	for _, root := range deviceRoots {
+		if isPathWithin(cleaned, root) {
+			return cleaned, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid device path %q in %s: not under %s", value, origin, strings.Join(deviceRoots, ", "))
+}
+
+// getDeviceLabel looks up the value of the name.<device> label for devicePath. A label keyed by a
+// directory applies to every device below it, with the longest matching path winning, so
+// dvd.ttl./dev/dri/card0 overrides dvd.ttl./dev/dri.
+func getDeviceLabel(labels map[string]string, name string, devicePath string) (string, string, bool) {
+	prefix := labelKey(name) + "."
+
+	var matchKey, matchValue, matchPath string
+
+	for key, value := range labels {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		labelPath, err := normalizeDevicePath(key, strings.TrimPrefix(key, prefix))
+
+		if err != nil || !isPathWithin(devicePath, labelPath) {
+			continue
+		}
+
+		// Equally long matches, e.g. /dev/dri and /dev/dri/, are broken by key to stay deterministic.
+		if len(labelPath) > len(matchPath) || (len(labelPath) == len(matchPath) && key < matchKey) {
+			matchKey, matchValue, matchPath = key, value, labelPath
+		}
+	}
+
+	return matchKey, matchValue, matchKey != ""
+}
+
+// isPathWithin reports whether devicePath is root or lies below it.
+func isPathWithin(devicePath string, root string) bool {
+	return devicePath == root || strings.HasPrefix(devicePath, strings.TrimSuffix(root, "/")+"/")
+}
+
+// getDeviceAccess returns the access granted to devicePath, rwm unless an access.<device> label
+// narrows it for the device or a directory above it.
+func getDeviceAccess(labels map[string]string, devicePath string) (string, error) {
+	key, value, ok := getDeviceLabel(labels, "access", devicePath)
+
+	if !ok {
+		return "rwm", nil
+	}
+
+	if err := validateAccess(value); err != nil {
+		return "", fmt.Errorf("invalid %s label: %v", key, err)
+	}
+
+	return value, nil
+}
+
+// validateDeviceLabels reports the device keyed labels of a container whose device path is invalid,
+// and the invalid device patterns of its allow and deny labels.
+func validateDeviceLabels(labels map[string]string) {
+	for _, key := range []string{labelKey("devices", "allow"), labelKey("devices", "deny")} {
+		if err := validateDevicePatterns("label "+key, strings.Split(labels[key], ",")); err != nil {
+			log.Println(err)
+		}
+	}
+
+	for _, name := range deviceLabelNames {
+		prefix := labelKey(name) + "."
+
+		for key := range labels {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			if _, err := normalizeDevicePath("label "+key, strings.TrimPrefix(key, prefix)); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
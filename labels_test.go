@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func FuzzNormalizeDevicePath(f *testing.F) {
+	for _, seed := range []string{"/dev/ttyUSB0", "/dev/", "/dev//dri/./card0", "/dev/../etc/passwd", "/devices", "dev/null", "/dev\\null", "/", "/dev/bus/usb/.."} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		normalized, err := normalizeDevicePath("the fuzzer", value)
+
+		if err != nil {
+			return
+		}
+
+		if normalized != path.Clean(normalized) || !isPathWithin(normalized, "/dev") {
+			t.Fatalf("%q normalized to %q, outside of /dev", value, normalized)
+		}
+
+		if strings.Contains(value+"/", "/../") {
+			t.Fatalf("%q normalized to %q despite the traversal", value, normalized)
+		}
+
+		// A normalized path is normalized already.
+		if again, err := normalizeDevicePath("the fuzzer", normalized); err != nil || again != normalized {
+			t.Fatalf("%q normalized to %q, which normalizes to %q (%v)", value, normalized, again, err)
+		}
+	})
+}
+
+func TestLabelsUnderPluginID(t *testing.T) {
+	previousID, previousOptIn := pluginId, optIn
+	pluginId, optIn = "gpu", true
+	t.Cleanup(func() { pluginId, optIn = previousID, previousOptIn })
+
+	labels := map[string]string{
+		"gpu.enable":             "true",
+		"gpu.devices.allow":      "/dev/null",
+		"gpu.access./dev/null":   "r",
+		"dvd.devices.allow":      "/dev/full",
+		"dvd.devices.deny":       "/dev/null",
+		"dvd.access./dev/random": "r",
+	}
+
+	if !isEnabled(labels) {
+		t.Errorf("%s=true does not opt the container in", labelKey("enable"))
+	}
+
+	if isEnabled(map[string]string{"dvd.enable": "true"}) {
+		t.Error("a label of another plugin ID opts the container in")
+	}
+
+	// Only the labels of the configured plugin ID are read, those of another instance are left to it.
+	effective := effectiveDevices(t, testContainer(nil, labels))
+
+	if len(effective) != 1 || !effective["/dev/null"] {
+		t.Errorf("applied %v, want only an allow of /dev/null", effective)
+	}
+
+	for devicePath, want := range map[string]string{"/dev/null": "r", "/dev/random": "rwm"} {
+		if access, err := getDeviceAccess(labels, devicePath); err != nil || access != want {
+			t.Errorf("%s: access = %q (%v), want %q", devicePath, access, err, want)
+		}
+	}
+}
+
+func TestDeviceLabelLongestPrefix(t *testing.T) {
+	labels := map[string]string{
+		"dvd.access./dev/dri":         "rw",
+		"dvd.access./dev/dri/":        "m",
+		"dvd.access./dev/dri/card0":   "r",
+		"dvd.access./dev/ttyUSB0":     "rw",
+		"dvd.access./dev/../dev/full": "m",
+		"dvd.ttl./dev/dri/card0":      "1m",
+	}
+
+	for devicePath, want := range map[string]string{
+		"/dev/dri/card0":      "r",
+		"/dev/dri/card1":      "rw",
+		"/dev/dri/by-path/x":  "rw",
+		"/dev/drivers/card0":  "rwm",
+		"/dev/ttyUSB0":        "rw",
+		"/dev/ttyUSB01":       "rwm",
+		"/dev/full":           "rwm",
+		"/dev/dri/renderD128": "rw",
+	} {
+		if access, err := getDeviceAccess(labels, devicePath); err != nil || access != want {
+			t.Errorf("%s: access = %q (%v), want %q", devicePath, access, err, want)
+		}
+	}
+
+	// Each device tree mounted into one container gets the access of its own label.
+	info := testContainer(nil, map[string]string{"dvd.access./dev/null": "rw", "dvd.access./dev": "r"}, deviceMount("/dev/null"), deviceMount("/dev/full"))
+	target := deviceTarget{id: info.ID, labels: info.Config.Labels, summary: &processSummary{id: info.ID}}
+	access := make(map[string]string)
+
+	for _, request := range getEffectiveRequests(target, getContainerDeviceSources(info, target.summary)) {
+		access[request.path] = request.rule.Access
+	}
+
+	if access["/dev/null"] != "rw" || access["/dev/full"] != "r" {
+		t.Errorf("granted %v, want rw to /dev/null and r to /dev/full", access)
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lateDevices queues the requested devices that did not exist yet, keyed by container and device path,
+// so the reconcile loop keeps retrying their containers until the devices appear.
+var lateDevices = struct {
+	sync.Mutex
+	pending map[string]map[string]time.Time
+}{pending: make(map[string]map[string]time.Time)}
+
+// queueLateDevice records that a container requested a device that does not exist yet.
+func queueLateDevice(id string, devicePath string) {
+	lateDevices.Lock()
+	defer lateDevices.Unlock()
+
+	if _, ok := lateDevices.pending[id]; !ok {
+		lateDevices.pending[id] = make(map[string]time.Time)
+	}
+
+	if _, ok := lateDevices.pending[id][devicePath]; !ok {
+		log.Printf("%s does not exist yet, retrying it for %s until it appears\n", devicePath, id)
+		lateDevices.pending[id][devicePath] = time.Now()
+	}
+}
+
+// dropLateDevice removes a device from the queue once it exists.
+func dropLateDevice(id string, devicePath string) {
+	lateDevices.Lock()
+	defer lateDevices.Unlock()
+
+	if since, ok := lateDevices.pending[id][devicePath]; ok {
+		log.Printf("%s appeared after %v, granting it to %s\n", devicePath, time.Since(since).Round(time.Second), id)
+		delete(lateDevices.pending[id], devicePath)
+	}
+
+	if len(lateDevices.pending[id]) == 0 {
+		delete(lateDevices.pending, id)
+	}
+}
+
+// forgetLateDevices empties the queue of a container that is gone.
+func forgetLateDevices(id string) {
+	lateDevices.Lock()
+	defer lateDevices.Unlock()
+
+	delete(lateDevices.pending, id)
+}
+
+// lateDeviceContainers returns the containers that still wait for a device.
+func lateDeviceContainers() []string {
+	lateDevices.Lock()
+	defer lateDevices.Unlock()
+
+	ids := make([]string, 0, len(lateDevices.pending))
+
+	for id := range lateDevices.pending {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
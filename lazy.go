@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// appearedDevices records, by container, the paths created in the directories watched for it, so a
+// container mounting its directories lazily is only granted the nodes that appeared since.
+var appearedDevices = struct {
+	sync.Mutex
+	paths map[string]map[string]bool
+}{paths: make(map[string]map[string]bool)}
+
+// isLazyDirectories reports whether a container asked, with dvd.dir-strategy=lazy, for its mounted
+// directories to be granted only as nodes appear in them rather than eagerly as it starts.
+func isLazyDirectories(labels map[string]string) bool {
+	key := labelKey("dir-strategy")
+
+	switch value := labels[key]; value {
+	case "lazy":
+		return true
+	case "", "eager":
+		return false
+	default:
+		log.Printf("ignoring invalid %s label %q, expected eager or lazy\n", key, value)
+		return false
+	}
+}
+
+// isLazyDirectory reports whether the nodes below the directory devicePath are only granted to the
+// target once they appear, as it is a directory watched for a container mounting it lazily.
+func isLazyDirectory(target deviceTarget, devicePath string) bool {
+	if !isLazyDirectories(target.labels) {
+		return false
+	}
+
+	deviceWatcher.Lock()
+	defer deviceWatcher.Unlock()
+
+	return deviceWatcher.roots[filepath.Clean(devicePath)][target.id]
+}
+
+// recordAppearedDevice records that path was created in a directory watched for a container.
+func recordAppearedDevice(id string, path string) {
+	appearedDevices.Lock()
+	defer appearedDevices.Unlock()
+
+	if appearedDevices.paths[id] == nil {
+		appearedDevices.paths[id] = make(map[string]bool)
+	}
+
+	appearedDevices.paths[id][path] = true
+}
+
+// getAppearedPaths returns those of paths that appeared for a container, or lie below a directory
+// that did.
+func getAppearedPaths(id string, paths []string) []string {
+	appearedDevices.Lock()
+	defer appearedDevices.Unlock()
+
+	var appeared []string
+
+	for _, path := range paths {
+		for created := range appearedDevices.paths[id] {
+			if isPathWithin(path, created) {
+				appeared = append(appeared, path)
+				break
+			}
+		}
+	}
+
+	return appeared
+}
+
+// forgetAppearedDevices drops what appeared for a container that is gone.
+func forgetAppearedDevices(id string) {
+	appearedDevices.Lock()
+	defer appearedDevices.Unlock()
+
+	delete(appearedDevices.paths, id)
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLazyDirectories(t *testing.T) {
+	lazy, eager := newTestTask(t), newTestTask(t)
+
+	for _, task := range []testTask{lazy, eager} {
+		if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.deny"), []byte("a"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := newDeviceRoot(t)
+
+	mknod := func(name string, minor uint32) {
+		if err := unix.Mknod(filepath.Join(root, name), unix.S_IFCHR|0600, int(unix.Mkdev(benchmarkMajor, minor))); err != nil {
+			t.Skipf("unable to create device nodes: %v", err)
+		}
+	}
+
+	mknod("existing", 1)
+
+	lazyInfo := runningContainer(containerID(161), lazy, map[string]string{"dvd.dir-strategy": "lazy"}, deviceMount(root))
+	eagerInfo := runningContainer(containerID(162), eager, map[string]string{"dvd.dir-strategy": "eager"}, deviceMount(root))
+	_, cli := newTestDocker(t, lazyInfo, eagerInfo)
+
+	for _, id := range []string{lazyInfo.ID, eagerInfo.ID} {
+		id := id
+		resetTracking(t, id)
+		t.Cleanup(func() {
+			unwatchContainerDevices(id)
+			forgetAppearedDevices(id)
+		})
+
+		if err := processContainer(cli, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// waitForList waits for the reader of the watches to grant what appeared.
+	waitForList := func(task testTask, want ...string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			entries := task.devicesList(t)
+			sort.Strings(entries)
+
+			if reflect.DeepEqual(entries, want) {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("%s lists %v, want %v", task.cgroupPath, entries, want)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitForList(lazy)
+	waitForList(eager, "c 240:1 rwm")
+
+	// Nodes created afterwards are granted, those in a new directory too.
+	mknod("created", 2)
+	waitForList(lazy, "c 240:2 rwm")
+
+	if err := os.Mkdir(filepath.Join(root, "bus"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mknod("bus/node", 3)
+	waitForList(lazy, "c 240:2 rwm", "c 240:3 rwm")
+
+	// A later pass, e.g. the reconcile loop, still leaves out what existed before.
+	if err := processContainer(cli, lazyInfo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForList(lazy, "c 240:2 rwm", "c 240:3 rwm")
+}
+
+func TestIsLazyDirectories(t *testing.T) {
+	for value, want := range map[string]bool{"lazy": true, "eager": false, "": false, "LAZY": false, "later": false} {
+		if lazy := isLazyDirectories(map[string]string{"dvd.dir-strategy": value}); lazy != want {
+			t.Errorf("%q: lazy = %v, want %v", value, lazy, want)
+		}
+	}
+}
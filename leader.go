@@ -0,0 +1,50 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// leaderLock holds the lock on DVD_LEADER_LOCK for as long as the daemon runs; the kernel releases it
+// when the process dies, which lets a standby take over.
+var leaderLock *os.File
+
+// acquireLeadership blocks until this instance holds the lock on leaderLockPath, so of several
+// instances sharing it only one applies rules while the others wait, already set up, to take over.
+func acquireLeadership() error {
+	file, err := os.OpenFile(leaderLockPath, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return fmt.Errorf("unable to open the leader lock: %v", err)
+	}
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+
+	if err == unix.EWOULDBLOCK {
+		holder, _ := os.ReadFile(leaderLockPath)
+		log.Printf("Standing by, another instance (pid %s) holds %s\n", holder, leaderLockPath)
+
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+	}
+
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to lock %s: %v", leaderLockPath, err)
+	}
+
+	// The pid is only informational, for the log of a standby.
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+
+	leaderLock = file
+
+	log.Printf("Leading, holding %s\n", leaderLockPath)
+	return nil
+}
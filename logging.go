@@ -0,0 +1,229 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/journal"
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogging routes the daemon's log output according to logFormat.
+func setupLogging() {
+	switch logFormat {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+		log.SetFlags(0)
+		log.SetOutput(logrus.StandardLogger().Writer())
+	default:
+		log.Printf("ignoring unknown DVD_LOG_FORMAT %q, expected text or json\n", logFormat)
+	}
+
+	switch logDest {
+	case "stderr":
+	case "journald":
+		if !journal.Enabled() {
+			log.Printf("the systemd journal is not available, is /run/systemd/journal mounted? Logging to stderr\n")
+			break
+		}
+
+		logrus.AddHook(journalHook{})
+		logrus.SetOutput(io.Discard)
+		log.SetFlags(0)
+		log.SetOutput(stdLogWriter{})
+	default:
+		log.Printf("ignoring unknown DVD_LOG_DEST %q, expected stderr or journald\n", logDest)
+	}
+}
+
+// journalPriorities maps log levels to the priorities of the systemd journal.
+var journalPriorities = map[logrus.Level]journal.Priority{
+	logrus.PanicLevel: journal.PriCrit,
+	logrus.FatalLevel: journal.PriCrit,
+	logrus.ErrorLevel: journal.PriErr,
+	logrus.WarnLevel:  journal.PriWarning,
+	logrus.InfoLevel:  journal.PriInfo,
+	logrus.DebugLevel: journal.PriDebug,
+	logrus.TraceLevel: journal.PriDebug,
+}
+
+// journalHook sends every log entry to the systemd journal, with its fields as journal variables.
+type journalHook struct{}
+
+func (journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (journalHook) Fire(entry *logrus.Entry) error {
+	vars := make(map[string]string, len(entry.Data))
+
+	// Journal variable names may only hold upper case letters, digits and underscores.
+	for key, value := range entry.Data {
+		name := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' {
+				return r - 'a' + 'A'
+			} else if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, key)
+
+		vars[strings.TrimLeft(name, "_")] = fmt.Sprint(value)
+	}
+
+	return journal.Send(entry.Message, journalPriorities[entry.Level], vars)
+}
+
+// stdLogWriter passes the output of the standard logger on to logrus, treating lines that start
+// with WARNING as warnings, those that start with ERROR as errors and everything else as informational.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+
+	if strings.HasPrefix(message, "WARNING") {
+		logrus.Warn(message)
+	} else if strings.HasPrefix(message, "ERROR") {
+		logrus.Error(message)
+	} else {
+		logrus.Info(message)
+	}
+
+	return len(p), nil
+}
+
+// processSummary accumulates the outcome of processing a single container.
+type processSummary struct {
+	id      string
+	version int
+	applied int
+	skipped int
+	errors  int
+	start   time.Time
+
+	// devices and failures keep the outcome of every device and every error for the reprocess command.
+	devices  []deviceResult
+	failures []string
+}
+
+// deviceResult is the outcome of applying the rules for a single device: applied, unchanged when
+// they were already in effect, skipped or failed.
+type deviceResult struct {
+	Path   string `json:"path"`
+	Rule   string `json:"rule,omitempty"`
+	Result string `json:"result"`
+	Reason string `json:"reason,omitempty"`
+
+	denied bool
+}
+
+// processReport is the outcome of processing a container as returned over the control socket.
+type processReport struct {
+	ID      string         `json:"id"`
+	Version int            `json:"version"`
+	Applied int            `json:"applied"`
+	Skipped int            `json:"skipped"`
+	Errors  []string       `json:"errors,omitempty"`
+	Devices []deviceResult `json:"devices"`
+}
+
+// count records the result of applying the rules for a single device.
+func (s *processSummary) count(err error) {
+	if err == errNotDevice {
+		s.skipped++
+	} else if err != nil {
+		s.fail(err)
+	}
+}
+
+// record counts the result of applying the rules for request and keeps it for reporting.
+func (s *processSummary) record(request deviceRequest, applied bool, err error) {
+	s.count(err)
+
+	result := deviceResult{Path: request.path, Rule: ruleKey(request.rule), Result: "unchanged", denied: !request.rule.Allow}
+
+	switch {
+	case err == errNotDevice:
+		result.Result, result.Reason = "skipped", "not a device"
+	case err != nil:
+		result.Result, result.Reason = "failed", err.Error()
+	case applied:
+		result.Result = "applied"
+	case tracker.isExpired(s.id, request.path):
+		result.Result, result.Reason = "skipped", "its TTL expired"
+	}
+
+	s.devices = append(s.devices, result)
+}
+
+// skip records a requested path that was skipped before any rule was built for it.
+func (s *processSummary) skip(devicePath string, reason string) {
+	s.skipped++
+	s.devices = append(s.devices, deviceResult{Path: devicePath, Result: "skipped", Reason: reason})
+}
+
+// report returns the outcome of processing the container.
+func (s *processSummary) report() processReport {
+	devices := s.devices
+
+	if devices == nil {
+		devices = []deviceResult{}
+	}
+
+	return processReport{
+		ID:      s.id,
+		Version: s.version,
+		Applied: s.applied,
+		Skipped: s.skipped,
+		Errors:  s.failures,
+		Devices: devices,
+	}
+}
+
+// fail records an error that kept a device, or the whole container, from being processed.
+func (s *processSummary) fail(err error) {
+	log.Println(err)
+	s.errors++
+	s.failures = append(s.failures, err.Error())
+	tracker.recordError(s.id, err)
+}
+
+func (s *processSummary) log() {
+	version := "unknown"
+
+	if s.version > 0 {
+		version = fmt.Sprintf("v%d", s.version)
+	}
+
+	id := s.id
+
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	elapsed := time.Since(s.start).Round(time.Millisecond)
+	message := fmt.Sprintf(
+		"container %s: applied %d rules, skipped %d non-devices, %d errors, cgroup %s, %v",
+		id, s.applied, s.skipped, s.errors, version, elapsed,
+	)
+
+	if logFormat != "json" {
+		log.Println(message)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container":  s.id,
+		"applied":    s.applied,
+		"skipped":    s.skipped,
+		"errors":     s.errors,
+		"cgroup":     version,
+		"durationMs": elapsed.Milliseconds(),
+	}).Info(message)
+}
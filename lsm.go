@@ -0,0 +1,149 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// probeCGroupWrites writes a device rule to an empty cgroup created below the daemon's own, so a
+// security module or seccomp profile that blocks cgroup writes is found at startup rather than as
+// an unexplained EACCES or EPERM on the first container. The cgroup has no tasks, so the rule
+// affects nothing, and it is removed again right away.
+func probeCGroupWrites() {
+	version, err := cgroup.GetDeviceCGroupVersion("/", os.Getpid())
+
+	if err != nil {
+		return
+	}
+
+	api, err := cgroup.New(version)
+
+	if err != nil {
+		return
+	}
+
+	ownPath := getHostCGroupPath(api, version, os.Getpid())
+
+	if ownPath == "" {
+		log.Printf("Skipping the cgroup write probe: the daemon's own cgroup is not found below %s\n", rootPath)
+		return
+	}
+
+	probePath := path.Join(ownPath, fmt.Sprintf("dvd-probe-%d", os.Getpid()))
+
+	err = os.Mkdir(probePath, 0755)
+
+	if err == nil {
+		defer os.Remove(probePath)
+		err = api.AddDeviceRules(probePath, []cgroup.DeviceRule{denyAllRule})
+	}
+
+	if err == nil {
+		log.Printf("Cgroup device rules can be written\n")
+		return
+	}
+
+	log.Printf("WARNING: unable to write a device rule to the probe cgroup %s: %v\n", probePath, err)
+
+	if !isPermissionError(err) {
+		return
+	}
+
+	for _, hint := range getLSMHints() {
+		log.Printf("WARNING: %s\n", hint)
+	}
+}
+
+// isPermissionError reports whether err is an EACCES or EPERM, which the cgroup package may wrap
+// as text only.
+func isPermissionError(err error) bool {
+	message := err.Error()
+	return errors.Is(err, os.ErrPermission) || strings.Contains(message, "permission denied") || strings.Contains(message, "operation not permitted")
+}
+
+// getLSMHints inspects the security modules and seccomp filter confining the daemon and returns what
+// likely blocks its cgroup writes, with how to lift it.
+func getLSMHints() []string {
+	var hints []string
+
+	if !hasCapability(21) {
+		hints = append(hints, "the daemon lacks CAP_SYS_ADMIN, run it with --privileged")
+	}
+
+	if modules, err := os.ReadFile("/sys/kernel/security/lsm"); err == nil {
+		hints = append(hints, fmt.Sprintf("active security modules: %s", strings.TrimSpace(string(modules))))
+	}
+
+	// Kernels with stacked modules keep the AppArmor label apart from the generic one.
+	profile := readAttr("/proc/self/attr/apparmor/current")
+
+	if profile == "" && isAppArmorEnabled() {
+		profile = readAttr("/proc/self/attr/current")
+	}
+
+	if profile != "" && profile != "unconfined" {
+		hints = append(hints, fmt.Sprintf("AppArmor confines the daemon with the profile %q, run it with --security-opt apparmor=unconfined or allow writes below /sys/fs/cgroup in the profile", profile))
+	}
+
+	if enforce, err := os.ReadFile("/sys/fs/selinux/enforce"); err == nil && strings.TrimSpace(string(enforce)) == "1" {
+		hints = append(hints, fmt.Sprintf("SELinux is enforcing with the context %q, run the daemon with --security-opt label=disable or a type allowed to write cgroupfs, and check the audit log for AVC denials", readAttr("/proc/self/attr/current")))
+	}
+
+	if getStatusField("Seccomp") == "2" {
+		hints = append(hints, "a seccomp filter is active, which may block bpf(2) on cgroup v2, run the daemon with --security-opt seccomp=unconfined")
+	}
+
+	if len(hints) == 0 {
+		hints = append(hints, "no security module confining the daemon was found, check the host's audit log")
+	}
+
+	return hints
+}
+
+// readAttr reads an LSM attribute of the daemon's process, e.g. its AppArmor profile or SELinux context.
+func readAttr(attrPath string) string {
+	content, err := os.ReadFile(attrPath)
+
+	if err != nil {
+		return ""
+	}
+
+	// AppArmor appends the mode, e.g. "docker-default (enforce)".
+	return strings.TrimSuffix(strings.TrimRight(string(content), "\x00\n"), " (enforce)")
+}
+
+func isAppArmorEnabled() bool {
+	content, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(content)) == "Y"
+}
+
+// getStatusField returns a field of /proc/self/status, e.g. Seccomp.
+func getStatusField(name string) string {
+	content, err := os.ReadFile("/proc/self/status")
+
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if key, value, found := strings.Cut(line, ":"); found && key == name {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+// hasCapability reports whether the daemon's effective capabilities include the capability numbered bit.
+func hasCapability(bit uint) bool {
+	effective, err := strconv.ParseUint(getStatusField("CapEff"), 16, 64)
+	return err == nil && effective&(1<<bit) != 0
+}
@@ -7,29 +7,76 @@ import "C"
 import (
 	"context"
 	"device-volume-driver/internal/cgroup"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	_ "github.com/opencontainers/runtime-spec/specs-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sys/unix"
 )
 
-const pluginId = "dvd"
-const rootPath = "/host"
+var errNotDevice = errors.New("unsupported device type... aborting")
+
+// deviceTarget is the container cgroup that device rules are applied to.
+type deviceTarget struct {
+	ctx        context.Context
+	id         string
+	pid        int
+	api        cgroup.Interface
+	cgroupPath string
+	labels     map[string]string
+	user       containerUser
+	summary    *processSummary
+}
+
+// deviceRequest is a device node along with the rule to apply for it.
+type deviceRequest struct {
+	path string
+	rule cgroup.DeviceRule
+}
 
 func Ptr[T any](v T) *T {
 	return &v
 }
 
 func main() {
-	log.Printf("Starting\n")
+	setupLogging()
+	validateConfig()
+	loadConfigFile()
+
+	build := getBuildInfo()
+	log.Printf("Starting version %s, commit %s, built %s with %s\n", build.Version, build.Commit, build.BuildDate, build.GoVersion)
+
+	if runMode == "oci-hook" {
+		if err := runOCIHook(os.Stdin); err != nil {
+			log.Printf("OCI hook failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if runMode == "cleanup" {
+		if err := runCleanup(); err != nil {
+			log.Fatalf("Cleanup failed: %v\n", err)
+		}
+
+		return
+	}
 
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 
@@ -39,14 +86,125 @@ func main() {
 
 	defer cli.Close()
 
-	checkExistingContainers(cli)
-	listenForMounts(cli)
+	if strictMode {
+		if err := checkStrictSetup(cli); err != nil {
+			log.Fatalf("DVD_STRICT is set, refusing to run: %v\n", err)
+		}
+	}
+
+	if targetContainer != "" {
+		if err := processContainer(cli, targetContainer); err != nil {
+			log.Printf("Processing %s failed: %v\n", targetContainer, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	handleShutdown()
+	checkDeviceController()
+
+	if probeWrites {
+		probeCGroupWrites()
+	}
+
+	subscribeAuditLog()
+	subscribeMetrics()
+	setupTracing()
+	startPostApplyHook()
+
+	if leaderLockPath != "" {
+		if err := acquireLeadership(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	restoreState()
+
+	go listenForControl(cli)
+	go serveHTTP()
+	go listenForReloads(cli)
+	go reconcileContainers(cli)
+
+	if startupDelay > 0 {
+		log.Printf("Waiting %v for containers to settle before the initial scan\n", startupDelay)
+		time.Sleep(startupDelay)
+	}
+
+	// Subscribing first closes the gap between the scan and the subscription: a container starting
+	// while the scan runs is reported by the events, which dockerd replays from when the scan began.
+	since := time.Now()
+	msgs, errs := subscribeEvents(cli, since)
+
+	checkExistingContainers(cli, false)
+	listenForMounts(cli, since, msgs, errs)
+}
+
+// checkDeviceController logs whether the host's cgroups can enforce device rules at all, since without a
+// devices controller every rule the daemon writes is silently meaningless.
+func checkDeviceController() {
+	version, err := cgroup.GetDeviceCGroupVersion("/", os.Getpid())
+
+	if err != nil {
+		log.Printf("WARNING: unable to determine the cgroup version to check for device control: %v\n", err)
+		return
+	}
+
+	api, err := cgroup.New(version)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	available, err := api.DeviceControllerAvailable()
+
+	switch {
+	case err != nil:
+		log.Printf("WARNING: unable to check whether the cgroup v%d device controller is available: %v\n", version, err)
+	case !available:
+		log.Printf("WARNING: the cgroup v%d device controller is not available, device rules will have no effect\n", version)
+	default:
+		log.Printf("The cgroup v%d device controller is available\n", version)
+	}
 }
 
+// getDeviceInfo returns the type and major:minor numbers of the device node at devicePath, during a
+// reload pass as the pass already found them.
 func getDeviceInfo(devicePath string) (string, int64, int64, error) {
+	if device, ok := scanCache.device(devicePath); ok {
+		return device.deviceType, device.major, device.minor, device.err
+	}
+
+	deviceType, major, minor, err := statDeviceInfo(devicePath)
+	scanCache.storeDevice(devicePath, cachedDevice{deviceType, major, minor, err})
+
+	return deviceType, major, minor, err
+}
+
+// statDeviceInfo returns the type and major:minor numbers of the device node at devicePath. They are
+// read from an fd of the resolved node rather than through a second path lookup, so the node cannot
+// be swapped for a symlink to another device between resolving and inspecting it.
+func statDeviceInfo(devicePath string) (string, int64, int64, error) {
 	var stat unix.Stat_t
 
-	if err := unix.Stat(devicePath, &stat); err != nil {
+	resolvedPath, err := resolveDevicePath(devicePath)
+
+	if err != nil {
+		log.Println(err)
+		return "", -1, -1, err
+	}
+
+	fd, err := openDeviceNode(resolvedPath)
+
+	if err != nil {
+		log.Println(err)
+		return "", -1, -1, err
+	}
+
+	defer unix.Close(fd)
+
+	if err := unix.Fstat(fd, &stat); err != nil {
 		log.Println(err)
 		return "", -1, -1, err
 	}
@@ -59,8 +217,7 @@ func getDeviceInfo(devicePath string) (string, int64, int64, error) {
 	case unix.S_IFCHR:
 		deviceType = "c"
 	default:
-		log.Println("aborting: device is neither a character or block device")
-		return "", -1, -1, fmt.Errorf("unsupported device type... aborting")
+		return "", -1, -1, errNotDevice
 	}
 
 	major := int64(unix.Major(stat.Rdev))
@@ -71,128 +228,1082 @@ func getDeviceInfo(devicePath string) (string, int64, int64, error) {
 	return deviceType, major, minor, nil
 }
 
-func listenForMounts(cli *client.Client) {
-	msgs, errs := cli.Events(
-		context.Background(),
-		types.EventsOptions{Filters: filters.NewArgs(filters.Arg("event", "start"))},
+// resolveDevicePath resolves the symlinks of devicePath, e.g. /dev/disk/by-id/... to /dev/sdb, and
+// makes sure the node it points to is still within deviceRoots. The host's /dev is used when mounted
+// below rootPath, as the daemon's own /dev lacks the links udev creates on the host.
+func resolveDevicePath(devicePath string) (string, error) {
+	var resolvedPath, prefix string
+	var err error
+
+	if _, err := os.Lstat(path.Join(rootPath, devicePath)); err == nil {
+		resolvedPath, err = resolveHostPath(path.Join(rootPath, devicePath))
+		prefix = rootPath
+	} else {
+		resolvedPath, err = filepath.EvalSymlinks(devicePath)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	devicePath = path.Clean(devicePath)
+	relativePath := path.Join("/", strings.TrimPrefix(resolvedPath, prefix))
+
+	if relativePath == devicePath {
+		return resolvedPath, nil
+	}
+
+	for _, root := range deviceRoots {
+		if isPathWithin(relativePath, root) {
+			log.Printf("%s resolves to %s\n", devicePath, relativePath)
+			return resolvedPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s resolves to %s, outside of %s", devicePath, relativePath, strings.Join(deviceRoots, ", "))
+}
+
+// openDeviceNode opens an O_PATH fd to a resolved device node without following any symlink along the
+// way, falling back to only refusing a final symlink on kernels without openat2.
+func openDeviceNode(resolvedPath string) (int, error) {
+	fd, err := unix.Openat2(unix.AT_FDCWD, resolvedPath, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS,
+	})
+
+	if err == unix.ENOSYS {
+		fd, err = unix.Open(resolvedPath, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	}
+
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: resolvedPath, Err: err}
+	}
+
+	return fd, nil
+}
+
+// eventQueueSize is how many events are buffered while the initial scan runs, as many as dockerd keeps.
+const eventQueueSize = 1024
+
+// subscribeEvents subscribes to the container and network events handled by listenForMounts, starting
+// at since, and buffers them until they are consumed. The error ending the subscription is reported
+// on the returned error channel.
+func subscribeEvents(cli *client.Client, since time.Time) (<-chan events.Message, <-chan error) {
+	eventFilters := filters.NewArgs(
+		filters.Arg("event", "start"),
+		filters.Arg("event", "exec_start"),
+		filters.Arg("event", "die"),
+		filters.Arg("event", "destroy"),
+		filters.Arg("event", "connect"),
 	)
 
+	if applyOnCreate {
+		eventFilters.Add("event", "create")
+	}
+
+	// Since is given to the nanosecond, as dockerd would otherwise replay every event of its second.
+	options := types.EventsOptions{Filters: eventFilters, Since: fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())}
+	msgs, errs := cli.Events(context.Background(), options)
+
+	queue := make(chan events.Message, eventQueueSize)
+	failed := make(chan error, 1)
+
+	go func() {
+		for {
+			select {
+			case msg := <-msgs:
+				queue <- msg
+			case err := <-errs:
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	return queue, failed
+}
+
+// maxEventsBackoff caps the delay between attempts to resubscribe to the events of dockerd.
+const maxEventsBackoff = 30 * time.Second
+
+// listenForMounts handles the events of a subscription starting at since. When the subscription ends,
+// e.g. as dockerd restarts, it waits with an exponential backoff for dockerd to answer again, then
+// resubscribes from the last event handled and rescans the running containers, as a restarted dockerd
+// no longer has the events that happened in between.
+func listenForMounts(cli *client.Client, since time.Time, msgs <-chan events.Message, errs <-chan error) {
+	delay := time.Second
+
 	for {
 		select {
 		case err := <-errs:
-			log.Fatal(err)
+			log.Printf("ERROR: lost the event stream of dockerd: %v\n", err)
+
+			for {
+				log.Printf("Resubscribing to the events of dockerd in %v\n", delay)
+				time.Sleep(delay)
+
+				if delay *= 2; delay > maxEventsBackoff {
+					delay = maxEventsBackoff
+				}
+
+				if _, err := cli.Ping(context.Background()); err != nil {
+					log.Printf("dockerd is not answering yet: %v\n", err)
+					continue
+				}
+
+				break
+			}
+
+			msgs, errs = subscribeEvents(cli, since)
+			checkExistingContainers(cli, false)
 		case msg := <-msgs:
+			// dockerd replays the events at since too, so resubscribing starts just after this one.
+			since, delay = time.Unix(0, msg.TimeNano+1), time.Second
+
+			// A container joining a network may now match a network policy.
+			if msg.Type == events.NetworkEventType {
+				if msg.Action == "connect" && len(config.Networks) > 0 {
+					log.Printf("%s connected to network %s, reprocessing its devices\n", msg.Actor.Attributes["container"], msg.Actor.Attributes["name"])
+					processContainer(cli, msg.Actor.Attributes["container"])
+				}
+
+				continue
+			}
+
+			// Only removing the container lifts its quarantine; it outlasts restarts.
+			if msg.Action == "destroy" {
+				tracker.unquarantine(msg.Actor.ID)
+			}
+
+			if msg.Action == "die" || msg.Action == "destroy" {
+				forgetContainer(msg.Actor.ID)
+				continue
+			}
+
+			// The action of an exec event carries the command, e.g. "exec_start: sh -c ...".
+			if strings.HasPrefix(msg.Action, "exec_start") {
+				log.Printf("%s started an exec, reprocessing its devices\n", msg.Actor.ID)
+			}
+
 			processContainer(cli, msg.Actor.ID)
 		}
 	}
 }
 
-func processContainer(cli *client.Client, id string) {
-	info, err := cli.ContainerInspect(context.Background(), id)
+func processContainer(cli *client.Client, id string) error {
+	return processContainerInto(cli, id, &processSummary{})
+}
+
+// processContainerInto processes a container, accumulating the outcome of every device in summary.
+func processContainerInto(cli *client.Client, id string, summary *processSummary) (result error) {
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	// Pausing grants leaves quarantines enforced, as they only deny.
+	if grantsPaused.Load() && tracker.quarantineOf(id) == nil {
+		log.Printf("Grants are paused by revoke-all, not processing %s\n", id)
+		return nil
+	}
+
+	defer saveState()
+
+	ctx, span := tracer.Start(shutdownCtx, "processContainer", trace.WithAttributes(attribute.String("container.id", id)))
+	defer span.End()
+
+	_, inspectSpan := tracer.Start(ctx, "inspect")
+	info, err := cli.ContainerInspect(ctx, id)
+	endSpan(inspectSpan, err)
 
 	if err != nil {
-		panic(err)
+		// The container may have been removed since its event, which is no reason to stop the daemon.
+		log.Printf("unable to inspect %s... skipping: %v\n", id, err)
+		return err
 	} else {
+		id = info.ID
 		pid := info.State.Pid
-		version, err := cgroup.GetDeviceCGroupVersion("/", pid)
 
-		log.Printf("The cgroup version for process %d is: %v\n", pid, version)
+		// A container that was only created has no task, and so no cgroup, yet; the
+		// start event processes it again once it does.
+		if pid == 0 {
+			log.Printf("%s has no running process yet... skipping\n", id)
+			return fmt.Errorf("%s has no running process", id)
+		}
+
+		var labels map[string]string
+
+		if info.Config != nil {
+			labels = info.Config.Labels
+		}
+
+		// Opting in decides what the daemon grants, not whether an operator's quarantine applies.
+		if !isEnabled(labels) && tracker.quarantineOf(id) == nil {
+			log.Printf("%s did not opt in with %s=true... skipping\n", id, labelKey("enable"))
+			return nil
+		}
+
+		summary.id, summary.version, summary.start = id, -1, time.Now()
+		defer summary.log()
+
+		defer func() {
+			span.SetAttributes(
+				attribute.Int("cgroup.version", summary.version),
+				attribute.Int("rules.applied", summary.applied),
+				attribute.Int("rules.skipped", summary.skipped),
+				attribute.Int("errors", summary.errors),
+			)
+		}()
+
+		// Required devices are checked however the pass ends, above all when it ends early, as it
+		// does when a required device is missing and nothing else was requested.
+		defer func() {
+			if checkRequiredDevices(cli, id, labels, summary) && result == nil {
+				result = fmt.Errorf("%s is missing required devices", id)
+			}
+		}()
+
+		var version int
+		var fallbackPath string
+
+		// Without the host's PID namespace, Docker's PIDs don't resolve through /proc,
+		// so the cgroup is located from the container ID instead.
+		visible := isPidVisible(pid)
+
+		if visible {
+			version, err = cgroup.GetDeviceCGroupVersion("/", pid)
+		} else {
+			log.Printf("process %d of %s is not visible, resolving its cgroup by ID\n", pid, id)
+			version, fallbackPath, err = getContainerCGroupFromID(cli, info)
+		}
 
 		if err != nil {
-			log.Println(err)
-			return
+			summary.fail(err)
+			return err
 		}
 
+		log.Printf("The cgroup version for process %d is: %v\n", pid, version)
+
+		summary.version = version
+
 		log.Printf("Checking mounts for process %d\n", pid)
 
-		for _, mount := range info.Mounts {
-			log.Printf(
-				"%s/%v requested a volume mount for %s at %s\n",
-				id, info.State.Pid, mount.Source, mount.Destination,
-			)
+		sources := getContainerDeviceSources(info, summary)
 
-			if !strings.HasPrefix(mount.Source, "/dev") {
-				log.Printf("%s is not a device... skipping\n", mount.Source)
-				continue
+		if podAnnotation != "" {
+			sources = append(sources, getPodAnnotationSource(ctx, cli, info))
+		}
+
+		if baselineDevices != "" {
+			sources = append(sources, deviceSource{
+				layer: layerBaseline,
+				allow: getDevicePathList(id, "baseline DVD_BASELINE_DEVICES", baselineDevices),
+			})
+		}
+
+		var peers []string
+
+		if propagateNetns {
+			for _, peer := range getNetnsPeers(cli, info) {
+				log.Printf("%s shares its network namespace with %s, propagating its devices\n", id, peer.ID)
+				peers = append(peers, peer.ID)
+
+				for _, source := range getContainerDeviceSources(peer, &processSummary{}) {
+					sources = append(sources, deviceSource{layer: layerNetwork, allow: source.allow})
+				}
 			}
+		}
+
+		// A container that lost its last device mount still needs its grants for it revoked.
+		if isEmptySources(sources) && len(tracker.grants(id)) == 0 && tracker.quarantineOf(id) == nil {
+			return nil
+		}
 
-			api, err := cgroup.New(version)
-			cgroupPath, sysfsPath, err := api.GetDeviceCGroupMountPath("/", pid)
+		api, err := cgroup.New(version)
+
+		if err != nil {
+			summary.fail(err)
+			return err
+		}
+
+		cgroupPath := fallbackPath
+
+		_, resolveSpan := tracer.Start(ctx, "resolve cgroup")
+
+		if visible {
+			rootlessPath, err := getRootlessCGroupPath(api, version, pid)
 
 			if err != nil {
-				log.Println(err)
-				break
+				summary.fail(err)
+				endSpan(resolveSpan, err)
+				return err
 			}
 
-			cgroupPath = path.Join(rootPath, sysfsPath, cgroupPath)
+			cgroupPath, err = waitForCGroup(pid, func() (string, error) {
+				if rootlessPath != "" {
+					return rootlessPath, nil
+				}
+
+				if hostPath := getHostCGroupPath(api, version, pid); hostPath != "" {
+					return hostPath, nil
+				}
+
+				cgroupPath, sysfsPath, err := api.GetDeviceCGroupMountPath("/", pid)
+
+				if err != nil {
+					return "", err
+				}
 
-			log.Printf("The cgroup path for process %d is at %v\n", pid, cgroupPath)
+				// The container's mount point says nothing about where the host mounts the controller.
+				if version == 1 {
+					sysfsPath = getHostDevicesMountPoint()
+				}
+
+				// Controller mounts can be symlinks, e.g. devices -> cpu,devices on some distros.
+				return resolveHostPath(path.Join(rootPath, sysfsPath, cgroupPath))
+			})
+
+			if err != nil {
+				summary.fail(err)
+				endSpan(resolveSpan, err)
+				return err
+			}
+
+			cgroupPath = findTaskCGroup(cgroupPath, pid)
+
+			if err := checkDevicesCGroup(cgroupPath, version); err != nil {
+				summary.fail(err)
+				endSpan(resolveSpan, err)
+				return err
+			}
 
-			if fileInfo, err := os.Stat(mount.Source); err != nil {
+			if rootlessPath != "" {
+				if err := checkCGroupWritable(cgroupPath); err != nil {
+					summary.fail(err)
+					endSpan(resolveSpan, err)
+					return err
+				}
+			}
+		}
+
+		if err := checkHostCGroup(cgroupPath, version); err != nil {
+			summary.fail(err)
+			endSpan(resolveSpan, err)
+			return err
+		}
+
+		resolveSpan.SetAttributes(attribute.String("cgroup.path", cgroupPath))
+		resolveSpan.End()
+
+		log.Printf("The cgroup path for process %d is at %v\n", pid, cgroupPath)
+
+		target := deviceTarget{ctx: ctx, id: id, pid: pid, api: api, cgroupPath: cgroupPath, summary: summary}
+
+		if info.Config != nil {
+			target.labels = info.Config.Labels
+			validateDeviceLabels(target.labels)
+		}
+
+		if len(config.Users) > 0 {
+			target.user = resolveContainerUser(info, visible)
+		}
+
+		// A restart moves the container to a new process and possibly a new cgroup, where
+		// revocations scheduled for the old one no longer apply.
+		if tracker.track(id, pid, version, cgroupPath) {
+			log.Printf("%s restarted into %s, reapplying its rules\n", id, cgroupPath)
+			cancelRevocations(id)
+		}
+
+		// A quarantined container is denied every device instead of being granted any.
+		if record := tracker.quarantineOf(id); record != nil {
+			err := enforceQuarantine(target, record)
+			summary.count(err)
+			return err
+		}
+
+		// The directories of a lazy container are watched before they are walked, so that a node
+		// created in between still counts as appeared.
+		if isLazyDirectories(target.labels) {
+			watchContainerDevices(cli, id, info.Mounts)
+		}
+
+		_, walkSpan := tracer.Start(ctx, "walk devices")
+
+		requests := getEffectiveRequests(target, sources)
+
+		walkSpan.SetAttributes(attribute.Int("devices.requested", len(requests)))
+		walkSpan.End()
+
+		revokeUnmountedDevices(target, getDeviceMountSources(info), requests)
+
+		if err := repairDeviceRules(target, requests); err != nil {
+			summary.fail(err)
+		}
+
+		if err := applyInBatches(target, orderDeviceRequests(requests)); err != nil {
+			summary.fail(err)
+			return err
+		}
+
+		if verifyInContainer && visible {
+			verifyFromContainer(target, version, requests)
+		}
+
+		if summary.applied > 0 {
+			queuePostApplyHook(target, requests)
+		}
+
+		tracker.markProcessed(id)
+
+		if watchDevices {
+			watchContainerDevices(cli, id, info.Mounts)
+		}
+
+		// Peers pick up what was just granted here; they stop triggering each other
+		// once a pass has nothing new to grant.
+		if summary.applied > 0 && len(peers) > 0 {
+			go func() {
+				for _, peer := range peers {
+					processContainer(cli, peer)
+				}
+			}()
+		}
+
+		if summary.errors > 0 {
+			return fmt.Errorf("%d errors while processing %s", summary.errors, id)
+		}
+
+		return nil
+	}
+}
+
+// waitForCGroup polls resolve with an exponential backoff until the cgroup directory it returns exists,
+// since the start event can arrive before the runtime has finished creating it. It gives up after
+// cgroupWait, or as soon as the process is gone, as the container then exited instead.
+func waitForCGroup(pid int, resolve func() (string, error)) (string, error) {
+	deadline := time.Now().Add(cgroupWait)
+	delay := 10 * time.Millisecond
+
+	for {
+		cgroupPath, err := resolve()
+
+		if err == nil {
+			_, err = os.Stat(cgroupPath)
+		}
+
+		if err == nil {
+			return cgroupPath, nil
+		}
+
+		if unix.Kill(pid, 0) == unix.ESRCH {
+			return "", fmt.Errorf("process %d exited before its cgroup was ready: %v", pid, err)
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return "", fmt.Errorf("cgroup of process %d not ready after %v: %v", pid, cgroupWait, err)
+		}
+
+		log.Printf("cgroup of process %d not ready yet, retrying in %v\n", pid, delay)
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// getHostCGroupPath returns the cgroup of pid within the host's hierarchy mounted below rootPath, or
+// an empty string if it can't be confirmed there. When the daemon runs nested in a container with
+// its own cgroup2 mount, only that check tells the host's hierarchy apart from the daemon's.
+func getHostCGroupPath(api cgroup.Interface, version int, pid int) string {
+	entry, err := api.GetDeviceCGroupRootPath("/", "/", pid)
+
+	// An entry outside the daemon's cgroup namespace is relative to it and can't be joined.
+	if err != nil || strings.HasPrefix(entry, "/..") {
+		return ""
+	}
+
+	hierarchyPath := path.Join(rootPath, "sys/fs/cgroup")
+
+	if version == 1 {
+		hierarchyPath = path.Join(rootPath, getHostDevicesMountPoint())
+	}
+
+	cgroupPath, err := resolveHostPath(path.Join(hierarchyPath, entry))
+
+	if err != nil || !cgroupHasPid(cgroupPath, pid) {
+		return ""
+	}
+
+	return cgroupPath
+}
+
+// findTaskCGroup returns the cgroup at or below cgroupPath whose cgroup.procs lists pid. Runtimes
+// may run a container's tasks in a leaf below the cgroup seen in mountinfo, and rules written to an
+// intermediate directory don't reach them.
+func findTaskCGroup(cgroupPath string, pid int) string {
+	found := ""
+
+	err := filepath.Walk(cgroupPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		if cgroupHasPid(path, pid) {
+			found = path
+			return io.EOF
+		}
+
+		return nil
+	})
+
+	// The walk is stopped with io.EOF as soon as the cgroup is found.
+	if (err != nil && err != io.EOF) || found == "" {
+		log.Printf("process %d is not listed in any cgroup.procs below %s, using it as is (is it the host's hierarchy?)\n", pid, cgroupPath)
+		return cgroupPath
+	}
+
+	if found != cgroupPath {
+		log.Printf("process %d runs in %s below its cgroup, applying rules there\n", pid, found)
+	}
+
+	return found
+}
+
+// cgroupHasPid reports whether pid is one of the processes of the cgroup at cgroupPath.
+func cgroupHasPid(cgroupPath string, pid int) bool {
+	content, err := os.ReadFile(filepath.Join(cgroupPath, "cgroup.procs"))
+
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Fields(string(content)) {
+		if line == strconv.Itoa(pid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getCgroupRuleRequests returns the rules of a container's cgroup-rules label, which are applied as
+// given rather than resolved from a device path.
+func getCgroupRuleRequests(info types.ContainerJSON, summary *processSummary) []deviceRequest {
+	if info.Config == nil {
+		return nil
+	}
+
+	key := labelKey("cgroup-rules")
+	value, ok := info.Config.Labels[key]
+
+	if !ok {
+		return nil
+	}
+
+	rules, err := parseCgroupRules(value)
+
+	if err != nil {
+		summary.fail(fmt.Errorf("invalid %s label: %v", key, err))
+		return nil
+	}
+
+	var requests []deviceRequest
+
+	for _, rule := range rules {
+		log.Printf("%s requested %s via the label %s\n", info.ID, ruleKey(rule), key)
+		requests = append(requests, deviceRequest{path: "label " + key, rule: rule})
+	}
+
+	return requests
+}
+
+// getMajorGrantRequests returns the wildcard rules requested through the grant-major label, granting
+// every minor of a major whose minors are allocated at runtime, e.g. USB serial adapters.
+func getMajorGrantRequests(info types.ContainerJSON, summary *processSummary) []deviceRequest {
+	if info.Config == nil {
+		return nil
+	}
+
+	key := labelKey("grant-major")
+	value, ok := info.Config.Labels[key]
+
+	if !ok {
+		return nil
+	}
+
+	rules, err := parseMajorGrants(value)
+
+	if err != nil {
+		summary.fail(fmt.Errorf("invalid %s label: %v", key, err))
+		return nil
+	}
+
+	var requests []deviceRequest
+
+	for _, rule := range rules {
+		log.Printf("%s requested every minor of %s via the label %s\n", info.ID, ruleKey(rule), key)
+		requests = append(requests, deviceRequest{path: "label " + key, rule: rule})
+	}
+
+	return requests
+}
+
+// tunDevice is the TUN/TAP clone device, whose number is fixed by the kernel.
+var tunDevice = deviceRequest{
+	path: "/dev/net/tun",
+	rule: cgroup.DeviceRule{Access: "rwm", Major: Ptr[int64](10), Minor: Ptr[int64](200), Type: "c", Allow: true},
+}
+
+// getTunRequests grants /dev/net/tun when the container sets the tun label, by number rather than
+// from the node, which may not exist on the host until the tun module is loaded.
+func getTunRequests(info types.ContainerJSON, summary *processSummary) []deviceRequest {
+	if info.Config == nil {
+		return nil
+	}
+
+	key := labelKey("tun")
+	value, ok := info.Config.Labels[key]
+
+	if !ok {
+		return nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+
+	if err != nil {
+		summary.fail(fmt.Errorf("invalid %s label: %v", key, err))
+		return nil
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	request := tunDevice
+	request.rule.Access, err = getDeviceAccess(info.Config.Labels, request.path)
+
+	if err != nil {
+		summary.fail(err)
+		return nil
+	}
+
+	log.Printf("%s requested %s via the label %s\n", info.ID, request.path, key)
+
+	return []deviceRequest{request}
+}
+
+// getEnvDevicePaths returns the devices declared in the container's environment under deviceEnvKey.
+func getEnvDevicePaths(id string, env []string) []string {
+	if deviceEnvKey == "" {
+		return nil
+	}
+
+	var devicePaths []string
+
+	for _, entry := range env {
+		key, value, found := strings.Cut(entry, "=")
+
+		if !found || key != deviceEnvKey {
+			continue
+		}
+
+		devicePaths = append(devicePaths, getDevicePathList(id, "environment variable "+deviceEnvKey, value)...)
+	}
+
+	return devicePaths
+}
+
+// getDevicePathList parses a comma separated list of device paths, keeping those that exist on the host.
+func getDevicePathList(id string, origin string, value string) []string {
+	var devicePaths []string
+
+	for _, devicePath := range strings.Split(value, ",") {
+		devicePath = strings.TrimSpace(devicePath)
+
+		if devicePath == "" {
+			continue
+		}
+
+		if isDevicePattern(devicePath) {
+			pattern, err := compileDevicePattern(origin, devicePath)
+
+			if err != nil {
 				log.Println(err)
 				continue
-			} else {
-				if fileInfo.IsDir() {
-					err := filepath.Walk(mount.Source,
-						func(path string, info os.FileInfo, err error) error {
-							if err != nil {
-								return err
-							} else if info.IsDir() {
-								return nil
-							} else if err = applyDeviceRules(api, path, cgroupPath, pid); err != nil {
-								log.Println(err)
-							}
-							return nil
-						})
-					if err != nil {
-						log.Println(err)
+			}
+
+			matched := getPatternDevicePaths(pattern)
+			log.Printf("%s requested %d devices matching %s via the %s\n", id, len(matched), devicePath, origin)
+
+			devicePaths = append(devicePaths, matched...)
+			continue
+		}
+
+		log.Printf("%s requested %s via the %s\n", id, devicePath, origin)
+
+		devicePath, err := normalizeDevicePath(origin, devicePath)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if _, err := os.Stat(devicePath); os.IsNotExist(err) && retryLateDevices {
+			queueLateDevice(id, devicePath)
+			continue
+		} else if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if retryLateDevices {
+			dropLateDevice(id, devicePath)
+		}
+
+		devicePaths = append(devicePaths, devicePath)
+	}
+
+	return devicePaths
+}
+
+// getDeviceRequests returns a rule for the device at devicePath, or for every device below it when it
+// is a directory, that allows or denies the device.
+func getDeviceRequests(target deviceTarget, devicePath string, allow bool) []deviceRequest {
+	var requests []deviceRequest
+
+	add := func(path string, walked bool) {
+		deviceType, major, minor, err := getDeviceInfo(path)
+
+		if err == errNotDevice {
+			handleNonDevice(target, path, walked)
+			return
+		} else if err != nil {
+			target.summary.count(err)
+			return
+		}
+
+		access, err := getDeviceAccess(target.labels, path)
+
+		if err != nil {
+			target.summary.fail(err)
+			return
+		}
+
+		requests = append(requests, deviceRequest{
+			path: path,
+			rule: cgroup.DeviceRule{
+				Access: access,
+				Major:  Ptr[int64](major),
+				Minor:  getRuleMinor(deviceType, major, minor),
+				Type:   deviceType,
+				Allow:  allow,
+			},
+		})
+
+		if deviceType != "b" || target.labels[labelKey("devices", "underlying")] != "true" {
+			return
+		}
+
+		// By-uuid and by-label links resolve to the dm node, whose stack may also need the physical devices.
+		for _, underlying := range getUnderlyingDevices(major, minor) {
+			log.Printf("%s is stacked on %s (%d:%d)\n", path, underlying.name, underlying.major, underlying.minor)
+
+			requests = append(requests, deviceRequest{
+				path: "/dev/" + underlying.name,
+				rule: cgroup.DeviceRule{
+					Access: access,
+					Major:  Ptr[int64](underlying.major),
+					Minor:  getRuleMinor("b", underlying.major, underlying.minor),
+					Type:   "b",
+					Allow:  allow,
+				},
+			})
+		}
+	}
+
+	if fileInfo, err := os.Stat(devicePath); err != nil {
+		target.summary.fail(err)
+	} else if fileInfo.IsDir() {
+		paths, err := getWalkedPaths(devicePath, fileInfo)
+
+		// A directory mounted lazily is only granted the nodes created in it since it is watched.
+		if allow && isLazyDirectory(target, devicePath) {
+			paths = getAppearedPaths(target.id, paths)
+		}
+
+		for _, path := range paths {
+			add(path, true)
+		}
+
+		if err != nil {
+			target.summary.fail(err)
+		}
+	} else {
+		add(devicePath, false)
+	}
+
+	return requests
+}
+
+// getWalkedPaths returns the files below the directory devicePath, leaving out other filesystems mounted
+// below it, or during a reload pass the files the pass already found there.
+func getWalkedPaths(devicePath string, fileInfo os.FileInfo) ([]string, error) {
+	if paths, ok := scanCache.walked(devicePath); ok {
+		return paths, nil
+	}
+
+	var paths []string
+
+	rootDev := getFileDev(fileInfo)
+
+	// The directories walked so far, resolved, so a link back to one of them doesn't loop.
+	visited := make(map[string]bool)
+
+	if resolvedPath, err := filepath.EvalSymlinks(devicePath); err == nil {
+		visited[resolvedPath] = true
+	}
+
+	var walk func(root string) error
+
+	walk = func(root string) error {
+		return filepath.Walk(root,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				} else if info.IsDir() {
+					// Directories on another filesystem, e.g. /dev/shm or /dev/pts below /dev,
+					// are mount points that hold no device nodes of their own.
+					if path != devicePath && getFileDev(info) != rootDev {
+						log.Printf("%s is a separate filesystem... skipping\n", path)
+						return filepath.SkipDir
 					}
-				} else {
-					if err = applyDeviceRules(api, mount.Source, cgroupPath, pid); err != nil {
-						log.Println(err)
+					return nil
+				} else if info.Mode()&os.ModeSymlink != 0 && followSymlinks {
+					if linkedPath, ok := getLinkedDirectory(path, visited); ok && linkedPath == "" {
+						return nil
+					} else if ok {
+						// The trailing slash makes the walk follow the link rather than list it.
+						return walk(linkedPath + "/")
 					}
 				}
+				paths = append(paths, path)
+				return nil
+			})
+	}
+
+	err := walk(devicePath)
+
+	if err == nil {
+		scanCache.storeWalked(devicePath, paths)
+	}
+
+	return paths, err
+}
+
+// getLinkedDirectory reports whether linkPath is a symlink to a directory, returning the link to walk
+// if the directory is within deviceRoots and wasn't walked yet, marking it as visited. Links to
+// anything else are listed like any other file.
+func getLinkedDirectory(linkPath string, visited map[string]bool) (string, bool) {
+	resolvedPath, err := filepath.EvalSymlinks(linkPath)
+
+	if err != nil {
+		return "", false
+	}
+
+	if info, err := os.Stat(resolvedPath); err != nil || !info.IsDir() {
+		return "", false
+	}
+
+	if _, err := resolveDevicePath(linkPath); err != nil {
+		log.Printf("%v... skipping\n", err)
+		return "", true
+	}
+
+	if visited[resolvedPath] {
+		log.Printf("%s links to %s, which was already walked... skipping\n", linkPath, resolvedPath)
+		return "", true
+	}
+
+	visited[resolvedPath] = true
+	return linkPath, true
+}
+
+// handleNonDevice deals with a requested path that is neither a character nor a block device, e.g. a
+// FIFO, according to nonDeviceMode. Unless configured, files found while walking a directory are skipped
+// silently while explicitly requested ones are warned about.
+func handleNonDevice(target deviceTarget, devicePath string, walked bool) {
+	mode := nonDeviceMode
+
+	if mode == "" && walked {
+		mode = "skip"
+	} else if mode == "" {
+		mode = "warn"
+	}
+
+	switch mode {
+	case "skip":
+		target.summary.skipped++
+	case "warn":
+		log.Printf("%s is neither a character nor a block device... skipping\n", devicePath)
+		target.summary.skipped++
+	default:
+		target.summary.fail(fmt.Errorf("%s is neither a character nor a block device", devicePath))
+	}
+}
+
+// getFileDev returns the number of the device holding the filesystem a file lives on.
+func getFileDev(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+
+	return 0
+}
+
+// orderDeviceRequests sequences allow and deny rules according to ruleOrder. Both cgroup versions
+// let a later rule override an earlier one for the same device, so with the default deny-last
+// a deny always wins over an overlapping allow.
+func orderDeviceRequests(requests []deviceRequest) []deviceRequest {
+	if ruleOrder == "input" {
+		return requests
+	}
+
+	denyFirst := ruleOrder == "deny-first"
+	ordered := make([]deviceRequest, 0, len(requests))
+
+	for _, first := range []bool{true, false} {
+		for _, request := range requests {
+			if (request.rule.Allow != denyFirst) == first {
+				ordered = append(ordered, request)
 			}
 		}
 	}
+
+	return ordered
 }
 
-func checkExistingContainers(cli *client.Client) {
+// checkExistingContainers processes every running container. A reload leaves out those whose
+// reconcile label asks for their rules to be applied only once.
+func checkExistingContainers(cli *client.Client, reload bool) {
 	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
 
 	if err != nil {
-		panic(err)
+		log.Printf("unable to list the running containers: %v\n", err)
+		return
 	}
 
+	// Cached PIDs and cgroup paths are never trusted here: anything no longer running
+	// is dropped and the rest are re-inspected by processContainer.
+	forgetStoppedContainers(containers)
+
 	for _, container := range containers {
+		if reload && !isReconciled(container.ID, container.Labels) {
+			continue
+		}
+
+		if !isEnabled(container.Labels) && tracker.quarantineOf(container.ID) == nil {
+			continue
+		}
+
 		log.Printf("Checking existing container %s %s\n", container.ID[:10], container.Image)
 		processContainer(cli, container.ID)
 	}
 }
 
-func applyDeviceRules(api cgroup.Interface, mountPath string, cgroupPath string, pid int) error {
-	deviceType, major, minor, err := getDeviceInfo(mountPath)
+func applyDeviceRules(target deviceTarget, request deviceRequest) error {
+	rule := request.rule
 
-	if err != nil {
-		log.Println(err)
-		return err
-	} else {
-		log.Printf("Adding device rule for process %d at %s\n", pid, cgroupPath)
-		err = api.AddDeviceRules(cgroupPath, []cgroup.DeviceRule{
-			{
-				Access: "rwm",
-				Major:  Ptr[int64](major),
-				Minor:  Ptr[int64](minor),
-				Type:   deviceType,
-				Allow:  true,
-			},
-		})
+	if !rule.Allow {
+		if tracker.isDenied(target.id, target.cgroupPath, rule) {
+			return nil
+		}
+
+		snapshotBaseline(target)
+		log.Printf("Adding deny rule for %s for process %d at %s\n", request.path, target.pid, target.cgroupPath)
+
+		_, writeSpan := startWriteSpan(target, request)
+		_, removed, err := target.api.Reconcile(target.cgroupPath, []cgroup.DeviceRule{rule})
+		endSpan(writeSpan, err)
 
 		if err != nil {
-			log.Println(err)
 			return err
 		}
+
+		target.summary.applied += removed
+		tracker.recordDenial(target.id, target.cgroupPath, rule)
+
+		if removed > 0 {
+			publish(eventDenied, target.id, request.path, &rule)
+		}
+
+		return nil
+	}
+
+	if tracker.isGranted(target.id, target.cgroupPath, rule) || tracker.isExpired(target.id, request.path) {
+		return nil
+	}
+
+	if err := checkUserPolicies(target, request.path); err != nil {
+		return err
+	}
+
+	ttl, err := getDeviceTTL(target, request.path)
+
+	if err != nil {
+		return err
+	}
+
+	// A device that could not be revoked in time is not granted at all.
+	if ttl > 0 && !hasRevocationBudget(target.id, request.path) {
+		return fmt.Errorf("not granting %s to %s: %d TTL revocations are already pending (DVD_MAX_TIMERS)", request.path, target.id, maxRevocationTimers)
+	}
+
+	snapshotBaseline(target)
+	log.Printf("Adding device rule for process %d at %s\n", target.pid, target.cgroupPath)
+
+	// Devices the runtime already allows, e.g. through --device, need no write.
+	_, writeSpan := startWriteSpan(target, request)
+	added, _, err := target.api.Reconcile(target.cgroupPath, []cgroup.DeviceRule{rule})
+	endSpan(writeSpan, err)
+
+	if err != nil {
+		return err
+	}
+
+	target.summary.applied += added
+
+	if added > 0 {
+		publish(eventApplied, target.id, request.path, &rule)
+	}
+
+	if tracker.recordGrant(target.id, target.cgroupPath, request.path, rule, added > 0) {
+		log.Printf("Drift: %s was present in container %s but not granted, granted %s\n", request.path, target.id, ruleKey(rule))
+	}
+
+	if ttl > 0 {
+		scheduleRevocation(target, request.path, rule, ttl)
+	}
+
+	if rule.Type == "b" && rule.Major != nil && rule.Minor != nil {
+		return applyIOLimit(target, request.path, *rule.Major, *rule.Minor)
 	}
 
 	return nil
 }
+
+// applyIOLimit throttles a granted block device when the container carries an io.max.<device> label for it.
+func applyIOLimit(target deviceTarget, devicePath string, major int64, minor int64) error {
+	key, value, ok := getDeviceLabel(target.labels, "io.max", devicePath)
+
+	if !ok {
+		return nil
+	}
+
+	limits, err := parseIOLimits(value)
+
+	if err != nil {
+		return fmt.Errorf("invalid %s label: %v", key, err)
+	}
+
+	log.Printf("Setting io limit %s on %s for process %d at %s\n", value, devicePath, target.pid, target.cgroupPath)
+
+	return target.api.SetIOLimit(target.cgroupPath, major, minor, limits)
+}
@@ -0,0 +1,465 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"golang.org/x/sys/unix"
+)
+
+// benchmarkMajor is a major of the range Linux reserves for local use, so no driver claims it.
+const benchmarkMajor = 240
+
+// newDeviceTree creates a device root holding n character device nodes, 100 to a directory, and
+// returns the paths of the nodes.
+func newDeviceTree(tb testing.TB, n int) (string, []string) {
+	tb.Helper()
+
+	root := newDeviceRoot(tb)
+	nodes := make([]string, n)
+
+	for i := range nodes {
+		directory := filepath.Join(root, fmt.Sprintf("bus%03d", i/100))
+
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			tb.Fatal(err)
+		}
+
+		nodes[i] = filepath.Join(directory, fmt.Sprintf("node%03d", i%100))
+
+		if err := unix.Mknod(nodes[i], unix.S_IFCHR|0600, int(unix.Mkdev(benchmarkMajor, uint32(i)))); err != nil {
+			tb.Skipf("unable to create device nodes: %v", err)
+		}
+	}
+
+	return root, nodes
+}
+
+// discardLogs drops what is logged until the benchmark is done, which would otherwise be most of its time.
+func discardLogs(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func BenchmarkGetWalkedPaths(b *testing.B) {
+	discardLogs(b)
+
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("%d nodes", n), func(b *testing.B) {
+			root, _ := newDeviceTree(b, n)
+			info, err := os.Stat(root)
+
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				paths, err := getWalkedPaths(root, info)
+
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if len(paths) != n {
+					b.Fatalf("walked %d paths, want %d", len(paths), n)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkProcessContainer measures processContainer granting the devices of a running container
+// with the given mounts, from scratch every time, and reports the rules applied per second.
+func benchmarkProcessContainer(b *testing.B, rules int, mounts func(nodes []string, root string) []types.MountPoint) {
+	discardLogs(b)
+
+	root, nodes := newDeviceTree(b, rules)
+	task := newTestTask(b)
+
+	id := containerID(130)
+	resetTracking(b, id)
+	_, cli := newTestDocker(b, runningContainer(id, task, nil, mounts(nodes, root)...))
+
+	var elapsed time.Duration
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tracker.untrack(id)
+
+		if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.deny"), []byte("a"), 0600); err != nil {
+			b.Fatal(err)
+		}
+
+		summary := &processSummary{}
+		start := time.Now()
+		b.StartTimer()
+
+		err := processContainerInto(cli, id, summary)
+
+		b.StopTimer()
+		elapsed += time.Since(start)
+		b.StartTimer()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if summary.applied != rules {
+			b.Fatalf("applied %d rules, want %d", summary.applied, rules)
+		}
+	}
+
+	b.ReportMetric(float64(rules*b.N)/elapsed.Seconds(), "rules/s")
+}
+
+func BenchmarkProcessContainer(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("%d mounts", n), func(b *testing.B) {
+			benchmarkProcessContainer(b, n, func(nodes []string, root string) []types.MountPoint {
+				mounts := make([]types.MountPoint, len(nodes))
+
+				for i, node := range nodes {
+					mounts[i] = deviceMount(node)
+				}
+
+				return mounts
+			})
+		})
+	}
+
+	// A single mount of a large directory, e.g. -v /dev:/dev.
+	b.Run("1000 nodes below a mount", func(b *testing.B) {
+		benchmarkProcessContainer(b, 1000, func(nodes []string, root string) []types.MountPoint {
+			return []types.MountPoint{deviceMount(root)}
+		})
+	})
+}
+
+func TestRuleOrder(t *testing.T) {
+	previous := ruleOrder
+	t.Cleanup(func() { ruleOrder = previous })
+
+	request := func(devicePath string, minor int64, access string, allow bool) deviceRequest {
+		return deviceRequest{path: devicePath, rule: cgroup.DeviceRule{Type: "c", Major: Ptr[int64](1), Minor: Ptr(minor), Access: access, Allow: allow}}
+	}
+
+	// As requested by a single layer: /dev/full allowed then denied, /dev/null denied w then allowed.
+	requests := []deviceRequest{
+		request("/dev/full", 7, "rwm", true),
+		request("/dev/full", 7, "rwm", false),
+		request("/dev/null", 3, "w", false),
+		request("/dev/null", 3, "rwm", true),
+	}
+
+	for _, test := range []struct {
+		order string
+		full  string
+		null  string
+	}{
+		{order: "deny-last", full: "", null: "rm"},
+		{order: "deny-first", full: "rwm", null: "rwm"},
+		{order: "input", full: "", null: "rwm"},
+	} {
+		ruleOrder = test.order
+
+		apis := map[string]func(t *testing.T) (cgroup.Interface, string){
+			"cgroup v1": func(t *testing.T) (cgroup.Interface, string) {
+				api, _ := cgroup.New(1)
+				task := newTestTask(t)
+
+				if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.deny"), []byte("a"), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				return api, task.cgroupPath
+			},
+			"cgroup v2": func(t *testing.T) (cgroup.Interface, string) {
+				return newTestCGroup(), "/sys/fs/cgroup/ordered"
+			},
+		}
+
+		for name, newAPI := range apis {
+			t.Run(test.order+" on "+name, func(t *testing.T) {
+				id := containerID(118)
+				resetTracking(t, id)
+
+				api, cgroupPath := newAPI(t)
+				target := testTarget(id, api, cgroupPath)
+
+				processMu.Lock()
+				err := applyInBatches(target, orderDeviceRequests(requests))
+				processMu.Unlock()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				actual, err := api.ListDeviceRules(cgroupPath)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, device := range []struct {
+					request deviceRequest
+					want    string
+				}{{requests[0], test.full}, {requests[2], test.null}} {
+					for _, access := range "rwm" {
+						rule := device.request.rule
+						rule.Access = string(access)
+
+						if allowed, want := cgroup.Allows(actual, rule), strings.ContainsRune(device.want, access); allowed != want {
+							t.Errorf("%s %c: allowed = %v, want %v", device.request.path, access, allowed, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWalkSkipsNestedFilesystems(t *testing.T) {
+	root, nodes := newDeviceTree(t, 2)
+	shm := filepath.Join(root, "shm")
+
+	if err := os.Mkdir(shm, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Mount("tmpfs", shm, "tmpfs", 0, "size=1m"); err != nil {
+		t.Skipf("unable to mount a tmpfs: %v", err)
+	}
+
+	t.Cleanup(func() { unix.Unmount(shm, unix.MNT_DETACH) })
+
+	if err := os.WriteFile(filepath.Join(shm, "segment"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(root)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := getWalkedPaths(root, info)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walked := make(map[string]bool)
+
+	for _, walkedPath := range paths {
+		walked[walkedPath] = true
+	}
+
+	if walked[filepath.Join(shm, "segment")] {
+		t.Errorf("the walk descended into the tmpfs mounted at %s: %v", shm, paths)
+	}
+
+	for _, node := range nodes {
+		if !walked[node] {
+			t.Errorf("the walk left out %s: %v", node, paths)
+		}
+	}
+
+	// The mount point itself is walked when it is the mounted directory.
+	if info, err = os.Stat(shm); err != nil {
+		t.Fatal(err)
+	}
+
+	if paths, err = getWalkedPaths(shm, info); err != nil || len(paths) != 1 {
+		t.Errorf("walking the tmpfs itself found %v (%v), want its segment", paths, err)
+	}
+}
+
+func TestHostCGroupOfNestedMounts(t *testing.T) {
+	previous := rootPath
+	rootPath = t.TempDir()
+	t.Cleanup(func() { rootPath = previous })
+
+	const pid = 4242
+
+	// addCGroup creates a cgroup below the host's hierarchy at rootPath, listing the given processes.
+	addCGroup := func(hierarchy string, entry string, pids string) string {
+		cgroupPath := filepath.Join(rootPath, hierarchy, entry)
+
+		if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.procs"), []byte(pids), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		return cgroupPath
+	}
+
+	v1Hierarchy := getHostDevicesMountPoint()
+	host := addCGroup("sys/fs/cgroup", "/system.slice/docker-abc.scope", "1\n4242\n")
+	hostV1 := addCGroup(v1Hierarchy, "/docker/abc", "4242\n")
+
+	// With a cgroup namespace of its own, the daemon's cgroup2 mount shows the container's cgroup at a
+	// path the host's hierarchy has too, but without its processes.
+	addCGroup("sys/fs/cgroup", "/docker-abc.scope", "17\n")
+
+	for _, test := range []struct {
+		name    string
+		version int
+		entry   string
+		want    string
+	}{
+		{name: "host hierarchy holding the container", version: 2, entry: "/system.slice/docker-abc.scope", want: host},
+		{name: "v1 devices hierarchy holding the container", version: 1, entry: "/docker/abc", want: hostV1},
+		{name: "path of the daemon's own mount", version: 2, entry: "/docker-abc.scope", want: ""},
+		{name: "cgroup missing from the host hierarchy", version: 2, entry: "/system.slice/docker-def.scope", want: ""},
+		{name: "cgroup outside the daemon's namespace", version: 2, entry: "/../system.slice/docker-abc.scope", want: ""},
+	} {
+		api := newTestCGroup()
+		api.entry = test.entry
+
+		if cgroupPath := getHostCGroupPath(api, test.version, pid); cgroupPath != test.want {
+			t.Errorf("%s: resolved %q, want %q", test.name, cgroupPath, test.want)
+		}
+	}
+}
+
+func TestEventsSubscribedBeforeTheScan(t *testing.T) {
+	early, late := newTestTask(t), newTestTask(t)
+
+	for _, task := range []testTask{early, late} {
+		if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.deny"), []byte("a"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	docker, cli := newTestDocker(t)
+	since := time.Now()
+
+	start := func(n int, task testTask, at time.Time) string {
+		info := runningContainer(containerID(n), task, nil, deviceMount("/dev/null"))
+		resetTracking(t, info.ID)
+		docker.set(info)
+		docker.emit(events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: info.ID}, Time: at.Unix(), TimeNano: at.UnixNano()})
+		return info.ID
+	}
+
+	// An event from before the scan began is not replayed.
+	stale := containerID(183)
+	docker.emit(events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: stale}, Time: since.Add(-time.Hour).Unix()})
+
+	// A container starting before the subscription is replayed by dockerd, one starting while the scan
+	// runs is buffered until it is done.
+	earlyID := start(184, early, since)
+	msgs, errs := subscribeEvents(cli, since)
+	checkExistingContainers(cli, false)
+	lateID := start(185, late, time.Now())
+
+	forwarded := make(chan events.Message)
+	received := make(chan string, 3)
+
+	go func() {
+		for msg := range msgs {
+			received <- msg.Actor.ID
+			forwarded <- msg
+		}
+	}()
+
+	go listenForMounts(cli, since, forwarded, make(chan error))
+
+	var ids []string
+
+	for len(ids) < 2 {
+		select {
+		case id := <-received:
+			ids = append(ids, id)
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received the events of %v, want those of %s and %s", ids, earlyID, lateID)
+		}
+	}
+
+	if want := []string{earlyID, lateID}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("received the events of %v, want %v", ids, want)
+	}
+
+	for _, task := range []testTask{early, late} {
+		deadline := time.Now().Add(5 * time.Second)
+
+		for entries := task.devicesList(t); !reflect.DeepEqual(entries, []string{"c 1:3 rwm"}); entries = task.devicesList(t) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s lists %v, want the rule of /dev/null", task.cgroupPath, entries)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestResubscribingSkipsHandledEvents(t *testing.T) {
+	handled, missed := testContainer(nil, nil), testContainer(nil, nil)
+	handled.ID, missed.ID = containerID(257), containerID(258)
+
+	// The rescan after resubscribing would inspect running containers again.
+	handled.State.Running, missed.State.Running = false, false
+	docker, cli := newTestDocker(t, handled, missed)
+
+	// Both events fall within the same second, which the subscription used to be given in.
+	second := time.Now().Truncate(time.Second)
+
+	start := func(id string, at time.Time) {
+		docker.emit(events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: id}, Time: at.Unix(), TimeNano: at.UnixNano()})
+	}
+
+	waitForInspections := func(id string, want int) {
+		t.Helper()
+
+		deadline := time.Now().Add(10 * time.Second)
+
+		for docker.inspections(id) < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was inspected %d times, want %d", id, docker.inspections(id), want)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	start(handled.ID, second.Add(100*time.Millisecond))
+
+	msgs, errs := subscribeEvents(cli, second)
+	go listenForMounts(cli, second, msgs, errs)
+
+	waitForInspections(handled.ID, 1)
+
+	// Losing the stream, e.g. to a restart of dockerd, resubscribes from the last event handled.
+	docker.dropEvents()
+	start(missed.ID, second.Add(200*time.Millisecond))
+
+	waitForInspections(missed.ID, 1)
+
+	// The replay sends the events in order, so the handled one would have been processed again by now.
+	if inspections := docker.inspections(handled.ID); inspections != 1 {
+		t.Errorf("%s was inspected %d times across the resubscription, want once", handled.ID, inspections)
+	}
+}
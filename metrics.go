@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceClasses maps the fixed major numbers of common devices to a coarse class for metrics. Majors
+// that are allocated dynamically, such as those of nvidia-uvm or device-mapper, fall into "other";
+// see Documentation/admin-guide/devices.txt in the kernel tree when adding to it.
+var deviceClasses = map[string]map[int64]string{
+	"c": {
+		4:   "tty", // ttyN, ttySN
+		5:   "tty", // tty, console, ptmx
+		166: "tty", // ttyACMN
+		188: "tty", // ttyUSBN
+		13:  "input",
+		116: "sound",
+		226: "dri",
+		195: "nvidia",
+	},
+	"b": {
+		8:   "disk", // sdX
+		179: "disk", // mmcblkN
+		259: "disk", // nvmeXnY and other extended partitions
+	},
+}
+
+// getDeviceClass returns the metrics class of a rule's device.
+func getDeviceClass(rule *cgroup.DeviceRule) string {
+	if rule == nil || rule.Major == nil {
+		return "other"
+	}
+
+	if class, ok := deviceClasses[rule.Type][*rule.Major]; ok {
+		return class
+	}
+
+	return "other"
+}
+
+var rulesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dvd_rules_total",
+	Help: "Device rules the daemon applied, denied and revoked, by device class.",
+}, []string{"event", "device_class"})
+
+var containersGoneTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "dvd_containers_gone_total",
+	Help: "Tracked containers that died or were destroyed.",
+})
+
+var requiredFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "dvd_required_device_failures_total",
+	Help: "Devices marked as required that could not be made available to their container.",
+})
+
+// cgroupWriteSeconds isolates the time spent writing cgroup device rules from Docker API and walk time.
+var cgroupWriteSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "dvd_cgroup_write_seconds",
+	Help:    "Duration of the writes of device rules to a cgroup, by cgroup version.",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+}, []string{"cgroup_version"})
+
+// subscribeMetrics counts the lifecycle events published on the event bus and times cgroup writes.
+func subscribeMetrics() {
+	prometheus.MustRegister(rulesTotal, containersGoneTotal, requiredFailuresTotal, cgroupWriteSeconds)
+
+	cgroup.WriteObserver = func(version int, duration time.Duration) {
+		cgroupWriteSeconds.WithLabelValues(strconv.Itoa(version)).Observe(duration.Seconds())
+	}
+
+	subscribe(func(event lifecycleEvent) {
+		if event.Kind == eventContainerGone {
+			containersGoneTotal.Inc()
+			return
+		}
+
+		rulesTotal.WithLabelValues(event.Kind, getDeviceClass(event.Rule)).Inc()
+	})
+}
@@ -0,0 +1,73 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// getDeviceMountSources returns the sorted sources of a container's mounts within deviceRoots.
+func getDeviceMountSources(info types.ContainerJSON) []string {
+	var sources []string
+
+	for _, mount := range info.Mounts {
+		if isDeviceSource(mount.Source) {
+			sources = append(sources, mount.Source)
+		}
+	}
+
+	sort.Strings(sources)
+	return sources
+}
+
+// revokeUnmountedDevices revokes what the daemon granted for device mounts a container no longer has,
+// e.g. after a directory mount was replaced by one with a different source. Devices that are still
+// requested some other way, such as through the new mount, stay granted.
+func revokeUnmountedDevices(target deviceTarget, sources []string, requests []deviceRequest) {
+	removed := tracker.updateMounts(target.id, sources)
+
+	if len(removed) == 0 {
+		return
+	}
+
+	log.Printf("%s no longer mounts %s, revoking its devices from there\n", target.id, strings.Join(removed, ", "))
+
+	requested := make(map[string]bool)
+
+	for _, request := range requests {
+		requested[ruleKey(request.rule)] = true
+	}
+
+	for _, grant := range tracker.grants(target.id) {
+		if !grant.Applied || requested[ruleKey(grant.Rule)] || !isWithinAny(grant.Path, removed) {
+			continue
+		}
+
+		log.Printf("Revoking %s from %s, its mount is gone\n", grant.Path, target.id)
+
+		if err := revokeRules(target.api, target.id, target.cgroupPath, []cgroup.DeviceRule{grant.Rule}); err != nil {
+			target.summary.fail(err)
+			continue
+		}
+
+		rule := grant.Rule
+		tracker.forgetRule(target.id, rule)
+		publish(eventRevoked, target.id, grant.Path, &rule)
+	}
+}
+
+// isWithinAny reports whether devicePath is or lies below one of roots.
+func isWithinAny(devicePath string, roots []string) bool {
+	for _, root := range roots {
+		if isPathWithin(devicePath, root) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// getNetnsPeers returns the running containers that share a network namespace with info, i.e. the
+// container owning the namespace and every container joined to it through --network container:<id>.
+func getNetnsPeers(cli *client.Client, info types.ContainerJSON) []types.ContainerJSON {
+	resolved := make(map[string]string)
+
+	// resolve maps the container reference of a network mode, a name or an ID, to the container ID.
+	resolve := func(ref string) string {
+		if id, ok := resolved[ref]; ok {
+			return id
+		}
+
+		owner, err := cli.ContainerInspect(context.Background(), ref)
+
+		if err != nil {
+			log.Println(err)
+		}
+
+		resolved[ref] = owner.ID
+		return owner.ID
+	}
+
+	ownerID := info.ID
+
+	if info.HostConfig != nil && info.HostConfig.NetworkMode.IsContainer() {
+		ownerID = resolve(info.HostConfig.NetworkMode.ConnectedContainer())
+	}
+
+	if ownerID == "" {
+		return nil
+	}
+
+	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
+
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	var peers []types.ContainerJSON
+
+	for _, container := range containers {
+		if container.ID == info.ID {
+			continue
+		}
+
+		if container.ID != ownerID {
+			networkMode := container.HostConfig.NetworkMode
+
+			if !strings.HasPrefix(networkMode, "container:") {
+				continue
+			}
+
+			if resolve(strings.TrimPrefix(networkMode, "container:")) != ownerID {
+				continue
+			}
+		}
+
+		peer, err := cli.ContainerInspect(context.Background(), container.ID)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
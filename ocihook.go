@@ -0,0 +1,231 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// runOCIHook applies the device rules of a single container as an OCI runtime hook, e.g. poststart,
+// without Docker: the state of the container is read from stdin as the runtime passes it, and its
+// devices from the bundle's config.json. A non-nil error makes the hook, and with it the runtime
+// operation, fail.
+func runOCIHook(input io.Reader) error {
+	var state specs.State
+
+	if err := json.NewDecoder(input).Decode(&state); err != nil {
+		return fmt.Errorf("malformed OCI state on stdin: %v", err)
+	}
+
+	if state.Pid <= 0 {
+		return fmt.Errorf("the OCI state of %s has no pid, run the hook at createRuntime or later", state.ID)
+	}
+
+	content, err := os.ReadFile(path.Join(state.Bundle, "config.json"))
+
+	if err != nil {
+		return err
+	}
+
+	spec, resources, err := parseOCIConfig(content)
+
+	if err != nil {
+		return fmt.Errorf("malformed config.json of %s: %v", state.ID, err)
+	}
+
+	version, err := cgroup.GetDeviceCGroupVersion("/", state.Pid)
+
+	if err != nil {
+		return err
+	}
+
+	api, err := cgroup.New(version)
+
+	if err != nil {
+		return err
+	}
+
+	// The hook runs in the runtime's namespaces, on the host itself.
+	cgroupPath, sysfsPath, err := api.GetDeviceCGroupMountPath("/", state.Pid)
+
+	if err != nil {
+		return err
+	}
+
+	cgroupPath = findTaskCGroup(path.Join(sysfsPath, cgroupPath), state.Pid)
+
+	if err := checkDevicesCGroup(cgroupPath, version); err != nil {
+		return err
+	}
+
+	if err := checkHostCGroup(cgroupPath, version); err != nil {
+		return err
+	}
+
+	log.Printf("The cgroup path for process %d of %s is at %v\n", state.Pid, state.ID, cgroupPath)
+
+	summary := &processSummary{id: state.ID, version: version, start: time.Now()}
+	target := deviceTarget{ctx: context.Background(), id: state.ID, pid: state.Pid, api: api, cgroupPath: cgroupPath, summary: summary}
+
+	// Annotations take the place of labels, e.g. dvd.access./dev/ttyUSB0=rw.
+	target.labels = spec.Annotations
+
+	for _, request := range getOCIHookRequests(target, spec, resources) {
+		applied := summary.applied
+		err := applyDeviceRules(target, request)
+		summary.record(request, summary.applied > applied, err)
+	}
+
+	summary.log()
+
+	if summary.errors > 0 {
+		return fmt.Errorf("%d errors while processing %s", summary.errors, state.ID)
+	}
+
+	return nil
+}
+
+// ociDeviceCgroup is an entry of linux.resources.devices of an OCI config, whose access may also be
+// given in the structured form of cgroup.DeviceAccess, e.g. {"read": true, "mknod": true}.
+type ociDeviceCgroup struct {
+	Allow  bool        `json:"allow"`
+	Type   string      `json:"type,omitempty"`
+	Major  *int64      `json:"major,omitempty"`
+	Minor  *int64      `json:"minor,omitempty"`
+	Access accessValue `json:"access,omitempty"`
+}
+
+// parseOCIConfig parses a bundle's config.json along with its linux.resources.devices. The spec
+// only takes access strings there, so an entry in the structured form is left to the latter.
+func parseOCIConfig(content []byte) (specs.Spec, []ociDeviceCgroup, error) {
+	var spec specs.Spec
+	var typeErr *json.UnmarshalTypeError
+
+	if err := json.Unmarshal(content, &spec); err != nil && !(errors.As(err, &typeErr) && isResourceAccessField(typeErr.Field)) {
+		return specs.Spec{}, nil, err
+	}
+
+	var resources struct {
+		Linux *struct {
+			Resources *struct {
+				Devices []ociDeviceCgroup `json:"devices"`
+			} `json:"resources"`
+		} `json:"linux"`
+	}
+
+	if err := json.Unmarshal(content, &resources); err != nil {
+		return specs.Spec{}, nil, err
+	}
+
+	if resources.Linux == nil || resources.Linux.Resources == nil {
+		return spec, nil, nil
+	}
+
+	return spec, resources.Linux.Resources.Devices, nil
+}
+
+// isResourceAccessField reports whether field, as a json.UnmarshalTypeError names it, is the access of
+// an entry of linux.resources.devices, with or without the index of the entry.
+func isResourceAccessField(field string) bool {
+	return strings.HasPrefix(field, "linux.resources.devices.") && strings.HasSuffix(field, ".access")
+}
+
+// getOCIHookRequests returns the requests for the devices of a container's OCI config: those it lists
+// as devices, which need not exist on the host, those its device cgroup resources allow and those bind
+// mounted from below /dev. The runtime starts the resources with a deny of every device, which would
+// take back everything else here, so their denies are left to it.
+func getOCIHookRequests(target deviceTarget, spec specs.Spec, resources []ociDeviceCgroup) []deviceRequest {
+	var requests []deviceRequest
+
+	for _, device := range resources {
+		deviceType := device.Type
+
+		if deviceType == "" {
+			deviceType = "a"
+		}
+
+		if !device.Allow || (deviceType != "a" && deviceType != "b" && deviceType != "c") {
+			continue
+		}
+
+		access := string(device.Access)
+
+		if access == "" {
+			access = "rwm"
+		}
+
+		// As in OCI json, a negative major or minor matches any number.
+		major, minor := device.Major, device.Minor
+
+		if major != nil && *major < 0 {
+			major = nil
+		}
+
+		if minor != nil && *minor < 0 {
+			minor = nil
+		}
+
+		rule := cgroup.DeviceRule{Access: access, Major: major, Minor: minor, Type: deviceType, Allow: true}
+
+		log.Printf("%s requested %s via the resources of its OCI config\n", target.id, ruleKey(rule))
+		requests = append(requests, deviceRequest{path: "linux.resources.devices", rule: rule})
+	}
+
+	if spec.Linux != nil {
+		for _, device := range spec.Linux.Devices {
+			deviceType := device.Type
+
+			// Unbuffered character devices are character devices to the cgroup, fifos aren't devices.
+			switch deviceType {
+			case "c", "b":
+			case "u":
+				deviceType = "c"
+			default:
+				continue
+			}
+
+			access, err := getDeviceAccess(target.labels, device.Path)
+
+			if err != nil {
+				target.summary.fail(err)
+				continue
+			}
+
+			log.Printf("%s requested %s via its OCI config\n", target.id, device.Path)
+
+			requests = append(requests, deviceRequest{
+				path: device.Path,
+				rule: cgroup.DeviceRule{
+					Access: access,
+					Major:  Ptr[int64](device.Major),
+					Minor:  getRuleMinor(deviceType, device.Major, device.Minor),
+					Type:   deviceType,
+					Allow:  true,
+				},
+			})
+		}
+	}
+
+	for _, mount := range spec.Mounts {
+		if !isDeviceSource(mount.Source) {
+			continue
+		}
+
+		log.Printf("%s requested a mount for %s at %s via its OCI config\n", target.id, mount.Source, mount.Destination)
+		requests = append(requests, getDeviceRequests(target, path.Clean(mount.Source), true)...)
+	}
+
+	return orderDeviceRequests(requests)
+}
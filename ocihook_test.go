@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOCIHookResourceAccess(t *testing.T) {
+	content := `{
+		"ociVersion": "1.0.2",
+		"annotations": {"dvd.access./dev/null": "r"},
+		"linux": {
+			"devices": [{"path": "/dev/null", "type": "c", "major": 1, "minor": 3}],
+			"resources": {
+				"devices": [
+					{"allow": false, "access": "rwm"},
+					{"allow": true, "type": "c", "major": 1, "minor": 5, "access": {"read": true, "write": true}},
+					{"allow": true, "type": "c", "major": 188, "minor": -1, "access": "rm"},
+					{"allow": true, "type": "b", "major": 8, "minor": 0, "access": {"mknod": true, "read": true}},
+					{"allow": true, "type": "p", "access": "rwm"},
+					{"allow": true, "type": "c", "major": 10, "minor": 200}
+				]
+			}
+		}
+	}`
+
+	spec, resources, err := parseOCIConfig([]byte(content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rest of the spec is read as well, despite the structured accesses.
+	if spec.Annotations["dvd.access./dev/null"] != "r" || spec.Linux == nil || len(spec.Linux.Devices) != 1 {
+		t.Fatalf("parsed the spec %+v", spec)
+	}
+
+	target := testTarget(containerID(131), newTestCGroup(), "/sys/fs/cgroup/oci")
+	target.labels = spec.Annotations
+	resetTracking(t, target.id)
+
+	var rules []string
+
+	for _, request := range getOCIHookRequests(target, spec, resources) {
+		rules = append(rules, ruleKey(request.rule))
+	}
+
+	if want := []string{"c 1:5 rw", "c 188:* rm", "b 8:0 rm", "c 10:200 rwm", "c 1:3 r"}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("requested %v, want %v", rules, want)
+	}
+
+	for _, access := range []string{`{"read": false}`, `{"read": true, "execute": true}`, `"rx"`} {
+		content := `{"linux": {"resources": {"devices": [{"allow": true, "type": "c", "major": 1, "minor": 5, "access": ` + access + `}]}}}`
+
+		if _, _, err := parseOCIConfig([]byte(content)); err == nil {
+			t.Errorf("parsed the access %s", access)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ociMount is a mount as recorded by a runtime, in either the OCI spec's or libcontainer's format.
+type ociMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// ociState holds the mounts of a container's OCI config.json, or of runc's state.json below "config".
+type ociState struct {
+	Mounts []ociMount `json:"mounts"`
+	Config *ociState  `json:"config"`
+}
+
+// getRuntimeStatePaths returns, most specific first, the files where the container's runtime records its
+// mounts. The bundle containerd writes is the same for every runtime it starts through a v2 shim.
+func getRuntimeStatePaths(info types.ContainerJSON) []string {
+	runtime := "runc"
+
+	if info.HostConfig != nil && info.HostConfig.Runtime != "" {
+		runtime = info.HostConfig.Runtime
+	}
+
+	var paths []string
+
+	switch runtime {
+	case "runc", "io.containerd.runc.v2":
+		paths = append(paths, path.Join(ociStateDir, "docker/runtime-runc/moby", info.ID, "state.json"))
+	case "crun":
+		paths = append(paths, path.Join(ociStateDir, "crun", info.ID, "config.json"))
+	}
+
+	return append(paths, path.Join(ociStateDir, "containerd/io.containerd.runtime.v2.task/moby", info.ID, "config.json"))
+}
+
+// getOCIDevicePaths returns the devices mounted into the container according to its runtime's state
+// that Docker's inspect output does not list, e.g. mounts added by a runtime hook.
+func getOCIDevicePaths(info types.ContainerJSON) []string {
+	known := make(map[string]bool)
+
+	for _, mount := range info.Mounts {
+		known[mount.Source] = true
+	}
+
+	for _, statePath := range getRuntimeStatePaths(info) {
+		mounts, err := readOCIMounts(path.Join(rootPath, statePath))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("unable to read the runtime state of %s: %v\n", info.ID, err)
+			continue
+		}
+
+		var devicePaths []string
+
+		for _, mount := range mounts {
+			if known[mount.Source] || !isDeviceSource(mount.Source) {
+				continue
+			}
+
+			log.Printf("%s has a runtime mount for %s at %s missing from inspect\n", info.ID, mount.Source, mount.Destination)
+			devicePaths = append(devicePaths, path.Clean(mount.Source))
+		}
+
+		return devicePaths
+	}
+
+	return nil
+}
+
+// readOCIMounts reads the mounts of a runtime state file.
+func readOCIMounts(statePath string) ([]ociMount, error) {
+	content, err := os.ReadFile(statePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var state ociState
+
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("malformed %s: %v", statePath, err)
+	}
+
+	if state.Config != nil {
+		return state.Config.Mounts, nil
+	}
+
+	return state.Mounts, nil
+}
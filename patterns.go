@@ -0,0 +1,86 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// devicePatterns caches the compiled device path patterns, keyed by their source.
+var devicePatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// isDevicePattern reports whether a requested device is a regular expression, prefixed with ~, rather
+// than a path, e.g. ~^/dev/ttyUSB\d+$.
+func isDevicePattern(value string) bool {
+	return strings.HasPrefix(value, "~")
+}
+
+// compileDevicePattern compiles a ~ prefixed device pattern, or returns it from the cache.
+func compileDevicePattern(origin string, value string) (*regexp.Regexp, error) {
+	devicePatterns.Lock()
+	defer devicePatterns.Unlock()
+
+	if pattern, ok := devicePatterns.compiled[value]; ok {
+		return pattern, nil
+	}
+
+	pattern, err := regexp.Compile(strings.TrimPrefix(value, "~"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid device pattern %q in %s: %v", value, origin, err)
+	}
+
+	devicePatterns.compiled[value] = pattern
+	return pattern, nil
+}
+
+// validateDevicePatterns compiles every pattern among devices, returning the first that is invalid.
+func validateDevicePatterns(origin string, devices []string) error {
+	for _, device := range devices {
+		device = strings.TrimSpace(device)
+
+		if !isDevicePattern(device) {
+			continue
+		}
+
+		if _, err := compileDevicePattern(origin, device); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPatternDevicePaths walks deviceRoots for the device nodes whose path matches pattern.
+func getPatternDevicePaths(pattern *regexp.Regexp) []string {
+	var devicePaths []string
+
+	for _, root := range deviceRoots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			if info.Mode()&os.ModeDevice != 0 && pattern.MatchString(path) {
+				devicePaths = append(devicePaths, path)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return devicePaths
+}
@@ -0,0 +1,216 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// isPidVisible reports whether a host PID reported by Docker can be inspected through /proc, which is
+// not the case when the daemon runs in its own PID namespace.
+func isPidVisible(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+
+	return err == nil
+}
+
+// getContainerCGroupFromID locates a container's device cgroup from its ID through Docker's cgroup
+// naming convention, returning the cgroup version and its path on the host.
+func getContainerCGroupFromID(cli *client.Client, info types.ContainerJSON) (int, string, error) {
+	daemon, err := cli.Info(context.Background())
+
+	if err != nil {
+		return -1, "", err
+	}
+
+	var parent string
+
+	if info.HostConfig != nil {
+		parent = info.HostConfig.CgroupParent
+	}
+
+	var relativePath string
+
+	if daemon.CgroupDriver == "systemd" {
+		if parent == "" {
+			parent = "system.slice"
+		}
+
+		relativePath = path.Join(expandSlice(parent), "docker-"+info.ID+".scope")
+	} else {
+		if parent == "" {
+			parent = "/docker"
+		}
+
+		relativePath = path.Join("/", parent, info.ID)
+	}
+
+	// Only v1 nests the cgroup below the hierarchy of the devices controller.
+	for _, candidate := range []string{
+		path.Join(rootPath, "sys/fs/cgroup", relativePath),
+		path.Join(rootPath, "sys/fs/cgroup/devices", relativePath),
+	} {
+		if version, err := getCGroupPathVersion(candidate); err == nil {
+			return version, candidate, nil
+		}
+	}
+
+	return -1, "", fmt.Errorf("no device cgroup found for %s at %s", info.ID, relativePath)
+}
+
+// expandSlice turns a systemd slice name into its cgroup path, e.g. "a-b.slice" into "/a.slice/a-b.slice".
+func expandSlice(slice string) string {
+	name := strings.TrimSuffix(slice, ".slice")
+
+	if name == "" || name == "-" {
+		return "/"
+	}
+
+	var slicePath, prefix string
+
+	for _, component := range strings.Split(name, "-") {
+		prefix += component
+		slicePath += "/" + prefix + ".slice"
+		prefix += "-"
+	}
+
+	return slicePath
+}
+
+// resolveHostPath resolves the symlinks of a path below rootPath the way the host would, so an absolute
+// link target such as /sys/fs/cgroup/cpu,devices stays below rootPath rather than the daemon's root.
+func resolveHostPath(hostPath string) (string, error) {
+	if !isPathWithin(hostPath, rootPath) {
+		return hostPath, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(hostPath, rootPath), "/")
+	resolved := "/"
+
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(path.Join(rootPath, next))
+
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > 40 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", hostPath)
+		}
+
+		target, err := os.Readlink(path.Join(rootPath, next))
+
+		if err != nil {
+			return "", err
+		}
+
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return path.Join(rootPath, resolved), nil
+}
+
+// checkDevicesCGroup makes sure a cgroup v1 path is a cgroup of the devices controller before any
+// rule is written there, which a misresolved controller mount would not be.
+func checkDevicesCGroup(cgroupPath string, version int) error {
+	if version != 1 {
+		return nil
+	}
+
+	for _, name := range []string{"devices.allow", "devices.list"} {
+		if _, err := os.Stat(path.Join(cgroupPath, name)); err != nil {
+			return fmt.Errorf("%s is not a devices cgroup: %v", cgroupPath, err)
+		}
+	}
+
+	return nil
+}
+
+// hostSlices are the systemd units holding host processes, which a container's cgroup never is.
+var hostSlices = map[string]bool{"init.scope": true, "system.slice": true, "user.slice": true, "machine.slice": true}
+
+// checkHostCGroup refuses a cgroup that the container shares with the host, e.g. with
+// --cgroup-parent / or a runtime placing it in the root, as rules written there apply to host
+// processes too. DVD_ALLOW_HOST_CGROUP overrides it.
+func checkHostCGroup(cgroupPath string, version int) error {
+	reason := ""
+
+	if isCGroupRoot(cgroupPath, version) {
+		reason = "the root of the hierarchy"
+	} else if hostSlices[path.Base(cgroupPath)] {
+		reason = "the host's " + path.Base(cgroupPath)
+	} else if cgroupHasPid(cgroupPath, 1) {
+		reason = "the cgroup of the host's init process"
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	if allowHostCGroup {
+		log.Printf("WARNING: %s is %s, applying rules there as DVD_ALLOW_HOST_CGROUP is set\n", cgroupPath, reason)
+		return nil
+	}
+
+	return fmt.Errorf("ERROR: refusing to apply rules to %s, it is %s and shared with host processes; set DVD_ALLOW_HOST_CGROUP=1 to allow it", cgroupPath, reason)
+}
+
+// isCGroupRoot reports whether cgroupPath is the root of its hierarchy: only the root of a v1 hierarchy
+// has a release_agent, and only the root of a v2 one lacks cgroup.events.
+func isCGroupRoot(cgroupPath string, version int) bool {
+	if version == 1 {
+		_, err := os.Stat(path.Join(cgroupPath, "release_agent"))
+		return err == nil
+	}
+
+	_, err := os.Stat(path.Join(cgroupPath, "cgroup.events"))
+	return os.IsNotExist(err)
+}
+
+// getHostDevicesMountPoint returns where the host mounts the cgroup v1 devices controller, as listed in
+// the mounts of its init process, falling back to the usual /sys/fs/cgroup/devices.
+func getHostDevicesMountPoint() string {
+	if mountPoint, ok := scanCache.devicesMountPoint(); ok {
+		return mountPoint
+	}
+
+	mountPoint, err := cgroup.GetDevicesMountPoint("/proc/1/mounts")
+
+	if err != nil {
+		log.Printf("unable to find the host's devices controller mount, assuming /sys/fs/cgroup/devices: %v\n", err)
+		mountPoint = "/sys/fs/cgroup/devices"
+	}
+
+	scanCache.storeDevicesMountPoint(mountPoint)
+	return mountPoint
+}
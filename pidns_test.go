@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSymlinkedControllerMounts(t *testing.T) {
+	previous := rootPath
+	rootPath = t.TempDir()
+	t.Cleanup(func() { rootPath = previous })
+
+	combined := filepath.Join(rootPath, "sys/fs/cgroup/cpu,devices/docker/abc")
+
+	if err := os.MkdirAll(combined, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{
+		"sys/fs/cgroup/devices":  "cpu,devices",
+		"sys/fs/cgroup/absolute": "/sys/fs/cgroup/cpu,devices",
+		"sys/fs/cgroup/escaping": "../../../../../../sys/fs/cgroup/cpu,devices",
+		"sys/fs/cgroup/loop":     "loop2",
+		"sys/fs/cgroup/loop2":    "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(rootPath, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Absolute targets and ones climbing above the root resolve below rootPath, as on the host.
+	for _, link := range []string{"devices", "absolute", "escaping"} {
+		resolved, err := resolveHostPath(filepath.Join(rootPath, "sys/fs/cgroup", link, "docker/abc"))
+
+		if err != nil || resolved != combined {
+			t.Errorf("%s: resolved %q (%v), want %q", link, resolved, err, combined)
+		}
+	}
+
+	if resolved, err := resolveHostPath(filepath.Join(rootPath, "sys/fs/cgroup/loop/docker")); err == nil || !strings.Contains(err.Error(), "too many levels") {
+		t.Errorf("a symlink loop resolved to %q (%v)", resolved, err)
+	}
+
+	if _, err := resolveHostPath(filepath.Join(rootPath, "sys/fs/cgroup/devices/docker/def")); err == nil {
+		t.Error("a missing cgroup resolved")
+	}
+
+	// Paths outside rootPath are the daemon's own and left alone.
+	if resolved, err := resolveHostPath("/proc/1/root"); err != nil || resolved != "/proc/1/root" {
+		t.Errorf("a path outside rootPath resolved to %q (%v)", resolved, err)
+	}
+}
+
+func TestCheckDevicesCGroup(t *testing.T) {
+	cgroupPath := t.TempDir()
+
+	// A misresolved controller mount leads to a cgroup of another controller, without the devices files.
+	if err := checkDevicesCGroup(cgroupPath, 1); err == nil {
+		t.Error("a directory without devices files passed as a devices cgroup")
+	}
+
+	if err := checkDevicesCGroup(cgroupPath, 2); err != nil {
+		t.Errorf("a cgroup v2 path was checked for devices files: %v", err)
+	}
+
+	for _, name := range []string{"devices.allow", "devices.list"} {
+		if err := os.WriteFile(filepath.Join(cgroupPath, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := checkDevicesCGroup(cgroupPath, 1); err != nil {
+		t.Errorf("a devices cgroup failed the check: %v", err)
+	}
+}
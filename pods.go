@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Labels cri-dockerd sets on the containers it runs for Kubernetes pods. Pod annotations are only
+// kept on the pod's sandbox container, prefixed with annotation.
+const (
+	sandboxIDLabel        = "io.kubernetes.sandbox.id"
+	sandboxAnnotationTag  = "annotation."
+	kubernetesTypeLabel   = "io.kubernetes.docker.type"
+	kubernetesSandboxType = "podsandbox"
+)
+
+// getPodAnnotationSource returns the devices the pod of a container running under Kubernetes with
+// cri-dockerd requested through the DVD_POD_ANNOTATION annotation, e.g.
+// dvd.example.com/devices: "/dev/fuse,/dev/net/tun". Every container of the pod is granted them.
+func getPodAnnotationSource(ctx context.Context, cli *client.Client, info types.ContainerJSON) deviceSource {
+	source := deviceSource{layer: layerLabels}
+
+	if podAnnotation == "" || info.Config == nil {
+		return source
+	}
+
+	// The sandbox only runs the pause process.
+	if info.Config.Labels[kubernetesTypeLabel] == kubernetesSandboxType {
+		return source
+	}
+
+	sandboxID, ok := info.Config.Labels[sandboxIDLabel]
+
+	if !ok || sandboxID == "" {
+		return source
+	}
+
+	sandbox, err := cli.ContainerInspect(ctx, sandboxID)
+
+	if err != nil {
+		log.Printf("unable to read the pod annotations of %s from its sandbox %s: %v\n", info.ID, sandboxID, err)
+		return source
+	}
+
+	if sandbox.Config == nil {
+		return source
+	}
+
+	value, ok := sandbox.Config.Labels[sandboxAnnotationTag+podAnnotation]
+
+	if !ok {
+		return source
+	}
+
+	// Annotations are often written as YAML block scalars, so newlines separate devices too.
+	value = strings.NewReplacer("\n", ",", "\"", "", "'", "").Replace(value)
+
+	source.allow = getDevicePathList(info.ID, "pod annotation "+podAnnotation, value)
+	return source
+}
@@ -0,0 +1,177 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// daemonConfig is the layout of the DVD_CONFIG_FILE JSON file.
+type daemonConfig struct {
+	Compose  []composePolicy `json:"compose"`
+	Networks []networkPolicy `json:"networks"`
+	Users    []userPolicy    `json:"users"`
+}
+
+// composePolicy grants and denies devices to the containers of a compose project and/or service,
+// matched through the labels compose puts on every container it creates.
+type composePolicy struct {
+	Project string      `json:"project"`
+	Service string      `json:"service"`
+	Devices []string    `json:"devices"`
+	Deny    []string    `json:"deny"`
+	Access  accessValue `json:"access,omitempty"`
+}
+
+// userPolicy restricts a device, or every device below a directory, to containers running as one of
+// the listed users or as a member of one of the listed groups.
+type userPolicy struct {
+	Device string   `json:"device"`
+	UIDs   []uint32 `json:"uids"`
+	GIDs   []uint32 `json:"gids"`
+}
+
+// networkPolicy grants and denies devices to every container connected to a Docker network,
+// named either by its name or its ID.
+type networkPolicy struct {
+	Network string      `json:"network"`
+	Devices []string    `json:"devices"`
+	Deny    []string    `json:"deny"`
+	Access  accessValue `json:"access,omitempty"`
+}
+
+// config holds the policies loaded from configFile.
+var config daemonConfig
+
+// loadConfigFile reads configFile, if one is set, leaving the daemon without its policies when it is invalid.
+func loadConfigFile() {
+	if configFile == "" {
+		return
+	}
+
+	content, err := os.ReadFile(configFile)
+
+	if err != nil {
+		log.Printf("ignoring DVD_CONFIG_FILE: %v\n", err)
+		return
+	}
+
+	var loaded daemonConfig
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&loaded); err != nil {
+		log.Printf("ignoring invalid DVD_CONFIG_FILE %s: %v\n", configFile, err)
+		return
+	}
+
+	for i, policy := range loaded.Compose {
+		if policy.Project == "" && policy.Service == "" {
+			log.Printf("ignoring invalid DVD_CONFIG_FILE %s: compose policy %d matches neither a project nor a service\n", configFile, i)
+			return
+		}
+
+		if err := validateDevicePatterns(fmt.Sprintf("compose policy %d", i), append(policy.Devices, policy.Deny...)); err != nil {
+			log.Printf("ignoring invalid DVD_CONFIG_FILE %s: %v\n", configFile, err)
+			return
+		}
+	}
+
+	for i, policy := range loaded.Networks {
+		if policy.Network == "" {
+			log.Printf("ignoring invalid DVD_CONFIG_FILE %s: network policy %d names no network\n", configFile, i)
+			return
+		}
+
+		if err := validateDevicePatterns(fmt.Sprintf("network policy %d", i), append(policy.Devices, policy.Deny...)); err != nil {
+			log.Printf("ignoring invalid DVD_CONFIG_FILE %s: %v\n", configFile, err)
+			return
+		}
+	}
+
+	for i, policy := range loaded.Users {
+		if !path.IsAbs(policy.Device) {
+			log.Printf("ignoring invalid DVD_CONFIG_FILE %s: user policy %d names no absolute device path\n", configFile, i)
+			return
+		}
+
+		loaded.Users[i].Device = path.Clean(policy.Device)
+	}
+
+	config = loaded
+
+	log.Printf("Loaded %d compose, %d network and %d user policies from %s\n", len(config.Compose), len(config.Networks), len(config.Users), configFile)
+}
+
+// getComposeSource returns what the compose policies matching a container allow and deny. The devices
+// of a policy giving an access are allowed with it, rather than with the container's own.
+func getComposeSource(info types.ContainerJSON) deviceSource {
+	source := deviceSource{layer: layerPolicy}
+
+	if info.Config == nil {
+		return source
+	}
+
+	project := info.Config.Labels["com.docker.compose.project"]
+	service := info.Config.Labels["com.docker.compose.service"]
+
+	for _, policy := range config.Compose {
+		if (policy.Project != "" && policy.Project != project) || (policy.Service != "" && policy.Service != service) {
+			continue
+		}
+
+		origin := "compose policy for " + project + "/" + service + " in " + configFile
+		addPolicyDevices(&source, info.ID, origin, policy.Devices, policy.Deny, policy.Access)
+	}
+
+	return source
+}
+
+// getNetworkSource returns what the network policies matching any network the container is connected
+// to allow and deny, like getComposeSource.
+func getNetworkSource(info types.ContainerJSON) deviceSource {
+	source := deviceSource{layer: layerNetwork}
+
+	if info.NetworkSettings == nil {
+		return source
+	}
+
+	for _, policy := range config.Networks {
+		for name, endpoint := range info.NetworkSettings.Networks {
+			if policy.Network != name && (endpoint == nil || policy.Network != endpoint.NetworkID) {
+				continue
+			}
+
+			origin := "network policy for " + name + " in " + configFile
+			addPolicyDevices(&source, info.ID, origin, policy.Devices, policy.Deny, policy.Access)
+			break
+		}
+	}
+
+	return source
+}
+
+// addPolicyDevices adds the devices a policy allows and denies to source, those it allows with the
+// access of the policy when it gives one.
+func addPolicyDevices(source *deviceSource, id string, origin string, devices []string, deny []string, access accessValue) {
+	allowed := getDevicePathList(id, origin, strings.Join(devices, ","))
+
+	if access == "" {
+		source.allow = append(source.allow, allowed...)
+	} else {
+		for _, devicePath := range allowed {
+			source.devices = append(source.devices, hostDevice{path: devicePath, access: string(access)})
+		}
+	}
+
+	source.deny = append(source.deny, getDevicePathList(id, origin, strings.Join(deny, ","))...)
+}
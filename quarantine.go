@@ -0,0 +1,183 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"device-volume-driver/internal/cgroup"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// quarantineRecord keeps what a quarantined container had in effect before every device was denied.
+type quarantineRecord struct {
+	Since time.Time `json:"since"`
+
+	// Rules are the rules that were in effect for CgroupPath, in the order they are evaluated.
+	CgroupPath string              `json:"cgroupPath,omitempty"`
+	Rules      []cgroup.DeviceRule `json:"rules,omitempty"`
+}
+
+// denyAllRule denies every device.
+var denyAllRule = cgroup.DeviceRule{Type: "a", Access: "rwm", Allow: false}
+
+// quarantineCommand denies every device to a container, including those its runtime granted, until
+// unquarantine: quarantine <container>
+func quarantineCommand(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: quarantine <container>")
+	}
+
+	info, err := controlClient.ContainerInspect(context.Background(), args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The deny is written to the container's cgroup, which only exists while it runs.
+	if info.State == nil || !info.State.Running || info.State.Pid == 0 {
+		return nil, fmt.Errorf("%s is not running", info.ID)
+	}
+
+	processMu.Lock()
+
+	if !tracker.quarantine(info.ID) {
+		processMu.Unlock()
+		return nil, fmt.Errorf("%s is already quarantined", info.ID)
+	}
+
+	log.Printf("QUARANTINE: denying every device to %s\n", info.ID)
+
+	for _, grant := range tracker.grants(info.ID) {
+		if grant.Applied {
+			rule := grant.Rule
+			publish(eventRevoked, info.ID, grant.Path, &rule)
+		}
+	}
+
+	cancelRevocations(info.ID)
+	tracker.clearRules(info.ID)
+	processMu.Unlock()
+
+	// Processing applies the quarantine to the container's cgroup, recording where it did. When it
+	// could not, the quarantine is lifted again and the container's devices granted as before.
+	err = processContainerInto(controlClient, info.ID, &processSummary{})
+
+	if record := tracker.quarantineOf(info.ID); err == nil && (record == nil || record.CgroupPath == "") {
+		err = fmt.Errorf("the deny was not written")
+	}
+
+	if err != nil {
+		log.Printf("unable to quarantine %s, lifting its quarantine: %v\n", info.ID, err)
+
+		processMu.Lock()
+		tracker.unquarantine(info.ID)
+		processMu.Unlock()
+
+		processContainer(controlClient, info.ID)
+		return nil, fmt.Errorf("unable to quarantine %s: %v", info.ID, err)
+	}
+
+	saveState()
+	return "ok", nil
+}
+
+// unquarantineCommand restores the rules a container had before it was quarantined and grants its
+// devices again: unquarantine <container>
+func unquarantineCommand(args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: unquarantine <container>")
+	}
+
+	info, err := controlClient.ContainerInspect(context.Background(), args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	processMu.Lock()
+
+	record := tracker.unquarantine(info.ID)
+
+	if record == nil {
+		processMu.Unlock()
+		return nil, fmt.Errorf("%s is not quarantined", info.ID)
+	}
+
+	log.Printf("UNQUARANTINE: restoring the device rules of %s\n", info.ID)
+
+	err = restoreQuarantinedRules(info.ID, record)
+	processMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	processContainer(controlClient, info.ID)
+	saveState()
+	return "ok", nil
+}
+
+// enforceQuarantine denies every device to a quarantined container's cgroup, first recording the
+// rules in effect there when they haven't been for this cgroup, e.g. after the container restarted.
+func enforceQuarantine(target deviceTarget, record *quarantineRecord) error {
+	if record.CgroupPath != target.cgroupPath {
+		rules, err := target.api.ListDeviceRules(target.cgroupPath)
+
+		// Rules that cannot be decoded are not restored on release, but must not keep the denial from being written.
+		if errors.Is(err, cgroup.ErrUnknownDeviceFilter) {
+			log.Printf("WARNING: the rules of quarantined %s are unknown and will not be restored: %v\n", target.id, err)
+		} else if err != nil {
+			return fmt.Errorf("unable to record the rules of quarantined %s: %v", target.id, err)
+		}
+
+		tracker.updateQuarantine(target.id, target.cgroupPath, rules)
+	}
+
+	_, removed, err := target.api.Reconcile(target.cgroupPath, []cgroup.DeviceRule{denyAllRule})
+
+	if err != nil {
+		return err
+	}
+
+	if removed > 0 {
+		log.Printf("%s is quarantined, denied every device at %s\n", target.id, target.cgroupPath)
+		publish(eventDenied, target.id, "quarantine", &denyAllRule)
+	}
+
+	return nil
+}
+
+// restoreQuarantinedRules writes back the rules recorded when the quarantine was enforced, if the
+// container still runs in that cgroup. Rules are recorded in evaluation order, the first match
+// winning, and written in reverse as a later rule overrides an earlier one.
+func restoreQuarantinedRules(id string, record *quarantineRecord) error {
+	var container *trackedContainer
+
+	for _, tracked := range tracker.snapshot() {
+		if tracked.ID == id {
+			tracked := tracked
+			container = &tracked
+		}
+	}
+
+	if container == nil || record.CgroupPath != container.CgroupPath || len(record.Rules) == 0 {
+		return nil
+	}
+
+	api, err := cgroup.New(container.Version)
+
+	if err != nil {
+		return err
+	}
+
+	rules := make([]cgroup.DeviceRule, 0, len(record.Rules))
+
+	for i := len(record.Rules) - 1; i >= 0; i-- {
+		rules = append(rules, record.Rules[i])
+	}
+
+	return api.AddDeviceRules(container.CgroupPath, rules)
+}
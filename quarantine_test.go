@@ -0,0 +1,163 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineWhilePaused(t *testing.T) {
+	task := newTestTask(t)
+	info := runningContainer(containerID(1), task, nil, deviceMount("/dev/full"))
+	_, cli := newTestDocker(t, info)
+	resetTracking(t, info.ID)
+
+	previousClient := controlClient
+	controlClient = cli
+	grantsPaused.Store(true)
+	t.Cleanup(func() {
+		controlClient = previousClient
+		grantsPaused.Store(false)
+	})
+
+	if _, err := quarantineCommand([]string{info.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := task.devicesList(t); len(entries) != 0 {
+		t.Errorf("a quarantined container still has access to %v", entries)
+	}
+
+	if record := tracker.quarantineOf(info.ID); record == nil || record.CgroupPath != task.cgroupPath {
+		t.Errorf("the quarantine was not recorded for %s: %+v", task.cgroupPath, record)
+	}
+
+	if _, err := unquarantineCommand([]string{info.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := task.devicesList(t); len(entries) != 1 || entries[0] != "a *:* rwm" {
+		t.Errorf("unquarantining did not restore the rules in effect before: %v", entries)
+	}
+}
+
+func TestQuarantineOptedOut(t *testing.T) {
+	task := newTestTask(t)
+	info := runningContainer(containerID(2), task, nil, deviceMount("/dev/full"))
+	_, cli := newTestDocker(t, info)
+	resetTracking(t, info.ID)
+
+	previousClient, previousOptIn := controlClient, optIn
+	controlClient, optIn = cli, true
+	t.Cleanup(func() { controlClient, optIn = previousClient, previousOptIn })
+
+	if _, err := quarantineCommand([]string{info.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := task.devicesList(t); len(entries) != 0 {
+		t.Errorf("a quarantined container that did not opt in still has access to %v", entries)
+	}
+
+	// A rescan, e.g. after a restart of the daemon, enforces it again.
+	if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.allow"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.untrack(info.ID)
+	checkExistingContainers(cli, false)
+
+	if entries := task.devicesList(t); len(entries) != 0 {
+		t.Errorf("rescanning did not enforce the quarantine of a container that did not opt in: %v", entries)
+	}
+}
+
+func TestQuarantineStoppedContainer(t *testing.T) {
+	info := testContainer(nil, nil)
+	info.ID = containerID(3)
+	info.State.Running = false
+	_, cli := newTestDocker(t, info)
+	resetTracking(t, info.ID)
+
+	previousClient := controlClient
+	controlClient = cli
+	t.Cleanup(func() { controlClient = previousClient })
+
+	if _, err := quarantineCommand([]string{info.ID}); err == nil {
+		t.Error("quarantining a stopped container succeeded without denying anything")
+	}
+
+	if record := tracker.quarantineOf(info.ID); record != nil {
+		t.Errorf("a failed quarantine was recorded: %+v", record)
+	}
+}
+
+func TestQuarantineSurvivesUntracking(t *testing.T) {
+	previousFile := stateFile
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	t.Cleanup(func() { stateFile = previousFile })
+
+	stateWriter.Lock()
+	stateWriter.enabled, stateWriter.last = true, nil
+	stateWriter.Unlock()
+	t.Cleanup(func() {
+		stateWriter.Lock()
+		stateWriter.enabled, stateWriter.last = false, nil
+		stateWriter.Unlock()
+	})
+
+	resetTracking(t, "stopped")
+
+	// The container died, so it is no longer tracked, but stays quarantined until it is removed.
+	tracker.track("stopped", 1234, 1, "/sys/fs/cgroup/devices/stopped")
+	tracker.quarantine("stopped")
+	tracker.updateQuarantine("stopped", "/sys/fs/cgroup/devices/stopped", []cgroup.DeviceRule{{Type: "c", Major: Ptr[int64](1), Minor: Ptr[int64](3), Access: "rwm", Allow: true}})
+	tracker.untrack("stopped")
+	saveState()
+
+	// A restart starts from an empty tracker.
+	tracker.unquarantine("stopped")
+	restoreState()
+
+	record := tracker.quarantineOf("stopped")
+
+	if record == nil {
+		t.Fatal("the quarantine of a stopped container was lost across a restart")
+	}
+
+	if record.CgroupPath != "/sys/fs/cgroup/devices/stopped" || len(record.Rules) != 1 {
+		t.Errorf("the quarantine was restored as %+v", record)
+	}
+}
+
+func TestRestoreLegacyState(t *testing.T) {
+	previousFile := stateFile
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	t.Cleanup(func() { stateFile = previousFile })
+
+	legacy := `[{"id":"legacy","pid":1234,"version":1,"cgroupPath":"/sys/fs/cgroup/devices/legacy","grants":{},"processed":true,"quarantine":{"since":"2024-01-01T00:00:00Z"}}]`
+
+	if err := os.WriteFile(stateFile, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resetTracking(t, "legacy")
+	restoreState()
+	t.Cleanup(func() {
+		stateWriter.Lock()
+		stateWriter.enabled, stateWriter.last = false, nil
+		stateWriter.Unlock()
+	})
+
+	if tracker.quarantineOf("legacy") == nil {
+		t.Error("the quarantine of a state file written by an earlier version was not restored")
+	}
+
+	if !strings.Contains(strings.Join(reconciledContainers(), ","), "legacy") {
+		t.Error("the containers of a state file written by an earlier version were not restored")
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// reconcileContainers periodically reprocesses tracked containers so devices that show up
+// after start, or rules lost in between, are granted without waiting for another event.
+func reconcileContainers(cli *client.Client) {
+	if reconcileInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		forgetStoppedContainers(containers)
+
+		labels := make(map[string]map[string]string)
+
+		for _, container := range containers {
+			labels[container.ID] = container.Labels
+		}
+
+		for _, id := range reconciledContainers() {
+			if isReconciled(id, labels[id]) {
+				processContainer(cli, id)
+			}
+		}
+	}
+}
+
+// forgetStoppedContainers drops the tracking state of every container missing from the running
+// containers, e.g. one replaced by its restart policy while events were not being handled.
+func forgetStoppedContainers(containers []types.Container) {
+	running := make(map[string]bool)
+
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+
+	for _, id := range reconciledContainers() {
+		if !running[id] {
+			log.Printf("%s is no longer running, forgetting it\n", id)
+			forgetContainer(id)
+		}
+	}
+}
+
+// reconciledContainers returns the tracked containers along with those that only wait for a late device.
+func reconciledContainers() []string {
+	ids := tracker.ids()
+	seen := make(map[string]bool)
+
+	for _, id := range ids {
+		seen[id] = true
+	}
+
+	for _, id := range lateDeviceContainers() {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// isReconciled reports whether a container's rules are reapplied after it was first processed, which
+// its reconcile label can turn off with "once" for containers that manage their device rules themselves.
+func isReconciled(id string, labels map[string]string) bool {
+	switch value := labels[labelKey("reconcile")]; value {
+	case "", "always":
+		return true
+	case "once":
+		return false
+	default:
+		log.Printf("ignoring unknown %s label %q of %s, expected once or always\n", labelKey("reconcile"), value, id)
+		return true
+	}
+}
+
+// isEnabled reports whether a container is processed at all: with DVD_OPT_IN only those whose enable
+// label is true are, every container otherwise.
+func isEnabled(labels map[string]string) bool {
+	return !optIn || labels[labelKey("enable")] == "true"
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"log"
+)
+
+// repairDeviceRules compares what the tracker believes is in effect for the container against the
+// rules actually in effect and repairs whatever was altered from outside according to repairMode.
+// Incremental repair forgets the broken rules so the processing pass writes them again one by one;
+// a rebuild clears every known grant that is no longer desired and reapplies all known rules at once.
+func repairDeviceRules(target deviceTarget, requests []deviceRequest) error {
+	var known, broken []deviceRequest
+	var actual []cgroup.DeviceRule
+	listed := false
+
+	ordered := orderDeviceRequests(requests)
+	last := make(map[string]int)
+
+	for i, request := range ordered {
+		last[deviceKey(request.rule)] = i
+	}
+
+	for i, request := range ordered {
+		// A device both allowed and denied only ends up with the later rule in effect.
+		if last[deviceKey(request.rule)] != i {
+			continue
+		}
+
+		if request.rule.Allow && tracker.isGranted(target.id, target.cgroupPath, request.rule) && !tracker.isExpired(target.id, request.path) {
+			known = append(known, request)
+		} else if !request.rule.Allow && tracker.isDenied(target.id, target.cgroupPath, request.rule) {
+			known = append(known, request)
+		} else {
+			continue
+		}
+
+		// Listed lazily, as a container nothing was recorded for has nothing to repair.
+		if !listed {
+			rules, err := target.api.ListDeviceRules(target.cgroupPath)
+
+			if err != nil {
+				log.Printf("unable to check the rules of %s for external changes: %v\n", target.id, err)
+				return nil
+			}
+
+			actual, listed = rules, true
+		}
+
+		if request.rule.Allow && !cgroup.Allows(actual, request.rule) || !request.rule.Allow && !cgroup.Denies(actual, request.rule) {
+			broken = append(broken, request)
+		}
+	}
+
+	if len(broken) == 0 {
+		return nil
+	}
+
+	log.Printf("%d device rules of %s were altered externally, repairing them (%s)\n", len(broken), target.id, repairMode)
+
+	if repairMode != "rebuild" {
+		for _, request := range broken {
+			tracker.forgetRule(target.id, request.rule)
+		}
+
+		return nil
+	}
+
+	desired := make(map[string]bool)
+
+	for _, request := range known {
+		desired[ruleKey(request.rule)] = true
+	}
+
+	var rules []cgroup.DeviceRule
+
+	// On cgroup v1 every rule is a separate write, so denying a grant that is reapplied
+	// right after would briefly cut off a device in use. Only stale grants are cleared.
+	for _, grant := range tracker.grants(target.id) {
+		if !desired[ruleKey(grant.Rule)] {
+			rule := grant.Rule
+			rule.Allow = false
+			rules = append(rules, rule)
+			tracker.forgetRule(target.id, grant.Rule)
+		}
+	}
+
+	for _, request := range known {
+		rules = append(rules, request.rule)
+	}
+
+	if err := target.api.AddDeviceRules(target.cgroupPath, rules); err != nil {
+		return fmt.Errorf("unable to rebuild the %d device rules of %s: %v", len(rules), target.id, err)
+	}
+
+	target.summary.applied += len(known)
+
+	for _, request := range known {
+		rule := request.rule
+
+		if rule.Allow {
+			tracker.recordGrant(target.id, target.cgroupPath, request.path, rule, true)
+			publish(eventApplied, target.id, request.path, &rule)
+		} else {
+			tracker.recordDenial(target.id, target.cgroupPath, rule)
+			publish(eventDenied, target.id, request.path, &rule)
+		}
+	}
+
+	log.Printf("Rebuilt %d device rules of %s\n", len(rules), target.id)
+
+	return nil
+}
+
+// deviceKey identifies the device or devices a rule applies to, regardless of its access.
+func deviceKey(rule cgroup.DeviceRule) string {
+	rule.Access = ""
+	return ruleKey(rule)
+}
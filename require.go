@@ -0,0 +1,110 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// getRequiredDevices returns the devices the require label marks as required, e.g. dvd.require=/dev/kvm.
+// The label requests them as well.
+func getRequiredDevices(id string, labels map[string]string) []string {
+	var required []string
+
+	key := labelKey("require")
+
+	for _, value := range strings.Split(labels[key], ",") {
+		value = strings.TrimSpace(value)
+
+		if value == "" {
+			continue
+		}
+
+		devicePath, err := normalizeDevicePath("label "+key, value)
+
+		if err != nil {
+			log.Printf("ERROR: %s: %v\n", id, err)
+			requiredFailuresTotal.Inc()
+			continue
+		}
+
+		required = append(required, devicePath)
+	}
+
+	return required
+}
+
+// getRequiredFailure returns why a required device is not in effect for a container, or "" when its
+// rules were applied or already were in effect. A directory is required as a whole.
+func getRequiredFailure(summary *processSummary, devicePath string) string {
+	if _, err := os.Stat(devicePath); err != nil {
+		return err.Error()
+	}
+
+	granted := false
+
+	for _, result := range summary.devices {
+		if result.Path != devicePath && !isPathWithin(result.Path, devicePath) {
+			continue
+		}
+
+		switch {
+		case result.denied:
+			return fmt.Sprintf("%s is denied", result.Path)
+		case result.Result == "applied" || result.Result == "unchanged":
+			granted = true
+		default:
+			return fmt.Sprintf("%s %s: %s", result.Path, result.Result, result.Reason)
+		}
+	}
+
+	if !granted && summary.errors > 0 {
+		return "not granted, processing the container failed"
+	} else if !granted {
+		return "not requested"
+	}
+
+	return ""
+}
+
+// checkRequiredDevices fails loudly for every required device of a container that is not in effect
+// after a pass summarized in summary, and stops the container when DVD_REQUIRED_FAILURE is
+// stop-container. It reports whether any was missing. A quarantined container is denied its
+// required devices on purpose, so they aren't checked.
+func checkRequiredDevices(cli *client.Client, id string, labels map[string]string, summary *processSummary) bool {
+	if tracker.quarantineOf(id) != nil {
+		return false
+	}
+
+	failed := false
+
+	for _, devicePath := range getRequiredDevices(id, labels) {
+		reason := getRequiredFailure(summary, devicePath)
+
+		if reason == "" {
+			continue
+		}
+
+		summary.fail(fmt.Errorf("ERROR: required device %s is not available to %s: %s", devicePath, id, reason))
+		requiredFailuresTotal.Inc()
+		failed = true
+	}
+
+	if !failed || requiredFailure != "stop-container" {
+		return failed
+	}
+
+	log.Printf("ERROR: stopping %s as it is missing required devices\n", id)
+
+	if err := cli.ContainerStop(context.Background(), id, nil); err != nil {
+		log.Printf("ERROR: unable to stop %s: %v\n", id, err)
+	}
+
+	return failed
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGetRequiredDevices(t *testing.T) {
+	failures := testutil.ToFloat64(requiredFailuresTotal)
+
+	required := getRequiredDevices(containerID(175), map[string]string{"dvd.require": " /dev/kvm, ,/dev/dri/ ,/etc/passwd,dev/null"})
+
+	if want := []string{"/dev/kvm", "/dev/dri"}; !reflect.DeepEqual(required, want) {
+		t.Errorf("required %v, want %v", required, want)
+	}
+
+	// The paths outside /dev and the relative one are counted as failures.
+	if counted := testutil.ToFloat64(requiredFailuresTotal) - failures; counted != 2 {
+		t.Errorf("counted %v required failures, want 2", counted)
+	}
+
+	if required := getRequiredDevices(containerID(175), nil); len(required) != 0 {
+		t.Errorf("required %v without the label", required)
+	}
+}
+
+func TestGetRequiredFailure(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		path    string
+		summary processSummary
+		failed  bool
+	}{
+		{name: "applied", path: "/dev/null", summary: processSummary{devices: []deviceResult{{Path: "/dev/null", Result: "applied"}}}},
+		{name: "already in effect", path: "/dev/null", summary: processSummary{devices: []deviceResult{{Path: "/dev/null", Result: "unchanged"}}}},
+		{name: "denied", path: "/dev/null", summary: processSummary{devices: []deviceResult{{Path: "/dev/null", Result: "applied", denied: true}}}, failed: true},
+		{name: "skipped", path: "/dev/null", summary: processSummary{devices: []deviceResult{{Path: "/dev/null", Result: "skipped", Reason: "not allowed to the user"}}}, failed: true},
+		{name: "not requested", path: "/dev/null", summary: processSummary{devices: []deviceResult{{Path: "/dev/full", Result: "applied"}}}, failed: true},
+		{name: "failed pass", path: "/dev/null", summary: processSummary{errors: 1}, failed: true},
+		{name: "missing", path: "/dev/dvd-test-missing", summary: processSummary{devices: []deviceResult{{Path: "/dev/dvd-test-missing", Result: "applied"}}}, failed: true},
+		{name: "directory", path: "/dev", summary: processSummary{devices: []deviceResult{{Path: "/dev/null", Result: "applied"}, {Path: "/dev/full", Result: "unchanged"}}}},
+		{name: "directory with a failed node", path: "/dev", summary: processSummary{devices: []deviceResult{{Path: "/dev/null", Result: "applied"}, {Path: "/dev/full", Result: "failed", Reason: "EPERM"}}}, failed: true},
+	} {
+		summary := test.summary
+
+		if reason := getRequiredFailure(&summary, test.path); (reason != "") != test.failed {
+			t.Errorf("%s: failure %q, want failed = %v", test.name, reason, test.failed)
+		}
+	}
+}
+
+func TestRequiredDeviceMissing(t *testing.T) {
+	previous := requiredFailure
+	requiredFailure = "stop-container"
+	t.Cleanup(func() { requiredFailure = previous })
+
+	task := newTestTask(t)
+	info := runningContainer(containerID(176), task, map[string]string{"dvd.require": "/dev/dvd-test-missing"})
+	resetTracking(t, info.ID)
+	docker, cli := newTestDocker(t, info)
+
+	failures := testutil.ToFloat64(requiredFailuresTotal)
+	summary := &processSummary{}
+
+	// The missing device was the only request, which used to end the pass before the check.
+	if err := processContainerInto(cli, info.ID, summary); err == nil {
+		t.Error("processing a container missing its required device succeeded")
+	}
+
+	if counted := testutil.ToFloat64(requiredFailuresTotal) - failures; counted != 1 {
+		t.Errorf("counted %v required failures, want 1", counted)
+	}
+
+	if len(summary.failures) == 0 {
+		t.Error("the missing required device was not reported")
+	}
+
+	docker.Lock()
+	running := docker.containers[info.ID].State.Running
+	docker.Unlock()
+
+	if running {
+		t.Error("the container missing its required device was not stopped")
+	}
+}
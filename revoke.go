@@ -0,0 +1,168 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// grantsPaused stops all processing after revoke-all, so the rules just removed are not granted
+// again by the next event or reconcile pass.
+var grantsPaused atomic.Bool
+
+// revokeAllCommand removes every rule the daemon wrote itself from all tracked containers, leaving the
+// rules the runtime applied alone, and pauses further grants: revoke-all
+func revokeAllCommand(args []string) (any, error) {
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	grantsPaused.Store(true)
+	log.Printf("Revoking all device rules applied by the daemon, pausing further grants\n")
+
+	revoked := make(map[string]int)
+
+	var failed []string
+
+	for _, container := range tracker.snapshot() {
+		var grants []deviceGrant
+		var rules []cgroup.DeviceRule
+
+		for _, grant := range container.Grants {
+			if grant.Applied {
+				grants = append(grants, grant)
+				rules = append(rules, grant.Rule)
+			}
+		}
+
+		if len(rules) > 0 {
+			api, err := cgroup.New(container.Version)
+
+			if err == nil {
+				err = revokeRules(api, container.ID, container.CgroupPath, rules)
+			}
+
+			if err != nil {
+				log.Printf("unable to revoke the rules of %s: %v\n", container.ID, err)
+				failed = append(failed, container.ID)
+				continue
+			}
+
+			revoked[container.ID] = len(rules)
+
+			for _, grant := range grants {
+				grant := grant
+				publish(eventRevoked, container.ID, grant.Path, &grant.Rule)
+			}
+		}
+
+		cancelRevocations(container.ID)
+		tracker.untrack(container.ID)
+	}
+
+	saveState()
+
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("unable to revoke the rules of %d containers: %v", len(failed), failed)
+	}
+
+	return revoked, nil
+}
+
+// revokeExitedContainer removes the rules the daemon applied to a container that stopped, when its
+// cgroup outlives it, e.g. a persistent delegated slice on cgroup v2. A cgroup that was removed along
+// with the container needs nothing.
+func revokeExitedContainer(id string) {
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	for _, container := range tracker.snapshot() {
+		if container.ID != id {
+			continue
+		}
+
+		if _, err := os.Stat(container.CgroupPath); err != nil {
+			return
+		}
+
+		var grants []deviceGrant
+		var rules []cgroup.DeviceRule
+
+		for _, grant := range container.Grants {
+			if grant.Applied {
+				grants = append(grants, grant)
+				rules = append(rules, grant.Rule)
+			}
+		}
+
+		if len(rules) == 0 {
+			return
+		}
+
+		api, err := cgroup.New(container.Version)
+
+		if err == nil {
+			err = revokeRules(api, id, container.CgroupPath, rules)
+		}
+
+		if err != nil {
+			log.Printf("unable to revoke the rules of stopped %s: %v\n", id, err)
+			return
+		}
+
+		log.Printf("Revoked %d rules from stopped %s, its cgroup %s remains\n", len(rules), id, container.CgroupPath)
+
+		for _, grant := range grants {
+			grant := grant
+			publish(eventRevoked, id, grant.Path, &grant.Rule)
+		}
+	}
+}
+
+// resumeCommand lets the daemon grant devices again after revoke-all and reprocesses on the next pass.
+func resumeCommand(args []string) (any, error) {
+	grantsPaused.Store(false)
+	log.Printf("Resuming device grants\n")
+
+	return "ok", nil
+}
+
+// runCleanup asks the running daemon to revoke its rules through the control socket, for DVD_MODE=cleanup.
+func runCleanup() error {
+	conn, err := net.Dial("unix", controlSocketPath)
+
+	if err != nil {
+		return fmt.Errorf("unable to reach the daemon at %s: %v", controlSocketPath, err)
+	}
+
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, "revoke-all"); err != nil {
+		return err
+	}
+
+	var reply controlReply
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return err
+	}
+
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+
+	log.Printf("Revoked %v\n", reply.Result)
+	return nil
+}
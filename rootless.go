@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootlessCGroupPattern matches the cgroups of a user's systemd instance, below which rootless
+// Docker and Podman create their containers, e.g. /user.slice/user-1000.slice/user@1000.service/...
+var rootlessCGroupPattern = regexp.MustCompile(`^/user\.slice/user-(\d+)\.slice/`)
+
+// getRootlessCGroupPath returns the cgroup of a process of a rootless container, or an empty string
+// if it does not run below a user's slice. The path is taken as is from /proc/<pid>/cgroup instead of
+// being joined onto the container's cgroup mount, which only covers the system.slice layout.
+func getRootlessCGroupPath(api cgroup.Interface, version int, pid int) (string, error) {
+	if !detectRootless {
+		return "", nil
+	}
+
+	entry, err := api.GetDeviceCGroupRootPath("/", "/", pid)
+
+	if err != nil {
+		return "", err
+	}
+
+	match := rootlessCGroupPattern.FindStringSubmatch(entry)
+
+	if match == nil {
+		return "", nil
+	}
+
+	// systemd never delegates the v1 devices controller to a user, so the entry is the user's
+	// session rather than a cgroup of the container and granting there would reach all of it.
+	if version == 1 {
+		return "", fmt.Errorf("process %d runs rootless as user %s, whose systemd instance is not delegated the devices controller: nothing can be granted", pid, match[1])
+	}
+
+	log.Printf("Process %d runs rootless as user %s in %s\n", pid, match[1], entry)
+
+	return path.Join(rootPath, "sys/fs/cgroup", entry), nil
+}
+
+// checkCGroupWritable makes sure the daemon can change the cgroup at cgroupPath, which e.g. a rootless
+// container's cgroup may not allow when only some controllers are delegated.
+func checkCGroupWritable(cgroupPath string) error {
+	if err := unix.Access(cgroupPath, unix.W_OK); err != nil {
+		return fmt.Errorf("no write permission on the cgroup %s: %v", cgroupPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,319 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ruleKey identifies a device rule in the cgroup entry format, e.g. "c 189:0 rwm"
+func ruleKey(rule cgroup.DeviceRule) string {
+	major, minor := "*", "*"
+
+	if rule.Major != nil {
+		major = strconv.FormatInt(*rule.Major, 10)
+	}
+
+	if rule.Minor != nil {
+		minor = strconv.FormatInt(*rule.Minor, 10)
+	}
+
+	return fmt.Sprintf("%s %s:%s %s", rule.Type, major, minor, rule.Access)
+}
+
+// parseDeviceSpec parses a raw device rule of the form <type>:<major>:<minor>:<access>, e.g. c:189:0:rw
+func parseDeviceSpec(spec string) (cgroup.DeviceRule, error) {
+	parts := strings.Split(spec, ":")
+
+	if len(parts) != 4 {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed device spec %q: expected <type>:<major>:<minor>:<access>", spec)
+	}
+
+	deviceType := parts[0]
+
+	if deviceType != "a" && deviceType != "b" && deviceType != "c" {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed device spec %q: type must be one of a, b or c", spec)
+	}
+
+	major, err := strconv.ParseInt(parts[1], 10, 64)
+
+	if err != nil || major < 0 {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed device spec %q: invalid major %q", spec, parts[1])
+	}
+
+	minor, err := strconv.ParseInt(parts[2], 10, 64)
+
+	if err != nil || minor < 0 {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed device spec %q: invalid minor %q", spec, parts[2])
+	}
+
+	access := parts[3]
+
+	if err := validateAccess(access); err != nil {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed device spec %q: %v", spec, err)
+	}
+
+	return cgroup.DeviceRule{
+		Access: access,
+		Major:  Ptr[int64](major),
+		Minor:  Ptr[int64](minor),
+		Type:   deviceType,
+		Allow:  true,
+	}, nil
+}
+
+// parseCgroupRules parses a comma separated list of rules in the syntax of Docker's --device-cgroup-rule,
+// <type> <major>:<minor> <access> with '*' for any major or minor, e.g. "c 13:* rmw, b 8:0 r".
+func parseCgroupRules(value string) ([]cgroup.DeviceRule, error) {
+	var rules []cgroup.DeviceRule
+
+	for _, text := range strings.Split(value, ",") {
+		text = strings.TrimSpace(text)
+
+		if text == "" {
+			continue
+		}
+
+		rule, err := parseCgroupRule(text)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func parseCgroupRule(text string) (cgroup.DeviceRule, error) {
+	fields := strings.Fields(text)
+
+	if len(fields) != 3 {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: expected <type> <major>:<minor> <access>", text)
+	}
+
+	deviceType := fields[0]
+
+	if deviceType != "a" && deviceType != "b" && deviceType != "c" {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: type must be one of a, b or c", text)
+	}
+
+	rawMajor, rawMinor, found := strings.Cut(fields[1], ":")
+
+	if !found {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: expected <major>:<minor>, got %q", text, fields[1])
+	}
+
+	major, err := parseCgroupRuleNumber(rawMajor)
+
+	if err != nil {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: invalid major %q", text, rawMajor)
+	}
+
+	minor, err := parseCgroupRuleNumber(rawMinor)
+
+	if err != nil {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: invalid minor %q", text, rawMinor)
+	}
+
+	access := fields[2]
+
+	if len(access) > 3 {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: access %q has more than 3 characters", text, access)
+	}
+
+	if err := validateAccess(access); err != nil {
+		return cgroup.DeviceRule{}, fmt.Errorf("malformed cgroup rule %q: %v", text, err)
+	}
+
+	return cgroup.DeviceRule{
+		Access: access,
+		Major:  major,
+		Minor:  minor,
+		Type:   deviceType,
+		Allow:  true,
+	}, nil
+}
+
+// parseMajorGrants parses a comma separated list of <type>:<major>[:<access>] entries, e.g. "c:188, c:13:r",
+// into rules matching any minor of the major, with rwm access unless given.
+func parseMajorGrants(value string) ([]cgroup.DeviceRule, error) {
+	var rules []cgroup.DeviceRule
+
+	for _, text := range strings.Split(value, ",") {
+		text = strings.TrimSpace(text)
+
+		if text == "" {
+			continue
+		}
+
+		parts := strings.Split(text, ":")
+
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, fmt.Errorf("malformed major grant %q: expected <type>:<major>[:<access>]", text)
+		}
+
+		deviceType := parts[0]
+
+		if deviceType != "b" && deviceType != "c" {
+			return nil, fmt.Errorf("malformed major grant %q: type must be b or c", text)
+		}
+
+		major, err := strconv.ParseInt(parts[1], 10, 64)
+
+		if err != nil || major < 0 {
+			return nil, fmt.Errorf("malformed major grant %q: invalid major %q", text, parts[1])
+		}
+
+		access := "rwm"
+
+		if len(parts) == 3 {
+			access = parts[2]
+
+			if err := validateAccess(access); err != nil {
+				return nil, fmt.Errorf("malformed major grant %q: %v", text, err)
+			}
+		}
+
+		rules = append(rules, cgroup.DeviceRule{
+			Access: access,
+			Major:  Ptr[int64](major),
+			Type:   deviceType,
+			Allow:  true,
+		})
+	}
+
+	return rules, nil
+}
+
+// parseWildcardMinorMajors parses a comma separated list of <type>:<major> entries, e.g. "c:243, b:252",
+// ignoring invalid ones.
+func parseWildcardMinorMajors(value string) map[string]bool {
+	majors := make(map[string]bool)
+
+	for _, text := range strings.Split(value, ",") {
+		text = strings.TrimSpace(text)
+
+		if text == "" {
+			continue
+		}
+
+		deviceType, rawMajor, _ := strings.Cut(text, ":")
+		major, err := strconv.ParseInt(rawMajor, 10, 64)
+
+		if (deviceType != "b" && deviceType != "c") || err != nil || major < 0 {
+			log.Printf("ignoring invalid DVD_WILDCARD_MINOR_MAJORS entry %q, expected <type>:<major> with type b or c\n", text)
+			continue
+		}
+
+		majors[fmt.Sprintf("%s:%d", deviceType, major)] = true
+	}
+
+	return majors
+}
+
+// getRuleMinor returns the minor to grant a device with, nil for any minor when its major is listed
+// in DVD_WILDCARD_MINOR_MAJORS.
+func getRuleMinor(deviceType string, major int64, minor int64) *int64 {
+	if wildcardMinors[fmt.Sprintf("%s:%d", deviceType, major)] {
+		return nil
+	}
+
+	return Ptr[int64](minor)
+}
+
+// parseCgroupRuleNumber parses a major or minor of a cgroup rule, returning nil for the '*' wildcard.
+func parseCgroupRuleNumber(value string) (*int64, error) {
+	if value == "*" {
+		return nil, nil
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || number < 0 {
+		return nil, fmt.Errorf("invalid number %q", value)
+	}
+
+	return Ptr[int64](number), nil
+}
+
+func validateAccess(access string) error {
+	if access == "" {
+		return fmt.Errorf("empty access")
+	}
+
+	_, err := cgroup.ParseDeviceAccess(access)
+
+	return err
+}
+
+// accessValue is an access read from JSON, given either as a string, e.g. "rw", or in the structured
+// form of cgroup.DeviceAccess, e.g. {"read": true, "write": true}, as tools that express access as
+// flags write it. It holds the access string in "rwm" order either way.
+type accessValue string
+
+func (a *accessValue) UnmarshalJSON(data []byte) error {
+	var access string
+
+	if err := json.Unmarshal(data, &access); err != nil {
+		var structured cgroup.DeviceAccess
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&structured); err != nil {
+			return fmt.Errorf("invalid access %s: expected a string such as \"rw\" or an object of read, write and mknod flags", data)
+		}
+
+		access = structured.String()
+	}
+
+	if err := validateAccess(access); err != nil {
+		return fmt.Errorf("invalid access %s: %v", data, err)
+	}
+
+	parsed, _ := cgroup.ParseDeviceAccess(access)
+
+	*a = accessValue(parsed.String())
+	return nil
+}
+
+// parseIOLimits parses io.max style throttles such as "rbps=1048576 wiops=120", separated by spaces or commas.
+func parseIOLimits(value string) (map[string]uint64, error) {
+	limits := make(map[string]uint64)
+
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+		key, rawLimit, found := strings.Cut(field, "=")
+
+		if !found {
+			return nil, fmt.Errorf("malformed io limit %q: expected <key>=<value>", field)
+		}
+
+		switch key {
+		case "rbps", "wbps", "riops", "wiops":
+		default:
+			return nil, fmt.Errorf("unknown io limit %q: expected one of rbps, wbps, riops or wiops", key)
+		}
+
+		limit, err := strconv.ParseUint(rawLimit, 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("malformed io limit %q: invalid value %q", field, rawLimit)
+		}
+
+		limits[key] = limit
+	}
+
+	if len(limits) == 0 {
+		return nil, fmt.Errorf("no io limits set")
+	}
+
+	return limits, nil
+}
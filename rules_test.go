@@ -0,0 +1,159 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"golang.org/x/sys/unix"
+)
+
+func FuzzParseCgroupRule(f *testing.F) {
+	for _, seed := range []string{"c 13:* rmw", "b 8:0 r", "a *:* rwm", "c 1:3", "c 1:3 rwmx", "x 1:3 r", "c -1:3 r", "c 1: r", "c +5:*  m"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		rule, err := parseCgroupRule(text)
+
+		if err != nil {
+			return
+		}
+
+		if !strings.Contains("abc", rule.Type) || len(rule.Type) != 1 || validateAccess(rule.Access) != nil || !rule.Allow {
+			t.Fatalf("%q parsed to the invalid rule %+v", text, rule)
+		}
+
+		// The cgroup entry format of a rule is the syntax parsed, so it parses back to the same rule.
+		reparsed, err := parseCgroupRule(ruleKey(rule))
+
+		if err != nil {
+			t.Fatalf("%q parsed to %q, which doesn't parse: %v", text, ruleKey(rule), err)
+		}
+
+		if !reflect.DeepEqual(reparsed, rule) {
+			t.Fatalf("%q parsed to %+v, which parses back to %+v", text, rule, reparsed)
+		}
+	})
+}
+
+func FuzzParseDeviceSpec(f *testing.F) {
+	for _, seed := range []string{"c:189:0:rw", "b:8:0:r", "a:0:0:rwm", "c:189:0", "c:189:*:rw", "c:-1:0:rw", "c:1:3:", "c:1:3:rwq"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, spec string) {
+		rule, err := parseDeviceSpec(spec)
+
+		if err != nil {
+			return
+		}
+
+		if rule.Major == nil || rule.Minor == nil || *rule.Major < 0 || *rule.Minor < 0 || validateAccess(rule.Access) != nil {
+			t.Fatalf("%q parsed to the invalid rule %+v", spec, rule)
+		}
+
+		formatted := fmt.Sprintf("%s:%d:%d:%s", rule.Type, *rule.Major, *rule.Minor, rule.Access)
+		reparsed, err := parseDeviceSpec(formatted)
+
+		if err != nil || !reflect.DeepEqual(reparsed, rule) {
+			t.Fatalf("%q parsed to %+v, which formats to %q parsing back to %+v (%v)", spec, rule, formatted, reparsed, err)
+		}
+	})
+}
+
+func FuzzParseMajorGrants(f *testing.F) {
+	for _, seed := range []string{"c:188, c:13:r", "b:8", "a:1", "c:188:", "c:-5", ",,c:1:rwm,"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		rules, err := parseMajorGrants(value)
+
+		if err != nil {
+			return
+		}
+
+		for _, rule := range rules {
+			if (rule.Type != "b" && rule.Type != "c") || rule.Major == nil || *rule.Major < 0 || rule.Minor != nil || validateAccess(rule.Access) != nil {
+				t.Fatalf("%q parsed to the invalid rule %+v", value, rule)
+			}
+		}
+	})
+}
+
+func FuzzParseIOLimits(f *testing.F) {
+	for _, seed := range []string{"rbps=1048576 wiops=120", "rbps=1,wbps=2", "rbps", "rbps=-1", "xbps=1", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		limits, err := parseIOLimits(value)
+
+		if err != nil {
+			return
+		}
+
+		if len(limits) == 0 {
+			t.Fatalf("%q parsed to no limits without an error", value)
+		}
+
+		for key := range limits {
+			switch key {
+			case "rbps", "wbps", "riops", "wiops":
+			default:
+				t.Fatalf("%q parsed to the unknown limit %q", value, key)
+			}
+		}
+	})
+}
+
+func TestWildcardMinorRules(t *testing.T) {
+	previous := wildcardMinors
+	wildcardMinors = parseWildcardMinorMajors("c:240")
+	t.Cleanup(func() { wildcardMinors = previous })
+
+	task := newTestTask(t)
+
+	if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.deny"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes of a major listed in DVD_WILDCARD_MINOR_MAJORS and of one that isn't.
+	root := newDeviceRoot(t)
+	nodes := map[string]uint64{"wildcard": unix.Mkdev(240, 3), "specific": unix.Mkdev(241, 3)}
+
+	var mounts []types.MountPoint
+
+	for name, dev := range nodes {
+		node := filepath.Join(root, name)
+
+		if err := unix.Mknod(node, unix.S_IFCHR|0600, int(dev)); err != nil {
+			t.Skipf("unable to create device nodes: %v", err)
+		}
+
+		mounts = append(mounts, deviceMount(node))
+	}
+
+	info := runningContainer(containerID(261), task, map[string]string{"dvd.grant-major": "c:242:r"}, mounts...)
+	resetTracking(t, info.ID)
+	_, cli := newTestDocker(t, info)
+
+	if err := processContainer(cli, info.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := task.devicesList(t)
+	sort.Strings(entries)
+
+	if want := []string{"c 240:* rwm", "c 241:3 rwm", "c 242:* r"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("devices.list holds %v, want %v", entries, want)
+	}
+}
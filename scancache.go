@@ -0,0 +1,135 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// deviceScanCache shares what is found in /dev and sysfs between the containers of a reload pass,
+// which reprocesses every container at once and where many of them request the same device trees.
+// Devices are stat'ed, directories walked and stacked block devices read once per pass instead of
+// once per container. Outside of a pass it is inactive and every lookup goes to the filesystem.
+type deviceScanCache struct {
+	mu         sync.Mutex
+	active     bool
+	devices    map[string]cachedDevice
+	walks      map[string][]string
+	underlying map[string][]blockDevice
+	mountPoint string
+	hits       int
+}
+
+// cachedDevice is the outcome of looking up a device node.
+type cachedDevice struct {
+	deviceType string
+	major      int64
+	minor      int64
+	err        error
+}
+
+var scanCache = &deviceScanCache{}
+
+// withScanCache runs a reload pass with the scan cache active, and drops what it found afterwards.
+func withScanCache(pass func()) {
+	scanCache.mu.Lock()
+	scanCache.active = true
+	scanCache.devices = make(map[string]cachedDevice)
+	scanCache.walks = make(map[string][]string)
+	scanCache.underlying = make(map[string][]blockDevice)
+	scanCache.mountPoint = ""
+	scanCache.hits = 0
+	scanCache.mu.Unlock()
+
+	start := time.Now()
+	pass()
+
+	scanCache.mu.Lock()
+	defer scanCache.mu.Unlock()
+
+	log.Printf("Reload pass took %v, sharing %d scans of devices between containers\n", time.Since(start).Round(time.Millisecond), scanCache.hits)
+
+	scanCache.active = false
+	scanCache.devices, scanCache.walks, scanCache.underlying = nil, nil, nil
+}
+
+func (c *deviceScanCache) device(devicePath string) (cachedDevice, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	device, ok := c.devices[devicePath]
+	c.count(ok)
+	return device, ok
+}
+
+func (c *deviceScanCache) storeDevice(devicePath string, device cachedDevice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active {
+		c.devices[devicePath] = device
+	}
+}
+
+func (c *deviceScanCache) walked(directory string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths, ok := c.walks[directory]
+	c.count(ok)
+	return paths, ok
+}
+
+func (c *deviceScanCache) storeWalked(directory string, paths []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active {
+		c.walks[directory] = paths
+	}
+}
+
+func (c *deviceScanCache) underlyingDevices(key string) ([]blockDevice, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	devices, ok := c.underlying[key]
+	c.count(ok)
+	return devices, ok
+}
+
+func (c *deviceScanCache) storeUnderlying(key string, devices []blockDevice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active {
+		c.underlying[key] = devices
+	}
+}
+
+func (c *deviceScanCache) devicesMountPoint() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ok := c.mountPoint != ""
+	c.count(ok)
+	return c.mountPoint, ok
+}
+
+func (c *deviceScanCache) storeDevicesMountPoint(mountPoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active {
+		c.mountPoint = mountPoint
+	}
+}
+
+// count tallies the lookups answered from the cache. c.mu must be held.
+func (c *deviceScanCache) count(hit bool) {
+	if hit {
+		c.hits++
+	}
+}
@@ -0,0 +1,253 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// The layers device requests come from, highest precedence first. When several layers request the
+// same device, only the requests of the highest of them apply, so e.g. a label denying a device wins
+// over a compose policy granting it, and a mount on the command line wins over both, except that a
+// deny label carving a device out of a mount is sequenced with it by ruleOrder. The devices
+// environment variable usually comes from the image, so it ranks below what the operator configured.
+const (
+	layerContainer   = iota // mounts and --device, set when running the container
+	layerLabels             // labels, the devices file and the pod annotation of the container
+	layerPolicy             // compose policies of DVD_CONFIG_FILE matching the container
+	layerEnvironment        // the devices environment variable, DVD_DEVICES_ENV
+	layerNetwork            // network policies and the devices of network namespace peers
+	layerBaseline           // DVD_BASELINE_DEVICES, granted to every container
+)
+
+var layerNames = []string{"container", "labels", "policy", "environment", "network", "baseline"}
+
+// deviceSource is what one layer requests for a container: device paths to allow and deny, and rules
+// that don't come from a device path.
+type deviceSource struct {
+	layer   int
+	allow   []string
+	deny    []string
+	rules   []deviceRequest
+	devices []hostDevice
+}
+
+// hostDevice is a device passed with docker run --device, mounted read-only or allowed by a policy
+// giving an access, allowed with the access given there.
+type hostDevice struct {
+	path   string
+	access string
+}
+
+// getContainerDeviceSources returns the devices a container requested through its mounts, environment
+// and labels, along with those its compose and network policies allow or deny, layer by layer.
+func getContainerDeviceSources(info types.ContainerJSON, summary *processSummary) []deviceSource {
+	container := deviceSource{layer: layerContainer, devices: getHostDevices(info, summary)}
+
+	passed := make(map[string]bool)
+
+	for _, device := range container.devices {
+		passed[device.path] = true
+	}
+
+	for _, mount := range info.Mounts {
+		log.Printf(
+			"%s/%v requested a volume mount for %s at %s\n",
+			info.ID, info.State.Pid, mount.Source, mount.Destination,
+		)
+
+		// Mixed runtime setups can report Windows style sources, e.g. C:\dev or \\?\pipe\...
+		if !path.IsAbs(mount.Source) || strings.Contains(mount.Source, "\\") {
+			log.Printf("%s is not an absolute unix path... skipping\n", mount.Source)
+			summary.skip(mount.Source, "not an absolute unix path")
+			continue
+		}
+
+		if !isDeviceSource(mount.Source) {
+			log.Printf("%s is not a device... skipping\n", mount.Source)
+			summary.skip(mount.Source, "not below "+strings.Join(deviceRoots, ", "))
+			continue
+		}
+
+		// The access given with --device applies rather than that of a mount.
+		if passed[path.Clean(mount.Source)] {
+			log.Printf("%s is also passed with --device... skipping its mount\n", mount.Source)
+			continue
+		}
+
+		// A device mounted read-only is only granted read access, whatever its labels say.
+		if !mount.RW {
+			log.Printf("%s is mounted read-only, granting read access only\n", mount.Source)
+			container.devices = append(container.devices, hostDevice{path: path.Clean(mount.Source), access: "r"})
+			continue
+		}
+
+		container.allow = append(container.allow, mount.Source)
+	}
+
+	if ociFallback {
+		container.allow = append(container.allow, getOCIDevicePaths(info)...)
+	}
+
+	labels := deviceSource{layer: layerLabels}
+	environment := deviceSource{layer: layerEnvironment}
+
+	if info.Config != nil {
+		environment.allow = getEnvDevicePaths(info.ID, info.Config.Env)
+
+		if value, ok := info.Config.Labels[labelKey("devices", "allow")]; ok {
+			labels.allow = append(labels.allow, getDevicePathList(info.ID, "label "+labelKey("devices", "allow"), value)...)
+		}
+
+		if value, ok := info.Config.Labels[labelKey("devices", "deny")]; ok {
+			labels.deny = append(labels.deny, getDevicePathList(info.ID, "label "+labelKey("devices", "deny"), value)...)
+		}
+
+		if value, ok := info.Config.Labels[labelKey("require")]; ok {
+			labels.allow = append(labels.allow, getDevicePathList(info.ID, "label "+labelKey("require"), value)...)
+		}
+
+		if value, ok := info.Config.Labels[labelKey("usb")]; ok {
+			labels.allow = append(labels.allow, getUSBDevicePaths(info.ID, value)...)
+		}
+	}
+
+	if devicesFile != "" && info.State != nil && isPidVisible(info.State.Pid) {
+		labels.allow = append(labels.allow, getFileDevicePaths(info.ID, info.State.Pid)...)
+	}
+
+	labels.rules = append(getCgroupRuleRequests(info, summary), getMajorGrantRequests(info, summary)...)
+	labels.rules = append(labels.rules, getTunRequests(info, summary)...)
+
+	return []deviceSource{
+		container,
+		labels,
+		getComposeSource(info),
+		environment,
+		getNetworkSource(info),
+	}
+}
+
+// getHostDevices returns the devices passed with docker run --device, with the cgroup permissions given
+// there, rwm unless set.
+func getHostDevices(info types.ContainerJSON, summary *processSummary) []hostDevice {
+	if info.HostConfig == nil {
+		return nil
+	}
+
+	var devices []hostDevice
+
+	for _, device := range info.HostConfig.Devices {
+		access := device.CgroupPermissions
+
+		if access == "" {
+			access = "rwm"
+		}
+
+		if err := validateAccess(access); err != nil {
+			summary.fail(fmt.Errorf("invalid cgroup permissions of --device %s: %v", device.PathOnHost, err))
+			continue
+		}
+
+		if !path.IsAbs(device.PathOnHost) {
+			summary.skip(device.PathOnHost, "not an absolute unix path")
+			continue
+		}
+
+		log.Printf("%s requested %s with %s via --device\n", info.ID, device.PathOnHost, access)
+		devices = append(devices, hostDevice{path: path.Clean(device.PathOnHost), access: access})
+	}
+
+	return devices
+}
+
+// isEmptySources reports whether no layer requests anything.
+func isEmptySources(sources []deviceSource) bool {
+	for _, source := range sources {
+		if len(source.allow) > 0 || len(source.deny) > 0 || len(source.rules) > 0 || len(source.devices) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getEffectiveRequests resolves the requests of every layer and keeps, for each device, those of
+// the highest layer requesting it. Precedence compares the devices rules apply to exactly, so a
+// wildcard rule and a rule for a single device within it both apply, sequenced by ruleOrder.
+func getEffectiveRequests(target deviceTarget, sources []deviceSource) []deviceRequest {
+	var requests []deviceRequest
+	var layers []int
+
+	for _, source := range sources {
+		for _, devicePath := range source.allow {
+			for _, request := range getDeviceRequests(target, devicePath, true) {
+				requests, layers = append(requests, request), append(layers, source.layer)
+			}
+		}
+
+		for _, devicePath := range source.deny {
+			for _, request := range getDeviceRequests(target, devicePath, false) {
+				requests, layers = append(requests, request), append(layers, source.layer)
+			}
+		}
+
+		for _, request := range source.rules {
+			requests, layers = append(requests, request), append(layers, source.layer)
+		}
+
+		for _, device := range source.devices {
+			for _, request := range getDeviceRequests(target, device.path, true) {
+				request.rule.Access = device.access
+				requests, layers = append(requests, request), append(layers, source.layer)
+			}
+		}
+	}
+
+	highest := make(map[string]int)
+
+	for i, request := range requests {
+		key := deviceKey(request.rule)
+
+		if layer, ok := highest[key]; !ok || layers[i] < layer {
+			highest[key] = layers[i]
+		}
+	}
+
+	// A deny label carves a device out of the container's own requests, e.g. a node out of a /dev
+	// mount, so it is sequenced with them by ruleOrder rather than overridden by them.
+	for i, request := range requests {
+		if layers[i] == layerLabels && !request.rule.Allow && highest[deviceKey(request.rule)] == layerContainer {
+			layers[i] = layerContainer
+		}
+	}
+
+	var effective []deviceRequest
+
+	seen := make(map[string]bool)
+
+	for i, request := range requests {
+		if layer := highest[deviceKey(request.rule)]; layers[i] != layer {
+			log.Printf("%s: %s from the %s layer is overridden by the %s layer\n", target.id, request.path, layerNames[layers[i]], layerNames[layer])
+			continue
+		}
+
+		// A device requested several ways within a layer, e.g. as a mount and in the environment,
+		// gets its rule once.
+		key := fmt.Sprintf("%s %t", ruleKey(request.rule), request.rule.Allow)
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		effective = append(effective, request)
+	}
+
+	return effective
+}
@@ -0,0 +1,248 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// testContainer returns the inspected state of a running container with the given environment,
+// labels and mounts.
+func testContainer(env []string, labels map[string]string, mounts ...types.MountPoint) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         "test",
+			State:      &types.ContainerState{Running: true, Pid: 0},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{Env: env, Labels: labels},
+		Mounts: mounts,
+	}
+}
+
+// deviceMount returns a read-write bind mount of a device path.
+func deviceMount(devicePath string) types.MountPoint {
+	return types.MountPoint{Type: "bind", Source: devicePath, Destination: devicePath, RW: true}
+}
+
+// effectiveDevices resolves the requests of a container as processContainer does and returns, for
+// every device path a rule ends up applied for, whether the last of them allows it.
+func effectiveDevices(t *testing.T, info types.ContainerJSON) map[string]bool {
+	t.Helper()
+
+	summary := &processSummary{id: info.ID}
+	target := deviceTarget{id: info.ID, labels: info.Config.Labels, summary: summary}
+
+	effective := make(map[string]bool)
+
+	for _, request := range orderDeviceRequests(getEffectiveRequests(target, getContainerDeviceSources(info, summary))) {
+		effective[request.path] = request.rule.Allow
+	}
+
+	return effective
+}
+
+// setDeviceEnvKey sets deviceEnvKey for the duration of a test.
+func setDeviceEnvKey(t *testing.T, key string) {
+	previous := deviceEnvKey
+	deviceEnvKey = key
+	t.Cleanup(func() { deviceEnvKey = previous })
+}
+
+func TestEnvironmentDisabledByDefault(t *testing.T) {
+	setDeviceEnvKey(t, "")
+
+	effective := effectiveDevices(t, testContainer([]string{"DVD_DEVICES=/dev/full"}, nil))
+
+	if len(effective) != 0 {
+		t.Errorf("the devices environment variable was read while disabled: %v", effective)
+	}
+}
+
+func TestEnvironmentBelowLabelsAndPolicies(t *testing.T) {
+	setDeviceEnvKey(t, "DVD_DEVICES")
+
+	previous := config
+	config = daemonConfig{Compose: []composePolicy{{Project: "app", Deny: []string{"/dev/random"}}}}
+	t.Cleanup(func() { config = previous })
+
+	info := testContainer(
+		[]string{"DVD_DEVICES=/dev/null,/dev/full,/dev/random"},
+		map[string]string{"dvd.devices.deny": "/dev/full", "com.docker.compose.project": "app"},
+	)
+
+	effective := effectiveDevices(t, info)
+
+	for devicePath, want := range map[string]bool{"/dev/null": true, "/dev/full": false, "/dev/random": false} {
+		if allowed, ok := effective[devicePath]; !ok || allowed != want {
+			t.Errorf("%s: allowed = %v (applied %v), want %v", devicePath, allowed, ok, want)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	setDeviceEnvKey(t, "DVD_DEVICES")
+
+	previousConfig, previousOrder := config, ruleOrder
+	t.Cleanup(func() { config, ruleOrder = previousConfig, previousOrder })
+
+	for _, test := range []struct {
+		name    string
+		order   string
+		env     []string
+		labels  map[string]string
+		mounts  []types.MountPoint
+		devices []container.DeviceMapping
+		compose composePolicy
+		network networkPolicy
+		want    map[string]bool
+	}{
+		{
+			name:   "deny label carves a node out of a directory mount",
+			mounts: []types.MountPoint{deviceMount("/dev")},
+			labels: map[string]string{"dvd.devices.deny": "/dev/full"},
+			want:   map[string]bool{"/dev/full": false, "/dev/null": true},
+		},
+		{
+			name:   "deny label carves a mounted node out with deny-last",
+			mounts: []types.MountPoint{deviceMount("/dev/full")},
+			labels: map[string]string{"dvd.devices.deny": "/dev/full"},
+			want:   map[string]bool{"/dev/full": false},
+		},
+		{
+			name:   "mount wins over a deny label with deny-first",
+			order:  "deny-first",
+			mounts: []types.MountPoint{deviceMount("/dev/full")},
+			labels: map[string]string{"dvd.devices.deny": "/dev/full"},
+			want:   map[string]bool{"/dev/full": true},
+		},
+		{
+			name:    "deny label carves a device passed with --device out",
+			devices: []container.DeviceMapping{{PathOnHost: "/dev/full", PathInContainer: "/dev/full", CgroupPermissions: "rw"}},
+			labels:  map[string]string{"dvd.devices.deny": "/dev/full"},
+			want:    map[string]bool{"/dev/full": false},
+		},
+		{
+			name:    "mount wins over a policy deny",
+			mounts:  []types.MountPoint{deviceMount("/dev/full")},
+			compose: composePolicy{Project: "app", Deny: []string{"/dev/full"}},
+			want:    map[string]bool{"/dev/full": true},
+		},
+		{
+			name:    "label allow wins over a policy deny",
+			labels:  map[string]string{"dvd.devices.allow": "/dev/full"},
+			compose: composePolicy{Project: "app", Deny: []string{"/dev/full"}},
+			want:    map[string]bool{"/dev/full": true},
+		},
+		{
+			name:    "label deny wins over a policy allow",
+			labels:  map[string]string{"dvd.devices.deny": "/dev/full"},
+			compose: composePolicy{Project: "app", Devices: []string{"/dev/full", "/dev/null"}},
+			want:    map[string]bool{"/dev/full": false, "/dev/null": true},
+		},
+		{
+			name:   "label allow and deny are sequenced with deny-first",
+			order:  "deny-first",
+			labels: map[string]string{"dvd.devices.allow": "/dev/full", "dvd.devices.deny": "/dev/full"},
+			want:   map[string]bool{"/dev/full": true},
+		},
+		{
+			name:    "policy deny wins over the environment",
+			env:     []string{"DVD_DEVICES=/dev/full,/dev/null"},
+			compose: composePolicy{Project: "app", Deny: []string{"/dev/full"}},
+			want:    map[string]bool{"/dev/full": false, "/dev/null": true},
+		},
+		{
+			name:    "environment wins over a network deny",
+			env:     []string{"DVD_DEVICES=/dev/full"},
+			network: networkPolicy{Network: "lan", Deny: []string{"/dev/full"}},
+			want:    map[string]bool{"/dev/full": true},
+		},
+		{
+			name:    "policy deny wins over a network allow",
+			compose: composePolicy{Project: "app", Deny: []string{"/dev/full"}},
+			network: networkPolicy{Network: "lan", Devices: []string{"/dev/full", "/dev/random"}},
+			want:    map[string]bool{"/dev/full": false, "/dev/random": true},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ruleOrder = test.order
+			if ruleOrder == "" {
+				ruleOrder = "deny-last"
+			}
+
+			config = daemonConfig{Compose: []composePolicy{test.compose}, Networks: []networkPolicy{test.network}}
+
+			labels := map[string]string{"com.docker.compose.project": "app"}
+			for key, value := range test.labels {
+				labels[key] = value
+			}
+
+			info := testContainer(test.env, labels, test.mounts...)
+			info.HostConfig.Devices = test.devices
+			info.NetworkSettings = &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{"lan": {NetworkID: "lan"}}}
+
+			effective := effectiveDevices(t, info)
+
+			for devicePath, want := range test.want {
+				if allowed, ok := effective[devicePath]; !ok || allowed != want {
+					t.Errorf("%s: allowed = %v (applied %v), want %v", devicePath, allowed, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyAccess(t *testing.T) {
+	previousConfig, previousFile := config, configFile
+	t.Cleanup(func() { config, configFile = previousConfig, previousFile })
+
+	configFile = filepath.Join(t.TempDir(), "config.json")
+	content := `{
+		"compose": [{"project": "app", "devices": ["/dev/null"], "access": {"read": true, "write": false, "mknod": false}}],
+		"networks": [{"network": "lan", "devices": ["/dev/full", "/dev/zero"], "access": "wr"}, {"network": "lan", "devices": ["/dev/random"]}]
+	}`
+
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loadConfigFile()
+
+	info := testContainer(nil, map[string]string{"com.docker.compose.project": "app"})
+	info.NetworkSettings = &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{"lan": {NetworkID: "lan"}}}
+
+	summary := &processSummary{id: info.ID}
+	target := deviceTarget{id: info.ID, labels: info.Config.Labels, summary: summary}
+	access := make(map[string]string)
+
+	for _, request := range getEffectiveRequests(target, getContainerDeviceSources(info, summary)) {
+		access[request.path] = request.rule.Access
+	}
+
+	for devicePath, want := range map[string]string{"/dev/null": "r", "/dev/full": "rw", "/dev/zero": "rw", "/dev/random": "rwm"} {
+		if access[devicePath] != want {
+			t.Errorf("%s: access = %q, want %q", devicePath, access[devicePath], want)
+		}
+	}
+
+	// A policy whose structured access grants nothing, or names unknown flags, invalidates the file.
+	for _, access := range []string{`{"read": false}`, `{"read": true, "execute": true}`, `"rx"`, `7`} {
+		config = daemonConfig{}
+		content := `{"compose": [{"project": "app", "devices": ["/dev/null"], "access": ` + access + `}]}`
+
+		if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if loadConfigFile(); len(config.Compose) != 0 {
+			t.Errorf("loaded a compose policy with the access %s", access)
+		}
+	}
+}
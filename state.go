@@ -0,0 +1,164 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"device-volume-driver/internal/cgroup"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateWriter serializes writes of the state file and remembers the last content written, so
+// passes that change nothing don't rewrite it. It is only enabled once restoreState ran, which keeps
+// oneshot runs from overwriting the state of the daemon.
+var stateWriter = struct {
+	sync.Mutex
+	enabled bool
+	last    []byte
+}{}
+
+// savedState is the layout of stateFile. Quarantines are kept apart from the tracked containers, as
+// they outlast the tracking of a container that stopped. Earlier versions wrote Containers alone.
+type savedState struct {
+	Containers  []trackedStatus             `json:"containers"`
+	Quarantines map[string]quarantineRecord `json:"quarantines,omitempty"`
+}
+
+// saveState writes the tracking state to stateFile, replacing it atomically.
+func saveState() {
+	stateWriter.Lock()
+	enabled := stateWriter.enabled
+	stateWriter.Unlock()
+
+	if !enabled {
+		return
+	}
+
+	content, err := json.Marshal(savedState{Containers: trackedContainers(), Quarantines: tracker.quarantined()})
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	stateWriter.Lock()
+	defer stateWriter.Unlock()
+
+	if bytes.Equal(content, stateWriter.last) {
+		return
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(stateFile), filepath.Base(stateFile)+".*")
+
+	if err != nil {
+		log.Printf("unable to save state: %v\n", err)
+		return
+	}
+
+	defer os.Remove(temporary.Name())
+
+	_, err = temporary.Write(content)
+
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(temporary.Name(), stateFile)
+	}
+
+	if err != nil {
+		log.Printf("unable to save state: %v\n", err)
+		return
+	}
+
+	stateWriter.last = content
+}
+
+// restoreState loads the tracking state a previous run saved to stateFile, so the provenance of its
+// rules and its pending TTL revocations survive a restart. The initial scan then reconciles it with
+// the running containers. A missing or unreadable file leaves the daemon to rebuild its state from
+// that scan alone.
+func restoreState() {
+	if stateFile == "" {
+		return
+	}
+
+	stateWriter.Lock()
+	stateWriter.enabled = true
+	stateWriter.Unlock()
+
+	content, err := os.ReadFile(stateFile)
+
+	if os.IsNotExist(err) {
+		return
+	}
+
+	if err != nil {
+		log.Printf("ignoring state file: %v\n", err)
+		return
+	}
+
+	var state savedState
+
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(content, &state.Containers)
+	} else {
+		err = json.Unmarshal(content, &state)
+	}
+
+	if err != nil {
+		log.Printf("ignoring corrupt state file %s, rescanning instead: %v\n", stateFile, err)
+		return
+	}
+
+	statuses := state.Containers
+
+	for id, record := range state.Quarantines {
+		tracker.restoreQuarantine(id, record)
+	}
+
+	for _, status := range statuses {
+		container := status.trackedContainer
+
+		if container.ID == "" || container.Grants == nil {
+			log.Printf("ignoring corrupt state file %s, rescanning instead: incomplete container entry\n", stateFile)
+			tracker.reset()
+			return
+		}
+
+		tracker.restore(container)
+
+		if _, ok := state.Quarantines[container.ID]; !ok && status.Quarantine != nil {
+			tracker.restoreQuarantine(container.ID, *status.Quarantine)
+		}
+
+		api, err := cgroup.New(container.Version)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		target := deviceTarget{id: container.ID, pid: container.Pid, api: api, cgroupPath: container.CgroupPath}
+
+		for devicePath, deadline := range status.Revocations {
+			for _, grant := range container.Grants {
+				if grant.Path == devicePath {
+					scheduleRevocation(target, devicePath, grant.Rule, time.Until(deadline))
+				}
+			}
+		}
+	}
+
+	stateWriter.Lock()
+	stateWriter.last = content
+	stateWriter.Unlock()
+
+	log.Printf("Restored the state of %d containers from %s\n", len(statuses), stateFile)
+}
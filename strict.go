@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/docker/docker/client"
+)
+
+// checkStrictSetup makes sure the cgroup version and driver are known without any guessing, so a strict
+// daemon stops at startup instead of writing rules to paths that might be wrong.
+func checkStrictSetup(cli *client.Client) error {
+	version, err := cgroup.GetDeviceCGroupVersion("/", os.Getpid())
+
+	if err != nil {
+		return fmt.Errorf("unable to determine the cgroup version from /proc/%d/cgroup: %v", os.Getpid(), err)
+	}
+
+	daemon, err := cli.Info(context.Background())
+
+	if err != nil {
+		return fmt.Errorf("unable to ask dockerd for its cgroup driver: %v", err)
+	}
+
+	switch daemon.CgroupDriver {
+	case "cgroupfs", "systemd":
+	default:
+		return fmt.Errorf("dockerd reports unknown cgroup driver %q, expected cgroupfs or systemd", daemon.CgroupDriver)
+	}
+
+	if daemon.CgroupVersion != "" && daemon.CgroupVersion != strconv.Itoa(version) {
+		return fmt.Errorf("dockerd reports cgroup v%s but /proc/%d/cgroup indicates v%d", daemon.CgroupVersion, os.Getpid(), version)
+	}
+
+	sysfsPath := path.Join(rootPath, "sys/fs/cgroup")
+
+	if version == 1 {
+		sysfsPath = path.Join(sysfsPath, "devices")
+	}
+
+	if info, err := os.Stat(sysfsPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("cgroup v%d hierarchy not found at %s, is /sys mounted at %s/sys? %v", version, sysfsPath, rootPath, err)
+	}
+
+	return nil
+}
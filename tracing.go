@@ -0,0 +1,107 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the processing spans. Until setupTracing installs an exporter it is a no-op.
+var tracer = otel.Tracer("device-volume-driver")
+
+// tracerProvider batches the spans of tracer for export once setupTracing installed it.
+var tracerProvider *sdktrace.TracerProvider
+
+// tracingShutdownTimeout bounds how long shutting down waits for the remaining spans to be exported.
+const tracingShutdownTimeout = 5 * time.Second
+
+// setupTracing exports spans over OTLP/HTTP to otlpEndpoint, e.g. http://collector:4318.
+func setupTracing() {
+	if otlpEndpoint == "" {
+		return
+	}
+
+	endpoint, err := url.Parse(otlpEndpoint)
+
+	if err != nil || endpoint.Host == "" {
+		log.Printf("ignoring invalid DVD_OTLP_ENDPOINT %q, expected e.g. http://collector:4318\n", otlpEndpoint)
+		return
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+
+	if err != nil {
+		log.Printf("Unable to set up tracing, spans will not be exported: %v\n", err)
+		return
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "device-mapping-manager"))),
+	)
+
+	otel.SetTracerProvider(provider)
+	tracer, tracerProvider = provider.Tracer("device-volume-driver"), provider
+
+	log.Printf("Exporting traces to %s\n", otlpEndpoint)
+}
+
+// shutdownTracing exports the spans still batched, as the daemon exits, waiting at most
+// tracingShutdownTimeout for the collector.
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("unable to export the remaining spans: %v\n", err)
+	}
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// startWriteSpan starts the span of a cgroup write for a request below the target's processing span.
+func startWriteSpan(target deviceTarget, request deviceRequest) (context.Context, trace.Span) {
+	ctx := target.ctx
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return tracer.Start(ctx, "cgroup write", trace.WithAttributes(
+		attribute.String("device.path", request.path),
+		attribute.String("device.rule", ruleKey(request.rule)),
+	))
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// recordingExporter keeps the names of the spans exported to it, also after it was shut down.
+type recordingExporter struct {
+	sync.Mutex
+	names []string
+}
+
+func (e *recordingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, span := range spans {
+		e.names = append(e.names, span.Name())
+	}
+
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (e *recordingExporter) exported() []string {
+	e.Lock()
+	defer e.Unlock()
+
+	return append([]string(nil), e.names...)
+}
+
+func TestShutdownTracingExportsBatchedSpans(t *testing.T) {
+	exporter := &recordingExporter{}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+
+	previousTracer, previousProvider := tracer, tracerProvider
+	tracer, tracerProvider = provider.Tracer("device-volume-driver"), provider
+	t.Cleanup(func() { tracer, tracerProvider = previousTracer, previousProvider })
+
+	_, span := tracer.Start(context.Background(), "processContainer")
+	span.End()
+
+	// The batcher holds the span until its next export, long after the daemon would have exited.
+	if exported := exporter.exported(); len(exported) != 0 {
+		t.Fatalf("%v were exported before shutting down", exported)
+	}
+
+	shutdownTracing()
+
+	if exported := exporter.exported(); len(exported) != 1 || exported[0] != "processContainer" {
+		t.Errorf("shutting down exported %v, want the processContainer span", exported)
+	}
+}
@@ -0,0 +1,575 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"sort"
+	"sync"
+	"time"
+)
+
+// trackedContainer records what the daemon granted to a container's cgroup.
+type trackedContainer struct {
+	ID         string                 `json:"id"`
+	Pid        int                    `json:"pid"`
+	Version    int                    `json:"version"`
+	CgroupPath string                 `json:"cgroupPath"`
+	Grants     map[string]deviceGrant `json:"grants"`
+	Denials    map[string]time.Time   `json:"denials,omitempty"`
+	Drift      []deviceGrant          `json:"drift,omitempty"`
+	Expired    map[string]time.Time   `json:"expired,omitempty"`
+	Errors     []trackedError         `json:"errors,omitempty"`
+	Mounts     []string               `json:"mounts,omitempty"`
+
+	// Baseline holds the rules in effect before the daemon first wrote to the cgroup. It is nil until
+	// they were recorded, which may find none.
+	Baseline []cgroup.DeviceRule `json:"baseline"`
+
+	// processed is set once the container has been fully processed, after which any new
+	// grant means its devices drifted away from what was granted.
+	processed bool
+}
+
+type trackedError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// maxTrackedErrors bounds how many recent errors are kept per container.
+const maxTrackedErrors = 5
+
+type deviceGrant struct {
+	Path string            `json:"path"`
+	Rule cgroup.DeviceRule `json:"rule"`
+	Time time.Time         `json:"time"`
+
+	// Applied is set when the daemon wrote the rule itself rather than finding it in effect.
+	Applied bool `json:"applied"`
+}
+
+// forgetContainer revokes what was granted to a container that stopped or was removed, if its cgroup
+// remains, and drops all state kept for it.
+func forgetContainer(id string) {
+	revokeExitedContainer(id)
+	cancelRevocations(id)
+	forgetLateDevices(id)
+	unwatchContainerDevices(id)
+	forgetAppearedDevices(id)
+	tracker.untrack(id)
+	publish(eventContainerGone, id, "", nil)
+	saveState()
+}
+
+type containerTracker struct {
+	mu         sync.Mutex
+	containers map[string]*trackedContainer
+
+	// quarantines are kept by container ID apart from the containers, so they outlast restarts.
+	quarantines map[string]*quarantineRecord
+}
+
+var tracker = &containerTracker{
+	containers:  make(map[string]*trackedContainer),
+	quarantines: make(map[string]*quarantineRecord),
+}
+
+// track starts tracking a container, forgetting its grants if it now runs in a different cgroup.
+// It reports whether an already tracked container was found to have moved.
+func (t *containerTracker) track(id string, pid int, version int, cgroupPath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.containers[id]
+	moved := ok && (container.Pid != pid || container.CgroupPath != cgroupPath)
+
+	if !ok || moved {
+		t.containers[id] = &trackedContainer{
+			ID:         id,
+			Pid:        pid,
+			Version:    version,
+			CgroupPath: cgroupPath,
+			Grants:     make(map[string]deviceGrant),
+			Denials:    make(map[string]time.Time),
+			Expired:    make(map[string]time.Time),
+		}
+	}
+
+	return moved
+}
+
+// markProcessed records that a processing pass over the container has finished.
+func (t *containerTracker) markProcessed(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if container, ok := t.containers[id]; ok {
+		container.processed = true
+	}
+}
+
+// lookup returns a tracked container if it still runs in cgroupPath. Grants and denials are recorded per
+// container cgroup, as containers sharing a device may each be granted different access to it.
+func (t *containerTracker) lookup(id string, cgroupPath string) (*trackedContainer, bool) {
+	container, ok := t.containers[id]
+
+	if !ok || container.CgroupPath != cgroupPath {
+		return nil, false
+	}
+
+	return container, true
+}
+
+// isTracked reports whether a container is tracked as running in cgroupPath.
+func (t *containerTracker) isTracked(id string, cgroupPath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.lookup(id, cgroupPath)
+	return ok
+}
+
+func (t *containerTracker) isGranted(id string, cgroupPath string, rule cgroup.DeviceRule) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.lookup(id, cgroupPath)
+
+	if !ok {
+		return false
+	}
+
+	_, granted := container.Grants[ruleKey(rule)]
+	return granted
+}
+
+// recordGrant stores a rule in effect for the container and reports whether writing it closed a drift.
+func (t *containerTracker) recordGrant(id string, cgroupPath string, devicePath string, rule cgroup.DeviceRule, written bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.lookup(id, cgroupPath)
+
+	if !ok {
+		return false
+	}
+
+	grant := deviceGrant{Path: devicePath, Rule: rule, Time: time.Now(), Applied: written}
+	container.Grants[ruleKey(rule)] = grant
+
+	if container.processed && written {
+		container.Drift = append(container.Drift, grant)
+		return true
+	}
+
+	return false
+}
+
+// forgetRule drops a grant or denial so the next processing pass writes the rule again.
+func (t *containerTracker) forgetRule(id string, rule cgroup.DeviceRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if container, ok := t.containers[id]; ok {
+		delete(container.Grants, ruleKey(rule))
+		delete(container.Denials, ruleKey(rule))
+	}
+}
+
+// updateMounts records the device mount sources of a container and returns those that it had the last
+// time it was processed but no longer has.
+func (t *containerTracker) updateMounts(id string, sources []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.containers[id]
+
+	if !ok {
+		return nil
+	}
+
+	current := make(map[string]bool)
+
+	for _, source := range sources {
+		current[source] = true
+	}
+
+	var removed []string
+
+	for _, source := range container.Mounts {
+		if !current[source] {
+			removed = append(removed, source)
+		}
+	}
+
+	container.Mounts = sources
+	return removed
+}
+
+// clearRules forgets every grant and denial of a container.
+func (t *containerTracker) clearRules(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if container, ok := t.containers[id]; ok {
+		container.Grants = make(map[string]deviceGrant)
+		container.Denials = make(map[string]time.Time)
+	}
+}
+
+// hasBaseline reports whether the pre-existing rules of a container's cgroup were recorded.
+func (t *containerTracker) hasBaseline(id string, cgroupPath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.lookup(id, cgroupPath)
+	return ok && container.Baseline != nil
+}
+
+// setBaseline records the pre-existing rules of a container's cgroup.
+func (t *containerTracker) setBaseline(id string, cgroupPath string, rules []cgroup.DeviceRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if container, ok := t.lookup(id, cgroupPath); ok {
+		container.Baseline = append([]cgroup.DeviceRule{}, rules...)
+	}
+}
+
+// baseline returns the pre-existing rules of a container's cgroup, in the order they are evaluated.
+func (t *containerTracker) baseline(id string, cgroupPath string) []cgroup.DeviceRule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.lookup(id, cgroupPath)
+
+	if !ok {
+		return nil
+	}
+
+	return append([]cgroup.DeviceRule(nil), container.Baseline...)
+}
+
+// quarantine marks a container as quarantined, reporting false if it already was.
+func (t *containerTracker) quarantine(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.quarantines[id]; ok {
+		return false
+	}
+
+	t.quarantines[id] = &quarantineRecord{Since: time.Now()}
+	return true
+}
+
+// quarantineOf returns a copy of the quarantine of a container, or nil if it is not quarantined.
+func (t *containerTracker) quarantineOf(id string) *quarantineRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, ok := t.quarantines[id]
+
+	if !ok {
+		return nil
+	}
+
+	c := *record
+	c.Rules = append([]cgroup.DeviceRule(nil), record.Rules...)
+	return &c
+}
+
+// updateQuarantine records the rules that were in effect for the cgroup a quarantine is enforced on.
+func (t *containerTracker) updateQuarantine(id string, cgroupPath string, rules []cgroup.DeviceRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if record, ok := t.quarantines[id]; ok {
+		record.CgroupPath = cgroupPath
+		record.Rules = rules
+	}
+}
+
+// restoreQuarantine puts back a quarantine saved by a previous run.
+func (t *containerTracker) restoreQuarantine(id string, record quarantineRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.quarantines[id] = &record
+}
+
+// quarantined returns a copy of every quarantine by container ID, including those of containers
+// that are not tracked as they stopped.
+func (t *containerTracker) quarantined() map[string]quarantineRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	quarantines := make(map[string]quarantineRecord, len(t.quarantines))
+
+	for id, record := range t.quarantines {
+		c := *record
+		c.Rules = append([]cgroup.DeviceRule(nil), record.Rules...)
+		quarantines[id] = c
+	}
+
+	return quarantines
+}
+
+// unquarantine lifts the quarantine of a container and returns it, or nil if there was none.
+func (t *containerTracker) unquarantine(id string) *quarantineRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record := t.quarantines[id]
+	delete(t.quarantines, id)
+	return record
+}
+
+// grants returns the grants recorded for a container.
+func (t *containerTracker) grants(id string) []deviceGrant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.containers[id]
+
+	if !ok {
+		return nil
+	}
+
+	grants := make([]deviceGrant, 0, len(container.Grants))
+
+	for _, grant := range container.Grants {
+		grants = append(grants, grant)
+	}
+
+	sort.Slice(grants, func(i, j int) bool { return ruleKey(grants[i].Rule) < ruleKey(grants[j].Rule) })
+	return grants
+}
+
+func (t *containerTracker) isDenied(id string, cgroupPath string, rule cgroup.DeviceRule) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.lookup(id, cgroupPath)
+
+	if !ok {
+		return false
+	}
+
+	_, denied := container.Denials[ruleKey(rule)]
+	return denied
+}
+
+func (t *containerTracker) recordDenial(id string, cgroupPath string, rule cgroup.DeviceRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if container, ok := t.lookup(id, cgroupPath); ok {
+		container.Denials[ruleKey(rule)] = time.Now()
+	}
+}
+
+// expireGrant drops a grant whose TTL ran out so it is not granted again, reporting
+// whether the container still runs in the cgroup the grant was made to.
+func (t *containerTracker) expireGrant(id string, cgroupPath string, devicePath string, rule cgroup.DeviceRule) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.lookup(id, cgroupPath)
+
+	if !ok {
+		return false
+	}
+
+	delete(container.Grants, ruleKey(rule))
+	container.Expired[devicePath] = time.Now()
+	return true
+}
+
+func (t *containerTracker) isExpired(id string, devicePath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.containers[id]
+
+	if !ok {
+		return false
+	}
+
+	_, expired := container.Expired[devicePath]
+	return expired
+}
+
+func (t *containerTracker) recordError(id string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, ok := t.containers[id]
+
+	if !ok {
+		return
+	}
+
+	container.Errors = append(container.Errors, trackedError{Message: err.Error(), Time: time.Now()})
+
+	if len(container.Errors) > maxTrackedErrors {
+		container.Errors = container.Errors[len(container.Errors)-maxTrackedErrors:]
+	}
+}
+
+// forgetGrants drops every recorded grant, e.g. after systemd reset the device rules.
+func (t *containerTracker) forgetGrants() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, container := range t.containers {
+		container.Grants = make(map[string]deviceGrant)
+		container.Denials = make(map[string]time.Time)
+		container.processed = false
+	}
+}
+
+// restore puts back a container saved by a previous run, to be verified on its next processing pass.
+func (t *containerTracker) restore(container trackedContainer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if container.Denials == nil {
+		container.Denials = make(map[string]time.Time)
+	}
+
+	if container.Expired == nil {
+		container.Expired = make(map[string]time.Time)
+	}
+
+	container.processed = false
+	t.containers[container.ID] = &container
+}
+
+// reset forgets every tracked container.
+func (t *containerTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.containers = make(map[string]*trackedContainer)
+}
+
+func (t *containerTracker) untrack(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.containers, id)
+}
+
+func (t *containerTracker) ids() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.containers))
+
+	for id := range t.containers {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// drift returns the drifted grants of every tracked container that has any.
+func (t *containerTracker) drift() map[string][]deviceGrant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	drift := make(map[string][]deviceGrant)
+
+	for id, container := range t.containers {
+		if len(container.Drift) > 0 {
+			drift[id] = append([]deviceGrant(nil), container.Drift...)
+		}
+	}
+
+	return drift
+}
+
+// snapshot returns a copy of every tracked container, ordered by ID.
+func (t *containerTracker) snapshot() []trackedContainer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]trackedContainer, 0, len(t.containers))
+
+	for _, container := range t.containers {
+		c := *container
+		c.Grants = make(map[string]deviceGrant, len(container.Grants))
+
+		for key, grant := range container.Grants {
+			c.Grants[key] = grant
+		}
+
+		c.Denials = make(map[string]time.Time, len(container.Denials))
+
+		for key, denied := range container.Denials {
+			c.Denials[key] = denied
+		}
+
+		c.Expired = make(map[string]time.Time, len(container.Expired))
+
+		for key, expired := range container.Expired {
+			c.Expired[key] = expired
+		}
+
+		c.Drift = append([]deviceGrant(nil), container.Drift...)
+		c.Errors = append([]trackedError(nil), container.Errors...)
+		c.Mounts = append([]string(nil), container.Mounts...)
+
+		if container.Baseline != nil {
+			c.Baseline = append([]cgroup.DeviceRule{}, container.Baseline...)
+		}
+
+		snapshot = append(snapshot, c)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].ID < snapshot[j].ID })
+	return snapshot
+}
+
+// trackedStatus is a tracked container together with its pending TTL revocations and the device
+// directories watched for it.
+type trackedStatus struct {
+	trackedContainer
+	Processed   bool                 `json:"processed"`
+	Revocations map[string]time.Time `json:"revocations,omitempty"`
+	Quarantine  *quarantineRecord    `json:"quarantine,omitempty"`
+	Watching    []string             `json:"watching,omitempty"`
+}
+
+// trackedContainers returns a consistent copy of everything the daemon keeps per container.
+func trackedContainers() []trackedStatus {
+	containers := tracker.snapshot()
+	statuses := make([]trackedStatus, 0, len(containers))
+
+	for _, container := range containers {
+		statuses = append(statuses, trackedStatus{
+			trackedContainer: container,
+			Processed:        container.processed,
+			Revocations:      pendingRevocations(container.ID),
+			Quarantine:       tracker.quarantineOf(container.ID),
+			Watching:         getWatchedDirectories(container.ID),
+		})
+	}
+
+	return statuses
+}
+
+// lastApplied returns when the most recent grant was made to the container.
+func (c *trackedContainer) lastApplied() time.Time {
+	var last time.Time
+
+	for _, grant := range c.Grants {
+		if grant.Time.After(last) {
+			last = grant.Time
+		}
+	}
+
+	return last
+}
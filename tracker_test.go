@@ -0,0 +1,175 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// trackingSizes returns how many containers are tracked, quarantined, waiting for a late device and
+// waiting for a TTL revocation.
+func trackingSizes() [4]int {
+	tracker.mu.Lock()
+	containers, quarantines := len(tracker.containers), len(tracker.quarantines)
+	tracker.mu.Unlock()
+
+	lateDevices.Lock()
+	late := len(lateDevices.pending)
+	lateDevices.Unlock()
+
+	revocationTimers.Lock()
+	timers := len(revocationTimers.timers)
+	revocationTimers.Unlock()
+
+	return [4]int{containers, quarantines, late, timers}
+}
+
+// waitForSizes waits for the tracking maps to reach the given sizes, the events being handled
+// asynchronously by listenForMounts.
+func waitForSizes(t *testing.T, want [4]int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for trackingSizes() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("tracking has sizes %v (containers, quarantines, late devices, TTLs), want %v", trackingSizes(), want)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDieAndDestroyPurgeTracking(t *testing.T) {
+	const n = 200
+
+	api := newTestCGroup()
+	rule := cgroup.DeviceRule{Type: "c", Major: Ptr[int64](188), Minor: Ptr[int64](0), Access: "rwm", Allow: true}
+	baseline := trackingSizes()
+
+	for i := 0; i < n; i++ {
+		id := containerID(117000 + i)
+		resetTracking(t, id)
+
+		target := testTarget(id, api, fmt.Sprintf("/sys/fs/cgroup/churn-%d", i))
+		tracker.recordGrant(id, target.cgroupPath, "/dev/ttyUSB0", rule, true)
+		scheduleRevocation(target, "/dev/ttyUSB0", rule, time.Hour)
+		queueLateDevice(id, "/dev/ttyACM0")
+
+		if i%2 == 0 {
+			tracker.quarantine(id)
+		}
+	}
+
+	if sizes := trackingSizes(); sizes != [4]int{baseline[0] + n, baseline[1] + n/2, baseline[2] + n, baseline[3] + n} {
+		t.Fatalf("tracking has sizes %v after adding %d containers to %v", sizes, n, baseline)
+	}
+
+	msgs := make(chan events.Message)
+	go listenForMounts(nil, time.Now(), msgs, make(chan error))
+
+	send := func(action string) {
+		for i := 0; i < n; i++ {
+			msgs <- events.Message{Type: events.ContainerEventType, Action: action, Actor: events.Actor{ID: containerID(117000 + i)}}
+		}
+	}
+
+	// A container that died is forgotten, but its quarantine outlasts a restart.
+	send("die")
+	waitForSizes(t, [4]int{baseline[0], baseline[1] + n/2, baseline[2], baseline[3]})
+
+	// Only removing it lifts the quarantine.
+	send("destroy")
+	waitForSizes(t, baseline)
+}
+
+func TestSameDeviceWithDifferentAccess(t *testing.T) {
+	writer, reader := newTestTask(t), newTestTask(t)
+
+	for _, task := range []testTask{writer, reader} {
+		if err := os.WriteFile(filepath.Join(task.cgroupPath, "devices.deny"), []byte("a"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readOnly := deviceMount("/dev/null")
+	readOnly.RW = false
+
+	containers := []types.ContainerJSON{
+		runningContainer(containerID(173), writer, map[string]string{"dvd.access./dev/null": "rw"}, deviceMount("/dev/null")),
+		runningContainer(containerID(174), reader, nil, readOnly),
+	}
+	_, cli := newTestDocker(t, containers...)
+
+	for _, info := range containers {
+		resetTracking(t, info.ID)
+	}
+
+	want := map[testTask][]string{writer: {"c 1:3 rw"}, reader: {"c 1:3 r"}}
+
+	// Processing them again, in either order, neither writes nor loses the rule of the other.
+	for _, order := range [][]int{{0, 1}, {1, 0}, {0, 1}} {
+		for _, i := range order {
+			if err := processContainer(cli, containers[i].ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for task, entries := range want {
+			if actual := task.devicesList(t); !reflect.DeepEqual(actual, entries) {
+				t.Errorf("%s lists %v, want %v", task.cgroupPath, actual, entries)
+			}
+		}
+	}
+
+	for i, access := range []string{"rw", "r"} {
+		grants := tracker.grants(containers[i].ID)
+
+		if len(grants) != 1 || grants[0].Rule.Access != access {
+			t.Errorf("%s is tracked with the grants %+v, want one of %s", containers[i].ID, grants, access)
+		}
+	}
+}
+
+func TestTrackedContainersListWatchedDirectories(t *testing.T) {
+	root := newDeviceRoot(t, "usb", "input")
+	id := containerID(135)
+	resetTracking(t, id)
+	t.Cleanup(func() { unwatchContainerDevices(id) })
+
+	tracker.track(id, 1, 2, "/sys/fs/cgroup/watched")
+	watchContainerDevices(nil, id, []types.MountPoint{
+		{Source: filepath.Join(root, "usb"), Destination: "/dev/bus/usb", RW: true},
+		{Source: filepath.Join(root, "input"), Destination: "/dev/input", RW: true},
+	})
+
+	status := func() trackedStatus {
+		for _, status := range trackedContainers() {
+			if status.ID == id {
+				return status
+			}
+		}
+
+		t.Fatalf("%s is not tracked", id)
+		return trackedStatus{}
+	}
+
+	if want := []string{filepath.Join(root, "input"), filepath.Join(root, "usb")}; !reflect.DeepEqual(status().Watching, want) {
+		t.Errorf("%s is watching %v, want %v", id, status().Watching, want)
+	}
+
+	unwatchContainerDevices(id)
+
+	if watching := status().Watching; len(watching) != 0 {
+		t.Errorf("%s is still watching %v once unwatched", id, watching)
+	}
+}
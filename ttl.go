@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocationTimers holds the pending TTL revocations and when they fire, keyed by container and device path.
+var revocationTimers = struct {
+	sync.Mutex
+	timers    map[string]*time.Timer
+	deadlines map[string]time.Time
+}{timers: make(map[string]*time.Timer), deadlines: make(map[string]time.Time)}
+
+// getDeviceTTL returns how long a device may stay granted, or zero when its ttl.<device> label is unset.
+func getDeviceTTL(target deviceTarget, devicePath string) (time.Duration, error) {
+	key, value, ok := getDeviceLabel(target.labels, "ttl", devicePath)
+
+	if !ok {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s label %q: expected a positive duration such as 10m", key, value)
+	}
+
+	return ttl, nil
+}
+
+// hasRevocationBudget reports whether another TTL revocation can be scheduled without exceeding
+// maxRevocationTimers. Replacing the pending revocation of a device is always possible.
+func hasRevocationBudget(id string, devicePath string) bool {
+	revocationTimers.Lock()
+	defer revocationTimers.Unlock()
+
+	if _, ok := revocationTimers.timers[id+" "+devicePath]; ok {
+		return true
+	}
+
+	return maxRevocationTimers <= 0 || len(revocationTimers.timers) < maxRevocationTimers
+}
+
+func scheduleRevocation(target deviceTarget, devicePath string, rule cgroup.DeviceRule, ttl time.Duration) {
+	key := target.id + " " + devicePath
+
+	revocationTimers.Lock()
+	defer revocationTimers.Unlock()
+
+	if timer, ok := revocationTimers.timers[key]; ok {
+		timer.Stop()
+	}
+
+	log.Printf("%s will be revoked from %s in %v\n", devicePath, target.id, ttl)
+
+	revocationTimers.deadlines[key] = time.Now().Add(ttl)
+	revocationTimers.timers[key] = time.AfterFunc(ttl, func() {
+		revocationTimers.Lock()
+		delete(revocationTimers.timers, key)
+		delete(revocationTimers.deadlines, key)
+		revocationTimers.Unlock()
+
+		revokeExpiredDevice(target, devicePath, rule)
+	})
+}
+
+func revokeExpiredDevice(target deviceTarget, devicePath string, rule cgroup.DeviceRule) {
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	// The container may have been restarted into a new cgroup since the grant.
+	if !tracker.expireGrant(target.id, target.cgroupPath, devicePath, rule) {
+		return
+	}
+
+	log.Printf("TTL expired, revoking %s from %s at %s\n", devicePath, target.id, target.cgroupPath)
+
+	if err := revokeRules(target.api, target.id, target.cgroupPath, []cgroup.DeviceRule{rule}); err != nil {
+		log.Println(err)
+		return
+	}
+
+	publish(eventRevoked, target.id, devicePath, &rule)
+	saveState()
+}
+
+// cancelRevocations stops the pending TTL revocations of a container.
+func cancelRevocations(id string) {
+	revocationTimers.Lock()
+	defer revocationTimers.Unlock()
+
+	for key, timer := range revocationTimers.timers {
+		if strings.HasPrefix(key, id+" ") {
+			timer.Stop()
+			delete(revocationTimers.timers, key)
+			delete(revocationTimers.deadlines, key)
+		}
+	}
+}
+
+// pendingRevocations returns when each pending TTL revocation of a container fires, keyed by device path.
+func pendingRevocations(id string) map[string]time.Time {
+	revocationTimers.Lock()
+	defer revocationTimers.Unlock()
+
+	pending := make(map[string]time.Time)
+
+	for key, deadline := range revocationTimers.deadlines {
+		if strings.HasPrefix(key, id+" ") {
+			pending[strings.TrimPrefix(key, id+" ")] = deadline
+		}
+	}
+
+	return pending
+}
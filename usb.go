@@ -0,0 +1,138 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// getUSBDevicePaths returns the device nodes of every USB device matching one of the comma separated
+// vendor:product IDs in value, e.g. "0403:6001", such as its ttyUSB, hidraw and /dev/bus/usb nodes.
+func getUSBDevicePaths(id string, value string) []string {
+	var devicePaths []string
+
+	for _, usbID := range strings.Split(value, ",") {
+		usbID = strings.ToLower(strings.TrimSpace(usbID))
+
+		if usbID == "" {
+			continue
+		}
+
+		vendor, product, found := strings.Cut(usbID, ":")
+
+		if !found || len(vendor) != 4 || len(product) != 4 {
+			log.Printf("invalid USB ID %q in label %s: expected <vendor>:<product>, e.g. 0403:6001\n", usbID, labelKey("usb"))
+			continue
+		}
+
+		log.Printf("%s requested USB devices %s via the label %s\n", id, usbID, labelKey("usb"))
+
+		matches, err := findUSBDeviceNodes(vendor, product)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if len(matches) == 0 {
+			log.Printf("no USB device %s is plugged in\n", usbID)
+		}
+
+		devicePaths = append(devicePaths, matches...)
+	}
+
+	return devicePaths
+}
+
+// findUSBDeviceNodes walks the sysfs topology of each USB device with the given vendor and product
+// and returns the device nodes of it and of everything the kernel bound to its interfaces.
+func findUSBDeviceNodes(vendor string, product string) ([]string, error) {
+	usbDevicesPath := path.Join(rootPath, "sys/bus/usb/devices")
+
+	entries, err := os.ReadDir(usbDevicesPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var devicePaths []string
+
+	for _, entry := range entries {
+		devicePath := path.Join(usbDevicesPath, entry.Name())
+
+		if readSysfsValue(path.Join(devicePath, "idVendor")) != vendor || readSysfsValue(path.Join(devicePath, "idProduct")) != product {
+			continue
+		}
+
+		// The entries are symlinks into /sys/devices, below which the walk must not follow links.
+		resolvedPath, err := filepath.EvalSymlinks(devicePath)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = filepath.Walk(resolvedPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || info.Name() != "uevent" {
+				return nil
+			}
+
+			devName := getUeventDevName(path)
+
+			if devName == "" {
+				return nil
+			}
+
+			if devicePath, err := normalizeDevicePath(path, "/dev/"+devName); err != nil {
+				log.Println(err)
+			} else {
+				devicePaths = append(devicePaths, devicePath)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return devicePaths, nil
+}
+
+// getUeventDevName returns the DEVNAME of a sysfs uevent file, which is only set for nodes in /dev.
+func getUeventDevName(ueventPath string) string {
+	file, err := os.Open(ueventPath)
+
+	if err != nil {
+		return ""
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), "DEVNAME="); value != scanner.Text() {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// readSysfsValue returns the trimmed content of a sysfs attribute, or an empty string if it is unreadable.
+func readSysfsValue(attributePath string) string {
+	content, err := os.ReadFile(attributePath)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
@@ -0,0 +1,161 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// containerUser is the user and groups a container's process runs as, resolved for user policies.
+type containerUser struct {
+	uid  uint32
+	gids []uint32
+
+	// err is set when the user could not be resolved, in which case no user policy is satisfied.
+	err error
+}
+
+// resolveContainerUser resolves the configured user of a container, "<user>[:<group>]" with names
+// looked up in the container's own /etc/passwd and /etc/group. Groups added with --group-add count too.
+func resolveContainerUser(info types.ContainerJSON, visible bool) containerUser {
+	user := containerUser{gids: []uint32{0}}
+
+	if info.Config == nil || info.Config.User == "" {
+		return user
+	}
+
+	name, group, hasGroup := strings.Cut(info.Config.User, ":")
+
+	uid, primaryGid, err := lookupContainerID(info.State.Pid, visible, "/etc/passwd", name)
+
+	if err != nil {
+		user.err = fmt.Errorf("unable to resolve user %q of %s: %v", name, info.ID, err)
+		return user
+	}
+
+	user.uid = uid
+	user.gids = []uint32{primaryGid}
+
+	if hasGroup {
+		gid, _, err := lookupContainerID(info.State.Pid, visible, "/etc/group", group)
+
+		if err != nil {
+			user.err = fmt.Errorf("unable to resolve group %q of %s: %v", group, info.ID, err)
+			return user
+		}
+
+		user.gids = []uint32{gid}
+	}
+
+	if info.HostConfig != nil {
+		for _, added := range info.HostConfig.GroupAdd {
+			gid, _, err := lookupContainerID(info.State.Pid, visible, "/etc/group", added)
+
+			if err != nil {
+				user.err = fmt.Errorf("unable to resolve added group %q of %s: %v", added, info.ID, err)
+				return user
+			}
+
+			user.gids = append(user.gids, gid)
+		}
+	}
+
+	return user
+}
+
+// lookupContainerID resolves a user or group name, or number, through a passwd or group file of the
+// container. It returns the ID and, for passwd entries, the primary group, 0 if the user has no entry.
+func lookupContainerID(pid int, visible bool, database string, name string) (uint32, uint32, error) {
+	number, numberErr := strconv.ParseUint(name, 10, 32)
+
+	var content string
+	var err error
+
+	if visible {
+		content, err = readContainerFile(pid, database)
+	}
+
+	if !visible || err != nil {
+		if numberErr == nil {
+			return uint32(number), 0, nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("the container's %s can't be read without its process", database)
+		}
+
+		return 0, 0, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+
+	for scanner.Scan() {
+		// name:password:id[:gid:...]
+		fields := strings.Split(scanner.Text(), ":")
+
+		if len(fields) < 3 {
+			continue
+		}
+
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+
+		if err != nil || (fields[0] != name && (numberErr != nil || id != number)) {
+			continue
+		}
+
+		var gid uint64
+
+		if len(fields) > 3 && database == "/etc/passwd" {
+			gid, _ = strconv.ParseUint(fields[3], 10, 32)
+		}
+
+		return uint32(id), uint32(gid), nil
+	}
+
+	if numberErr == nil {
+		return uint32(number), 0, nil
+	}
+
+	return 0, 0, fmt.Errorf("no entry for %q in %s", name, database)
+}
+
+// checkUserPolicies reports an error when a user policy covers devicePath and the container runs as
+// none of the users or groups it allows. The most specific policy for the device decides.
+func checkUserPolicies(target deviceTarget, devicePath string) error {
+	var match *userPolicy
+
+	for i, policy := range config.Users {
+		if isPathWithin(devicePath, policy.Device) && (match == nil || len(policy.Device) > len(match.Device)) {
+			match = &config.Users[i]
+		}
+	}
+
+	if match == nil {
+		return nil
+	}
+
+	if target.user.err != nil {
+		return fmt.Errorf("not granting %s to %s: %v", devicePath, target.id, target.user.err)
+	}
+
+	for _, uid := range match.UIDs {
+		if uid == target.user.uid {
+			return nil
+		}
+	}
+
+	for _, gid := range match.GIDs {
+		for _, containerGid := range target.user.gids {
+			if gid == containerGid {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("not granting %s to %s: running as uid %d and gids %v, the user policy for %s allows uids %v and gids %v", devicePath, target.id, target.user.uid, target.user.gids, match.Device, match.UIDs, match.GIDs)
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package main
+
+import (
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// listRulesFromContainer reads the device rules in effect for a container from its own vantage point:
+// a thread joins the container's cgroup namespace and reads the cgroup it sees as its root through the
+// container's filesystem, which also works where the host's view of the cgroup is blocked.
+func listRulesFromContainer(api cgroup.Interface, version int, pid int) ([]cgroup.DeviceRule, error) {
+	type result struct {
+		rules []cgroup.DeviceRule
+		err   error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		rules, restored, err := listRulesInCGroupNamespace(api, version, pid)
+
+		// A thread that could not be moved back stays locked, so it's discarded when the goroutine
+		// exits rather than being reused in the container's namespace.
+		if restored {
+			runtime.UnlockOSThread()
+		}
+
+		results <- result{rules, err}
+	}()
+
+	r := <-results
+	return r.rules, r.err
+}
+
+// listRulesInCGroupNamespace does the work of listRulesFromContainer on a locked thread, reporting
+// whether the thread is back in its original cgroup namespace.
+func listRulesInCGroupNamespace(api cgroup.Interface, version int, pid int) ([]cgroup.DeviceRule, bool, error) {
+	original, err := os.Open("/proc/thread-self/ns/cgroup")
+
+	if err != nil {
+		return nil, true, err
+	}
+
+	defer original.Close()
+
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/cgroup", pid))
+
+	if err != nil {
+		return nil, true, err
+	}
+
+	defer target.Close()
+
+	var originalStat, targetStat unix.Stat_t
+
+	if err := unix.Fstat(int(original.Fd()), &originalStat); err != nil {
+		return nil, true, err
+	}
+
+	if err := unix.Fstat(int(target.Fd()), &targetStat); err != nil {
+		return nil, true, err
+	}
+
+	// Without a namespace of its own, the container's root cgroup is the host's and says nothing about it.
+	if originalStat.Ino == targetStat.Ino {
+		return nil, true, fmt.Errorf("process %d shares the daemon's cgroup namespace, cannot verify from inside", pid)
+	}
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWCGROUP); err != nil {
+		return nil, true, fmt.Errorf("unable to join the cgroup namespace of process %d: %v", pid, err)
+	}
+
+	cgroupPath := fmt.Sprintf("/proc/%d/root/sys/fs/cgroup", pid)
+
+	if version == 1 {
+		cgroupPath = path.Join(cgroupPath, "devices")
+	}
+
+	rules, err := api.ListDeviceRules(cgroupPath)
+
+	if restoreErr := unix.Setns(int(original.Fd()), unix.CLONE_NEWCGROUP); restoreErr != nil {
+		log.Printf("unable to leave the cgroup namespace of process %d: %v\n", pid, restoreErr)
+		return rules, false, err
+	}
+
+	return rules, true, err
+}
+
+// verifyFromContainer checks, from inside the container's cgroup namespace, that every allow among
+// requests took effect, failing the summary for each one that did not.
+func verifyFromContainer(target deviceTarget, version int, requests []deviceRequest) {
+	rules, err := listRulesFromContainer(target.api, version, target.pid)
+
+	if err != nil {
+		target.summary.fail(fmt.Errorf("unable to verify the rules of %s from inside: %v", target.id, err))
+		return
+	}
+
+	verified := 0
+
+	for _, request := range requests {
+		if !request.rule.Allow || tracker.isExpired(target.id, request.path) {
+			continue
+		}
+
+		if !cgroup.Allows(rules, request.rule) {
+			target.summary.fail(fmt.Errorf("%s is not allowed inside %s after granting %s", request.path, target.id, ruleKey(request.rule)))
+			continue
+		}
+
+		verified++
+	}
+
+	log.Printf("Verified %d rules from inside %s\n", verified, target.id)
+}
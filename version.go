@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g. go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo identifies the running build.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// getBuildInfo returns the build info set through ldflags, falling back to the VCS stamp Go embeds
+// when building from a checkout.
+func getBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+
+	if embedded, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range embedded.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	return info
+}
+
+// versionCommand returns the build info: version
+func versionCommand(args []string) (any, error) {
+	return getBuildInfo(), nil
+}
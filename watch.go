@@ -0,0 +1,263 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"golang.org/x/sys/unix"
+)
+
+// watchMask reports the nodes created in or moved into a watched directory.
+const watchMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// deviceWatcher watches the device directories mounted into running containers, reprocessing the
+// containers mounting a directory when a node appears in it, e.g. a hotplugged USB device.
+var deviceWatcher = struct {
+	sync.Mutex
+	fd        int
+	paths     map[int]string             // watched directories by watch descriptor
+	wds       map[string]int             // watch descriptors by watched directory
+	roots     map[string]map[string]bool // containers by mounted directory
+	exhausted bool                       // no more watches could be added, logged once until some are removed
+}{fd: -1, paths: make(map[int]string), wds: make(map[string]int), roots: make(map[string]map[string]bool)}
+
+// watchContainerDevices watches the device directories within deviceRoots among the mounts of a
+// container, along with the directories below them.
+func watchContainerDevices(cli *client.Client, id string, mounts []types.MountPoint) {
+	deviceWatcher.Lock()
+	defer deviceWatcher.Unlock()
+
+	for _, mount := range mounts {
+		root := filepath.Clean(mount.Source)
+
+		if !isDeviceSource(root) || deviceWatcher.roots[root][id] {
+			continue
+		}
+
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			continue
+		}
+
+		if deviceWatcher.fd < 0 {
+			fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+
+			if err != nil {
+				log.Printf("unable to watch device directories: %v\n", err)
+				return
+			}
+
+			deviceWatcher.fd = fd
+			go readDeviceEvents(cli, fd)
+		}
+
+		if deviceWatcher.roots[root] == nil {
+			deviceWatcher.roots[root] = make(map[string]bool)
+		}
+
+		log.Printf("Watching %s for devices created for %s\n", root, id)
+
+		deviceWatcher.roots[root][id] = true
+		addDeviceWatches(root)
+	}
+}
+
+// errWatchBudget stops a walk adding watches once maxWatchers are in use.
+var errWatchBudget = errors.New("watch budget exhausted")
+
+// addDeviceWatches watches a directory and those below it, as long as maxWatchers and the kernel's
+// fs.inotify.max_user_watches allow. The caller holds deviceWatcher.
+func addDeviceWatches(directory string) {
+	filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		if _, ok := deviceWatcher.wds[path]; ok {
+			return nil
+		}
+
+		if maxWatchers > 0 && len(deviceWatcher.wds) >= maxWatchers {
+			exhaustWatches(path, directory, "DVD_MAX_WATCHERS")
+			return errWatchBudget
+		}
+
+		wd, err := unix.InotifyAddWatch(deviceWatcher.fd, path, watchMask)
+
+		// The kernel's limit is shared with every other process of the user, so nothing more is tried.
+		if err == unix.ENOSPC {
+			exhaustWatches(path, directory, "fs.inotify.max_user_watches")
+			return errWatchBudget
+		} else if err != nil {
+			log.Printf("unable to watch %s: %v\n", path, err)
+			return filepath.SkipDir
+		}
+
+		deviceWatcher.paths[wd], deviceWatcher.wds[path] = path, wd
+		return nil
+	})
+}
+
+// exhaustWatches logs, once until watches are removed, that path and the rest of directory are left
+// unwatched because limit is reached. The caller holds deviceWatcher.
+func exhaustWatches(path string, directory string, limit string) {
+	if deviceWatcher.exhausted {
+		return
+	}
+
+	deviceWatcher.exhausted = true
+	log.Printf("WARNING: not watching %s and what remains below %s, %d directories are watched already (%s); nodes created there are granted on the next reconcile pass\n", path, directory, len(deviceWatcher.wds), limit)
+}
+
+// unwatchContainerDevices stops watching the directories only a container, now gone, mounted.
+func unwatchContainerDevices(id string) {
+	deviceWatcher.Lock()
+	defer deviceWatcher.Unlock()
+
+	for root, ids := range deviceWatcher.roots {
+		if delete(ids, id); len(ids) == 0 {
+			delete(deviceWatcher.roots, root)
+		}
+	}
+
+	for path, wd := range deviceWatcher.wds {
+		if len(getWatchingContainers(path)) == 0 {
+			log.Printf("No longer watching %s\n", path)
+
+			unix.InotifyRmWatch(deviceWatcher.fd, uint32(wd))
+			delete(deviceWatcher.wds, path)
+			delete(deviceWatcher.paths, wd)
+			deviceWatcher.exhausted = false
+		}
+	}
+}
+
+// getWatchedDirectories returns the mounted directories watched for a container.
+func getWatchedDirectories(id string) []string {
+	deviceWatcher.Lock()
+	defer deviceWatcher.Unlock()
+
+	var directories []string
+
+	for root, ids := range deviceWatcher.roots {
+		if ids[id] {
+			directories = append(directories, root)
+		}
+	}
+
+	sort.Strings(directories)
+	return directories
+}
+
+// getWatchingContainers returns the containers mounting a directory containing path. The caller holds
+// deviceWatcher.
+func getWatchingContainers(path string) []string {
+	watching := make(map[string]bool)
+
+	for root, ids := range deviceWatcher.roots {
+		if isPathWithin(path, root) {
+			for id := range ids {
+				watching[id] = true
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(watching))
+
+	for id := range watching {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// readDeviceEvents reprocesses the containers watching a directory whenever a node appears in it,
+// granting it through the usual rules, and watches the directories that appear too.
+func readDeviceEvents(cli *client.Client, fd int) {
+	buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.PathMax))
+
+	for {
+		n, err := unix.Read(fd, buffer)
+
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			log.Printf("ERROR: stopped watching device directories: %v\n", err)
+			return
+		}
+
+		reprocess := make(map[string]bool)
+
+		deviceWatcher.Lock()
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			name := strings.TrimRight(string(buffer[offset+unix.SizeofInotifyEvent:offset+unix.SizeofInotifyEvent+int(event.Len)]), "\x00")
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			// Events were lost, so any watched directory may hold new nodes.
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				for path := range deviceWatcher.wds {
+					for _, id := range getWatchingContainers(path) {
+						reprocess[id] = true
+					}
+				}
+
+				continue
+			}
+
+			directory, ok := deviceWatcher.paths[int(event.Wd)]
+
+			if !ok {
+				continue
+			}
+
+			// The directory was removed or unmounted.
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(deviceWatcher.paths, int(event.Wd))
+				delete(deviceWatcher.wds, directory)
+				continue
+			}
+
+			path := filepath.Join(directory, name)
+
+			if event.Mask&unix.IN_ISDIR != 0 {
+				addDeviceWatches(path)
+			}
+
+			for _, id := range getWatchingContainers(path) {
+				log.Printf("%s appeared, reprocessing the devices of %s\n", path, id)
+				recordAppearedDevice(id, path)
+				reprocess[id] = true
+			}
+		}
+
+		deviceWatcher.Unlock()
+
+		for id := range reprocess {
+			processContainer(cli, id)
+		}
+	}
+}
+
+// readSysctlInt reads a kernel setting holding a single number, e.g. below /proc/sys.
+func readSysctlInt(path string) (int, error) {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
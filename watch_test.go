@@ -0,0 +1,151 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"device-volume-driver/internal/cgroup"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// newDeviceRoot creates a directory treated as a device source, with the given subdirectories.
+func newDeviceRoot(t testing.TB, subdirectories ...string) string {
+	t.Helper()
+
+	root := t.TempDir()
+
+	for _, subdirectory := range subdirectories {
+		if err := os.MkdirAll(filepath.Join(root, subdirectory), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := deviceRoots
+	deviceRoots = append(append([]string(nil), deviceRoots...), root)
+	t.Cleanup(func() { deviceRoots = previous })
+
+	return root
+}
+
+// countFds returns the number of file descriptors the test process has open.
+func countFds(t *testing.T) int {
+	t.Helper()
+
+	entries, err := os.ReadDir("/proc/self/fd")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(entries)
+}
+
+func TestWatchBudget(t *testing.T) {
+	root := newDeviceRoot(t, "a", "b", "c", "d")
+
+	previous := maxWatchers
+	maxWatchers = 3
+	t.Cleanup(func() { maxWatchers = previous })
+
+	id := containerID(137)
+	t.Cleanup(func() { unwatchContainerDevices(id) })
+
+	watchContainerDevices(nil, id, []types.MountPoint{{Source: root, Destination: "/dev/test", RW: true}})
+
+	deviceWatcher.Lock()
+	watched := len(deviceWatcher.wds)
+	deviceWatcher.Unlock()
+
+	if watched != 3 {
+		t.Errorf("%d directories are watched, want the budget of 3", watched)
+	}
+}
+
+func TestWatchBudgetLoggedOnce(t *testing.T) {
+	root := newDeviceRoot(t, "a", "b", "c", "d")
+
+	previous := maxWatchers
+	maxWatchers = 1
+	t.Cleanup(func() { maxWatchers = previous })
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	first, second := containerID(262), containerID(263)
+	t.Cleanup(func() { unwatchContainerDevices(first); unwatchContainerDevices(second) })
+
+	watchContainerDevices(nil, first, []types.MountPoint{{Source: root, Destination: "/dev/test", RW: true}})
+	watchContainerDevices(nil, second, []types.MountPoint{{Source: filepath.Join(root, "c"), Destination: "/dev/test", RW: true}})
+
+	if logged := strings.Count(output.String(), "not watching"); logged != 1 {
+		t.Errorf("reaching the budget was logged %d times, want once:\n%s", logged, output.String())
+	}
+
+	// Removing watches makes room again, so reaching the budget anew is logged again.
+	unwatchContainerDevices(first)
+	output.Reset()
+	watchContainerDevices(nil, first, []types.MountPoint{{Source: root, Destination: "/dev/test", RW: true}})
+
+	if logged := strings.Count(output.String(), "not watching"); logged != 1 {
+		t.Errorf("reaching the budget again was logged %d times, want once:\n%s", logged, output.String())
+	}
+}
+
+func TestWatchersAndTimersAreReclaimed(t *testing.T) {
+	root := newDeviceRoot(t, "bus/usb/001", "bus/usb/002", "input")
+	mounts := []types.MountPoint{{Source: root, Destination: "/dev/test", RW: true}}
+	api := newTestCGroup()
+	rule := cgroup.DeviceRule{Type: "c", Major: Ptr[int64](188), Minor: Ptr[int64](0), Access: "rwm", Allow: true}
+
+	// One round first, so the inotify fd and its reader, shared by every container, exist.
+	churn := func(n int) {
+		for i := 0; i < n; i++ {
+			id := containerID(10000 + i)
+			target := testTarget(id, api, fmt.Sprintf("/sys/fs/cgroup/churn-%d", i))
+
+			watchContainerDevices(nil, id, mounts)
+			scheduleRevocation(target, "/dev/ttyUSB0", rule, time.Hour)
+			forgetContainer(id)
+		}
+	}
+
+	churn(1)
+
+	fds, goroutines := countFds(t), runtime.NumGoroutine()
+
+	churn(500)
+
+	deviceWatcher.Lock()
+	watched, roots := len(deviceWatcher.wds), len(deviceWatcher.roots)
+	deviceWatcher.Unlock()
+
+	if watched != 0 || roots != 0 {
+		t.Errorf("%d watches of %d directories outlived their containers", watched, roots)
+	}
+
+	revocationTimers.Lock()
+	timers := len(revocationTimers.timers)
+	revocationTimers.Unlock()
+
+	if timers != 0 {
+		t.Errorf("%d TTL revocations outlived their containers", timers)
+	}
+
+	if after := countFds(t); after > fds {
+		t.Errorf("churning containers grew the open fds from %d to %d", fds, after)
+	}
+
+	if after := runtime.NumGoroutine(); after > goroutines+2 {
+		t.Errorf("churning containers grew the goroutines from %d to %d", goroutines, after)
+	}
+}